@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * rebuild --blue-green
+ */
+
+// Starts the new container next to the old one, under a temporary name and the other
+// slot's ports. Once it's healthy, the old container is removed and the new one takes
+// its name. When it isn't, it is removed and the old container keeps serving.
+func (r *RebuildCmd) swapContainers(cli *Cli, ctx context.Context, conf *config.Config, extraEnv []string) error {
+	next := r.Config + "-next"
+
+	state, err := docker.Backend.ContainerState(ctx, r.Config)
+	if err != nil {
+		return err
+	}
+	var current *docker.ContainerInspect
+	if state != nil {
+		if current, err = docker.Backend.InspectContainer(ctx, state.Id); err != nil {
+			return err
+		}
+	}
+	slot := docker.OtherSlot(docker.ContainerSlot(current))
+
+	// left by an interrupted deploy
+	leftover, err := docker.Backend.ContainerState(ctx, next)
+	if err != nil {
+		return err
+	}
+	if leftover != nil {
+		if err := docker.Backend.Remove(ctx, next, true); err != nil {
+			return err
+		}
+	}
+
+	slotConf := *conf
+	slotConf.Expose = docker.SlotExpose(conf, slot)
+	start := StartCmd{Config: r.Config, extraEnv: extraEnv}
+	runner, err := start.runner(&slotConf)
+	if err != nil {
+		return err
+	}
+	runner.ContainerId = next
+	runner.ExtraFlags = append(runner.ExtraFlags, "--label", docker.SlotLabel+"="+slot)
+
+	if err := recordBootMigrations(cli.StateDir, r.Config, conf, extraEnv); err != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, "starting "+next+" next to "+r.Config+"...") //nolint:errcheck
+	err = runner.Run(ctx)
+	if err == nil {
+		err = waitHealthy(ctx, conf, next, r.WaitTimeout)
+	}
+	if err != nil {
+		removeCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if removeErr := docker.Backend.Remove(removeCtx, next, true); removeErr != nil {
+			fmt.Fprintln(utils.Out, "could not remove "+next+": "+removeErr.Error()) //nolint:errcheck
+		}
+		if state != nil {
+			fmt.Fprintln(utils.Out, r.Config+" was left running") //nolint:errcheck
+		}
+		return err
+	}
+
+	if state != nil {
+		destroy := DestroyCmd{Config: r.Config}
+		if err := destroy.Run(cli, ctx); err != nil {
+			return err
+		}
+	}
+	return docker.Backend.Rename(ctx, next, r.Config)
+}
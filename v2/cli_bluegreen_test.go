@@ -0,0 +1,130 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("BlueGreen", func() {
+	var testDir string
+	var confDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	// commands after the image is configured
+	var deployCmds = func() []string {
+		cmds := []string{}
+		for _, cmd := range RanCmds {
+			cmds = append(cmds, cmd.String())
+		}
+		for i, cmd := range cmds {
+			if strings.Contains(cmd, "docker commit") {
+				// the build container is removed after the commit
+				return cmds[i+2:]
+			}
+		}
+		return cmds
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		confDir, _ = os.MkdirTemp("", "ddocker-conf")
+		ctx = context.Background()
+
+		webOnly, _ := os.ReadFile("./test/containers/web_only.yml")
+		webOnly = append(webOnly, []byte("\nblue_green:\n  expose:\n    - \"8080:80\"\n    - \"8443:443\"\n")...)
+		os.WriteFile(filepath.Join(confDir, "web_only.yml"), webOnly, 0644) //nolint:errcheck
+		standalone, _ := os.ReadFile("./test/containers/standalone.yml")
+		os.WriteFile(filepath.Join(confDir, "standalone.yml"), standalone, 0644) //nolint:errcheck
+
+		cli = &ddocker.Cli{
+			ConfDir:      confDir,
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponse = []byte("456\tweb_only\tlocal_discourse/web_only\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n")
+		CmdOutputResponses["container inspect"] = []byte(`[{"Id": "456", "State": {"Status": "running", "Running": true}}]`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir) //nolint:errcheck
+		os.RemoveAll(confDir) //nolint:errcheck
+	})
+
+	It("starts the new container on the other ports before replacing the old one", func() {
+		runner := ddocker.RebuildCmd{Config: "web_only", BlueGreen: true, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		cmds := deployCmds()
+		Expect(cmds[0]).To(ContainSubstring("docker ps --all --no-trunc --filter name=^web_only$"))
+		Expect(cmds[1]).To(ContainSubstring("docker container inspect 456"))
+		Expect(cmds[2]).To(ContainSubstring("docker ps --all --no-trunc --filter name=^web_only-next$"))
+		Expect(cmds[3]).To(ContainSubstring("docker run"))
+		Expect(cmds[3]).To(ContainSubstring("--publish 8080:80 --publish 8443:443"))
+		Expect(cmds[3]).ToNot(ContainSubstring("--publish 80:80"))
+		Expect(cmds[3]).To(ContainSubstring("--label org.discourse.launcher.slot=green"))
+		Expect(cmds[3]).To(ContainSubstring("--name web_only-next local_discourse/web_only"))
+		Expect(cmds[4]).To(ContainSubstring("docker container inspect web_only-next"))
+		Expect(cmds[5]).To(ContainSubstring("docker exec web_only-next sh -c case $(curl"))
+		// only then is the old container replaced
+		Expect(cmds[6]).To(ContainSubstring("docker ps --all --no-trunc --filter name=^web_only$"))
+		Expect(cmds[7]).To(ContainSubstring("docker stop --time 600 web_only"))
+		Expect(cmds[8]).To(ContainSubstring("docker rm web_only"))
+		Expect(cmds[9]).To(ContainSubstring("docker rename web_only-next web_only"))
+		Expect(cmds[10]).To(ContainSubstring("--tags=db,migrate"))
+		Expect(cmds[10]).ToNot(ContainSubstring("SKIP_POST_DEPLOYMENT_MIGRATIONS"))
+		Expect(cmds).To(HaveLen(11))
+	})
+
+	It("moves back to the ports in expose from the green slot", func() {
+		CmdOutputResponses["container inspect"] = []byte(`[{"Id": "456", "State": {"Status": "running", "Running": true}, "Config": {"Labels": {"org.discourse.launcher.slot": "green"}}}]`)
+		runner := ddocker.RebuildCmd{Config: "web_only", BlueGreen: true, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		cmds := deployCmds()
+		Expect(cmds[3]).To(ContainSubstring("--publish 80:80 --publish 443:443"))
+		Expect(cmds[3]).To(ContainSubstring("--label org.discourse.launcher.slot=blue"))
+	})
+
+	It("keeps the old container when the new one is not healthy", func() {
+		CmdOutputResponses["container inspect web_only-next"] = []byte(`[{"Id": "789", "State": {"Status": "exited", "Running": false}}]`)
+		runner := ddocker.RebuildCmd{Config: "web_only", BlueGreen: true, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(MatchError("web_only-next is exited"))
+
+		cmds := deployCmds()
+		Expect(cmds[5]).To(ContainSubstring("docker logs web_only-next"))
+		Expect(cmds[6]).To(ContainSubstring("docker rm --force web_only-next"))
+		Expect(cmds).To(HaveLen(7))
+		Expect(out.String()).To(ContainSubstring("web_only was left running"))
+	})
+
+	It("needs an external database", func() {
+		runner := ddocker.RebuildCmd{Config: "standalone", BlueGreen: true, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(MatchError(ContainSubstring("--blue-green needs an external database")))
+		Expect(RanCmds).To(BeEmpty())
+	})
+
+	It("needs alternate ports for published ports", func() {
+		webOnly, _ := os.ReadFile("./test/containers/web_only.yml")
+		os.WriteFile(filepath.Join(confDir, "web_only.yml"), webOnly, 0644) //nolint:errcheck
+		runner := ddocker.RebuildCmd{Config: "web_only", BlueGreen: true, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(MatchError(ContainSubstring("set blue_green: expose: in the config")))
+		Expect(RanCmds).To(BeEmpty())
+	})
+})
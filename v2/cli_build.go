@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/discourse/launcher/v2/config"
@@ -19,24 +22,73 @@ import (
  * bootstrap
  */
 type DockerBuildCmd struct {
-	BakeEnv    bool     `short:"e" help:"Bake in the configured environment to image after build."`
-	BuildSlim  bool     `hidden:"" help:"Build a minimal image from a multistage build"`
-	Tag        string   `short:"t" help:"Resulting image tag. Defaults to 'local_discourse/{config}'"`
-	Config     string   `arg:"" name:"config" help:"configuration" predictor:"config" passthrough:""`
-	ExtraFlags []string `arg:"" optional:"" name:"docker-build-flags" help:"Extra build flags for docker build"`
+	BakeEnv       bool   `short:"e" help:"Bake in the configured environment to image after build."`
+	BuildSlim     bool   `hidden:"" help:"Build a minimal image from a multistage build"`
+	Tag           string `short:"t" help:"Resulting image tag. Defaults to 'local_discourse/{config}'"`
+	SkipPreflight bool   `name:"skip-preflight" help:"Build without first checking the config for problems that would fail the build."`
+	All           bool   `name:"all" help:"Build every config in the conf dir."`
+	Parallel      int    `name:"parallel" default:"1" help:"Number of sites to build at once."`
+	// configs, then extra build flags for docker build
+	Args []string `arg:"" optional:"" name:"config" help:"Configs to build, followed by extra build flags for docker build." predictor:"config" passthrough:""`
+
+	// parsed from Args, unless set by another command
+	Config     string   `kong:"-"`
+	ExtraFlags []string `kong:"-"`
+
+	stdout io.Writer
+	stderr io.Writer
 }
 
-func (r *DockerBuildCmd) Run(cli *Cli, ctx context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+func (r *DockerBuildCmd) Run(cli *Cli, ctx context.Context) (err error) {
+	if r.Config == "" {
+		// docker build flags start with a dash, configs don't
+		i := slices.IndexFunc(r.Args, func(arg string) bool { return strings.HasPrefix(arg, "-") })
+		if i < 0 {
+			i = len(r.Args)
+		}
+		names, err := siteNames(cli, r.Args[:i], r.All)
+		if err != nil {
+			return err
+		}
+		if r.Tag != "" && len(names) > 1 {
+			return errors.New("--tag names the image of a single site")
+		}
+		extraFlags := r.Args[i:]
+		return runSites(cli, ctx, "build", names, r.Parallel, func(cli *Cli, name string) sitePhases {
+			site := *r
+			site.Config, site.ExtraFlags = name, extraFlags
+			return sitePhases{build: func(ctx context.Context, stdout io.Writer, stderr io.Writer) error {
+				site.stdout, site.stderr = stdout, stderr
+				return site.Run(cli, ctx)
+			}}
+		})
+	}
+	ctx, unlock, err := lockSite(cli, ctx, "build", r.Config)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+	defer utils.StartPhase("build", r.Config).Finish(&err)
+	ctx, history := startHistory(cli, ctx, "build", r.Config)
+	defer history.finish(ctx, &err)
+	if !r.SkipPreflight {
+		if err := preflight(cli, r.Config); err != nil {
+			return err
+		}
+	}
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		return err
+	}
+	historyLoaded(ctx, config, r.tag())
 
 	dir := cli.BuildDir
 	if dir == "" {
 		if dir, err = os.MkdirTemp("", "launcher"); err != nil {
 			return err
 		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
 	}
 	defer os.RemoveAll(dir) //nolint:errcheck
 	configFile := "config.yaml"
@@ -46,10 +98,13 @@ func (r *DockerBuildCmd) Run(cli *Cli, ctx context.Context) error {
 
 	builder := docker.DockerBuilder{
 		Config:     config,
-		Stdin:      strings.NewReader(config.Dockerfile(r.BakeEnv, r.BuildSlim, configFile)),
+		Stdin:      strings.NewReader(config.Dockerfile(r.BakeEnv, r.BuildSlim, docker.Runtime.BuildMounts(), configFile)),
 		Dir:        dir,
+		ConfigFile: configFile,
 		ImageTag:   r.Tag,
 		ExtraFlags: r.ExtraFlags,
+		Stdout:     r.stdout,
+		Stderr:     r.stderr,
 	}
 	if err := builder.Run(ctx); err != nil {
 		if configErr := config.ValidateConfig(err); configErr != nil {
@@ -60,6 +115,13 @@ func (r *DockerBuildCmd) Run(cli *Cli, ctx context.Context) error {
 	return nil
 }
 
+func (r *DockerBuildCmd) tag() string {
+	if len(r.Tag) > 0 {
+		return r.Tag
+	}
+	return utils.DefaultNamespace + "/" + r.Config
+}
+
 type DockerConfigureCmd struct {
 	SourceTag    string `short:"s" help:"Source image tag to build from. Defaults to 'local_discourse/{config}'"`
 	TargetTag    string `short:"t" name:"tag" help:"Target image tag to save as. Defaults to 'local_discourse/{config}'"`
@@ -67,8 +129,16 @@ type DockerConfigureCmd struct {
 	Config       string `arg:"" name:"config" help:"config" predictor:"config"`
 }
 
-func (r *DockerConfigureCmd) Run(cli *Cli, ctx context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+func (r *DockerConfigureCmd) Run(cli *Cli, ctx context.Context) (err error) {
+	ctx, unlock, err := lockSite(cli, ctx, "configure", r.Config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer utils.StartPhase("configure", r.Config).Finish(&err)
+	ctx, history := startHistory(cli, ctx, "configure", r.Config)
+	defer history.finish(ctx, &err)
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
 
 	if err != nil {
 		return err
@@ -94,6 +164,7 @@ func (r *DockerConfigureCmd) Run(cli *Cli, ctx context.Context) error {
 	if len(r.TargetTag) > 0 {
 		targetTag = r.TargetTag
 	}
+	historyLoaded(ctx, config, targetTag)
 
 	pups := docker.DockerPupsRunner{
 		Config:         config,
@@ -114,11 +185,20 @@ type DockerMigrateCmd struct {
 	Config                       string `arg:"" name:"config" help:"config" predictor:"config"`
 }
 
-func (r *DockerMigrateCmd) Run(cli *Cli, ctx context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+func (r *DockerMigrateCmd) Run(cli *Cli, ctx context.Context) (err error) {
+	ctx, unlock, err := lockSite(cli, ctx, "migrate", r.Config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer utils.StartPhase("migrate", r.Config).Finish(&err)
+	ctx, history := startHistory(cli, ctx, "migrate", r.Config)
+	defer history.finish(ctx, &err)
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
 	if err != nil {
 		return err
 	}
+	historyLoaded(ctx, config, "")
 	containerId := "discourse-build-" + uuid.NewString()
 	env := []string{"SKIP_EMBER_CLI_COMPILE=1"}
 	if r.SkipPostDeploymentMigrations {
@@ -132,6 +212,12 @@ func (r *DockerMigrateCmd) Run(cli *Cli, ctx context.Context) error {
 	if len(r.Tag) > 0 {
 		tag = r.Tag
 	}
+	// recorded before running, migrations that fail may have partly run
+	if !r.SkipPostDeploymentMigrations {
+		if err := recordPostDeployMigrations(cli.StateDir, r.Config); err != nil {
+			return err
+		}
+	}
 	pups := docker.DockerPupsRunner{
 		Config:        config,
 		PupsArgs:      "--tags=db,migrate",
@@ -143,27 +229,102 @@ func (r *DockerMigrateCmd) Run(cli *Cli, ctx context.Context) error {
 }
 
 type DockerBootstrapCmd struct {
-	Config    string `arg:"" name:"config" help:"config" predictor:"config"`
-	Tag       string `short:"t" help:"Resulting image tag. Defaults to 'local_discourse/{config}'"`
-	BuildSlim bool   `hidden:"" help:"Build a minimal image from a multistage build"`
+	Sites         `embed:""`
+	Parallel      int    `name:"parallel" default:"1" help:"Number of sites to build at once. Migrating and configuring is done one site at a time."`
+	Tag           string `short:"t" help:"Resulting image tag. Defaults to 'local_discourse/{config}'"`
+	BuildSlim     bool   `hidden:"" help:"Build a minimal image from a multistage build"`
+	SkipPreflight bool   `name:"skip-preflight" help:"Bootstrap without first checking the config for problems that would fail the build."`
+	Resume        bool   `name:"resume" help:"Skip steps the last bootstrap completed, when the Dockerfile, config, and base image haven't changed since, and the image is still the one it left."`
+	FromStep      string `name:"from-step" placeholder:"STEP" help:"Skip the steps before this one: build, migrate, or configure."`
+
+	Config string `kong:"-"`
 }
 
-func (r *DockerBootstrapCmd) Run(cli *Cli, ctx context.Context) error {
-	tag := utils.DefaultNamespace + "/" + r.Config
-	if len(r.Tag) > 0 {
-		tag = r.Tag
+func (r *DockerBootstrapCmd) Run(cli *Cli, ctx context.Context) (err error) {
+	if err := checkFromStep(r.FromStep); err != nil {
+		return err
+	}
+	if r.Config == "" {
+		names, err := r.names(cli)
+		if err != nil {
+			return err
+		}
+		if r.Tag != "" && len(names) > 1 {
+			return errors.New("--tag names the image of a single site")
+		}
+		return runSites(cli, ctx, "bootstrap", names, r.Parallel, func(cli *Cli, name string) sitePhases {
+			site := *r
+			site.Config = name
+			var steps *checkpoints
+			return sitePhases{
+				build: func(ctx context.Context, stdout io.Writer, stderr io.Writer) (err error) {
+					buildStep := site.buildStep()
+					buildStep.stdout, buildStep.stderr = stdout, stderr
+					if steps, err = loadCheckpoints(cli, "bootstrap", buildStep, site.Resume, site.FromStep); err != nil {
+						return err
+					}
+					return steps.run(ctx, "build", func() error { return buildStep.Run(cli, ctx) })
+				},
+				deploy: func(ctx context.Context) error {
+					return site.migrateAndConfigure(cli, ctx, steps)
+				},
+			}
+		})
 	}
-	buildStep := DockerBuildCmd{Config: r.Config, BakeEnv: false, Tag: tag, BuildSlim: r.BuildSlim}
-	migrateStep := DockerMigrateCmd{Config: r.Config, Tag: tag}
-	configureStep := DockerConfigureCmd{Config: r.Config, SourceTag: tag, TargetTag: tag}
-	if err := buildStep.Run(cli, ctx); err != nil {
+	ctx, unlock, err := lockSite(cli, ctx, "bootstrap", r.Config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ctx, history := startHistory(cli, ctx, "bootstrap", r.Config)
+	defer history.finish(ctx, &err)
+	buildStep := r.buildStep()
+	steps, err := loadCheckpoints(cli, "bootstrap", buildStep, r.Resume, r.FromStep)
+	if err != nil {
 		return err
 	}
-	if err := migrateStep.Run(cli, ctx); err != nil {
+	if err := steps.run(ctx, "build", func() error { return buildStep.Run(cli, ctx) }); err != nil {
+		return err
+	}
+	return r.migrateAndConfigure(cli, ctx, steps)
+}
+
+func (r *DockerBootstrapCmd) tag() string {
+	if len(r.Tag) > 0 {
+		return r.Tag
+	}
+	return utils.DefaultNamespace + "/" + r.Config
+}
+
+func (r *DockerBootstrapCmd) buildStep() DockerBuildCmd {
+	return DockerBuildCmd{Config: r.Config, BakeEnv: false, Tag: r.tag(), BuildSlim: r.BuildSlim, SkipPreflight: r.SkipPreflight}
+}
+
+func (r *DockerBootstrapCmd) migrateAndConfigure(cli *Cli, ctx context.Context, steps *checkpoints) error {
+	migrateStep := DockerMigrateCmd{Config: r.Config, Tag: r.tag()}
+	configureStep := DockerConfigureCmd{Config: r.Config, SourceTag: r.tag(), TargetTag: r.tag()}
+	if err := steps.run(ctx, "migrate", func() error { return migrateStep.Run(cli, ctx) }); err != nil {
 		return err
 	}
-	if err := configureStep.Run(cli, ctx); err != nil {
+	if err := steps.run(ctx, "configure", func() error { return configureStep.Run(cli, ctx) }); err != nil {
 		return err
 	}
 	return nil
 }
+
+// Fails before anything is pulled or built when the config has problems that would fail the build,
+// listing all of them.
+func preflight(cli *Cli, name string) error {
+	problems, err := config.Preflight(cli.ConfDir, name, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	lines := []string{}
+	for _, p := range problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return errors.New("preflight checks failed for " + name + ":\n" + strings.Join(lines, "\n") + "\nFix them, or pass --skip-preflight to build anyway")
+}
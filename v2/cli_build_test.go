@@ -6,9 +6,11 @@ import (
 
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	ddocker "github.com/discourse/launcher/v2"
@@ -163,14 +165,14 @@ var _ = Describe("Build", func() {
 		}
 
 		It("Should run docker build with correct arguments", func() {
-			runner := ddocker.DockerBuildCmd{Config: "test"}
+			runner := ddocker.DockerBuildCmd{Config: "test", SkipPreflight: true}
 			runner.Run(cli, ctx) //nolint:errcheck
 			Expect(len(RanCmds)).To(Equal(1))
 			checkBuildCmd(RanCmds[0])
 		})
 
 		It("Should allow for extra build args", func() {
-			runner := ddocker.DockerBuildCmd{Config: "test", ExtraFlags: []string{"--platform", "linux/amd64,linux/arm64"}}
+			runner := ddocker.DockerBuildCmd{Config: "test", ExtraFlags: []string{"--platform", "linux/amd64,linux/arm64"}, SkipPreflight: true}
 			runner.Run(cli, ctx) //nolint:errcheck
 			Expect(len(RanCmds)).To(Equal(1))
 			checkBuildCmd(RanCmds[0])
@@ -193,7 +195,7 @@ var _ = Describe("Build", func() {
 
 		Context("With various tag arguments", func() {
 			It("Should run docker build with custom tag", func() {
-				runner := ddocker.DockerBuildCmd{Config: "test", Tag: "custom/tag"}
+				runner := ddocker.DockerBuildCmd{Config: "test", Tag: "custom/tag", SkipPreflight: true}
 				runner.Run(cli, ctx) //nolint:errcheck
 				Expect(len(RanCmds)).To(Equal(1))
 				checkBuildCmd(RanCmds[0])
@@ -201,7 +203,7 @@ var _ = Describe("Build", func() {
 			})
 
 			It("Should build with both custom tags set", func() {
-				runner := ddocker.DockerBuildCmd{Config: "test", Tag: "custom/tag", ExtraFlags: []string{"-t", "custom_docker/tag2"}}
+				runner := ddocker.DockerBuildCmd{Config: "test", Tag: "custom/tag", ExtraFlags: []string{"-t", "custom_docker/tag2"}, SkipPreflight: true}
 				runner.Run(cli, ctx) //nolint:errcheck
 				Expect(len(RanCmds)).To(Equal(1))
 				checkBuildCmd(RanCmds[0])
@@ -210,7 +212,7 @@ var _ = Describe("Build", func() {
 			})
 
 			var CheckBuildWithDockerBuildTagOnly = func(dockerBuildFlags []string) {
-				runner := ddocker.DockerBuildCmd{Config: "test", ExtraFlags: dockerBuildFlags}
+				runner := ddocker.DockerBuildCmd{Config: "test", ExtraFlags: dockerBuildFlags, SkipPreflight: true}
 				runner.Run(cli, ctx) //nolint:errcheck
 				Expect(len(RanCmds)).To(Equal(1))
 				checkBuildCmd(RanCmds[0])
@@ -295,7 +297,7 @@ var _ = Describe("Build", func() {
 		})
 
 		It("Should run all docker commands for full bootstrap", func() {
-			runner := ddocker.DockerBootstrapCmd{Config: "test"}
+			runner := ddocker.DockerBootstrapCmd{Config: "test", SkipPreflight: true}
 			runner.Run(cli, ctx) //nolint:errcheck
 			Expect(len(RanCmds)).To(Equal(5))
 			checkBuildCmd(RanCmds[0])
@@ -305,4 +307,120 @@ var _ = Describe("Build", func() {
 			checkConfigureClean(RanCmds[4])
 		})
 	})
+
+	Context("when the config would fail the build", func() {
+		var confDir string
+
+		BeforeEach(func() {
+			confDir = filepath.Join(testDir, "containers")
+			os.MkdirAll(confDir, 0755) //nolint:errcheck
+			os.WriteFile(filepath.Join(confDir, "app.yml"), []byte(`templates:
+  - templates/web.template.yml
+env:
+  DISCOURSE_HOSTNAME: discourse.example.com
+  DISCOURSE_DB_SOCKET: ''
+  DISCOURSE_DB_HOST: data
+hooks:
+  after_code:
+    - exec:
+        cd: $home/plugins
+        cmd:
+          - git clone https://github.com/discourse/discourse-math.git
+`), 0644) //nolint:errcheck
+			cli.ConfDir = confDir
+		})
+
+		It("lists every problem before building", func() {
+			runner := ddocker.DockerBuildCmd{Config: "app"}
+			err := runner.Run(cli, ctx)
+			Expect(err).To(MatchError(ContainSubstring("app.yml:4: domain is not configured")))
+			Expect(err).To(MatchError(ContainSubstring("app.yml:12: the plugin discourse-math is bundled with Discourse")))
+			Expect(err).To(MatchError(ContainSubstring("app.yml: DISCOURSE_DB_PASSWORD is empty")))
+			Expect(RanCmds).To(BeEmpty())
+		})
+
+		It("checks before rebuild touches the running site", func() {
+			runner := ddocker.RebuildCmd{Config: "app"}
+			Expect(runner.Run(cli, ctx)).To(MatchError(ContainSubstring("pass --skip-preflight")))
+			Expect(RanCmds).To(BeEmpty())
+		})
+
+		It("builds anyway with --skip-preflight", func() {
+			runner := ddocker.DockerBootstrapCmd{Config: "app", SkipPreflight: true}
+			runner.Run(cli, ctx) //nolint:errcheck
+			Expect(RanCmds[0].String()).To(ContainSubstring("docker build"))
+		})
+	})
+
+	Context("with json output", func() {
+		var events *bytes.Buffer
+
+		var parseEvents = func() []utils.Event {
+			parsed := []utils.Event{}
+			for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+				event := utils.Event{}
+				Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+				parsed = append(parsed, event)
+			}
+			return parsed
+		}
+
+		BeforeEach(func() {
+			events = &bytes.Buffer{}
+			utils.EnableJsonEvents(events)
+		})
+
+		AfterEach(func() {
+			utils.DisableJsonEvents()
+		})
+
+		It("emits phases, committed images, and output as events", func() {
+			runner := ddocker.DockerBootstrapCmd{Config: "test", SkipPreflight: true}
+			Expect(runner.Run(cli, ctx)).To(Succeed())
+			utils.FlushEvents()
+
+			phases := []string{}
+			images := []string{}
+			logs := 0
+			for _, event := range parseEvents() {
+				Expect(event.Time).ToNot(BeZero())
+				switch event.Type {
+				case utils.EventPhaseStarted, utils.EventPhaseFinished:
+					Expect(event.Config).To(Equal("test"))
+					phases = append(phases, event.Type+" "+event.Phase)
+					if event.Type == utils.EventPhaseFinished {
+						Expect(event.Duration).ToNot(BeNil())
+						Expect(event.ExitCode).To(BeNil())
+					}
+				case utils.EventImageCommitted:
+					Expect(event.Created).ToNot(BeEmpty())
+					images = append(images, event.Image)
+				case utils.EventLog:
+					Expect(event.Stream).To(Equal("launcher"))
+					logs++
+				}
+			}
+			Expect(phases).To(Equal([]string{
+				"phase_started build", "phase_finished build",
+				"phase_started migrate", "phase_finished migrate",
+				"phase_started configure", "phase_finished configure",
+			}))
+			Expect(images).To(Equal([]string{"local_discourse/test", "local_discourse/test"}))
+			// the docker commit and rm commands launcher prints
+			Expect(logs).To(BeNumerically(">", 0))
+			Expect(out.String()).To(BeEmpty())
+		})
+
+		It("emits the error and exit code that ended a phase", func() {
+			CmdOutputError = utils.NewExitStatusError(3, "docker failed")
+			runner := ddocker.DockerMigrateCmd{Config: "test"}
+			Expect(runner.Run(cli, ctx)).ToNot(Succeed())
+
+			finished := parseEvents()[1]
+			Expect(finished.Type).To(Equal(utils.EventPhaseFinished))
+			Expect(finished.Phase).To(Equal("migrate"))
+			Expect(finished.Message).To(Equal("docker failed"))
+			Expect(*finished.ExitCode).To(Equal(3))
+		})
+	})
 })
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// State file of the steps of the last bootstrap or rebuild that completed.
+const checkpointState = "checkpoint.json"
+
+// Steps of a bootstrap or rebuild that are recorded, in the order they run.
+var checkpointSteps = []string{"build", "migrate", "configure"}
+
+// Steps the last bootstrap or rebuild of a site completed, and the build inputs they ran on.
+type Checkpoint struct {
+	Command string `json:"command"`
+	// hash of the Dockerfile, the pups config, the extra build flags, and the base image digest
+	Inputs string           `json:"inputs"`
+	Steps  []CheckpointStep `json:"steps"`
+}
+
+type CheckpointStep struct {
+	Name string `json:"name"`
+	// the image the site's tag pointed to once the step completed
+	ImageId string    `json:"image_id"`
+	Time    time.Time `json:"time"`
+}
+
+// Steps of a bootstrap or rebuild, skipped when resuming, and recorded as they complete.
+type checkpoints struct {
+	cli      *Cli
+	command  string
+	build    DockerBuildCmd
+	conf     *config.Config
+	resume   bool
+	fromStep string
+	saved    *Checkpoint
+}
+
+func checkFromStep(step string) error {
+	if step != "" && !slices.Contains(checkpointSteps, step) {
+		return errors.New("--from-step must be one of " + strings.Join(checkpointSteps, ", "))
+	}
+	return nil
+}
+
+// Loads the checkpoint of the last bootstrap or rebuild of the site built by build.
+func loadCheckpoints(cli *Cli, command string, build DockerBuildCmd, resume bool, fromStep string) (*checkpoints, error) {
+	c := &checkpoints{cli: cli, command: command, build: build, resume: resume, fromStep: fromStep}
+	if cli.StateDir == "" {
+		return c, nil
+	}
+	content, err := utils.ReadState(cli.StateDir, build.Config, checkpointState)
+	if err != nil || content == nil {
+		return c, err
+	}
+	saved := &Checkpoint{}
+	if err := json.Unmarshal(content, saved); err != nil {
+		fmt.Fprintln(utils.Out, "Ignoring unreadable checkpoint of "+build.Config+": "+err.Error()) //nolint:errcheck
+		return c, nil
+	}
+	c.saved = saved
+	return c, nil
+}
+
+// Runs a step, unless it is before --from-step, or resuming and it completed since the build
+// inputs last changed, with the site's image still the one it left.
+func (c *checkpoints) run(ctx context.Context, step string, run func() error) error {
+	skip, reason, err := c.skip(ctx, step)
+	if err != nil {
+		// checkpoints only save time, the step runs when they can't be checked
+		fmt.Fprintln(utils.Out, "Running "+step+" of "+c.build.Config+", couldn't check its checkpoint: "+err.Error()) //nolint:errcheck
+	} else if skip {
+		fmt.Fprintln(utils.Out, "Skipping "+step+" of "+c.build.Config+", "+reason) //nolint:errcheck
+		return nil
+	}
+	if err := run(); err != nil {
+		return err
+	}
+	if err := c.record(ctx, step); err != nil {
+		fmt.Fprintln(utils.Out, "Couldn't record the "+step+" of "+c.build.Config+": "+err.Error()) //nolint:errcheck
+	}
+	return nil
+}
+
+func (c *checkpoints) skip(ctx context.Context, step string) (bool, string, error) {
+	if c.fromStep != "" {
+		before := slices.Index(checkpointSteps, step) < slices.Index(checkpointSteps, c.fromStep)
+		return before, "it is before --from-step " + c.fromStep, nil
+	}
+	if !c.resume || c.saved == nil || c.saved.Command != c.command {
+		return false, "", nil
+	}
+	i := slices.IndexFunc(c.saved.Steps, func(s CheckpointStep) bool { return s.Name == step })
+	if i < 0 {
+		return false, "", nil
+	}
+	// inputs are hashed each time, the base image may only have been pulled since
+	inputs, err := c.inputs(ctx)
+	if err != nil || inputs != c.saved.Inputs {
+		return false, "", err
+	}
+	imageId, err := c.imageId(ctx)
+	if err != nil || imageId != c.saved.Steps[len(c.saved.Steps)-1].ImageId {
+		return false, "", err
+	}
+	completed := c.saved.Steps[i].Time.Local().Format(time.DateTime)
+	return true, "it completed at " + completed + " and its inputs haven't changed", nil
+}
+
+// Records a completed step. A build, or a step run on other inputs, starts a new checkpoint.
+func (c *checkpoints) record(ctx context.Context, step string) error {
+	if c.cli.StateDir == "" {
+		return nil
+	}
+	inputs, err := c.inputs(ctx)
+	if err != nil {
+		return err
+	}
+	imageId, err := c.imageId(ctx)
+	if err != nil {
+		return err
+	}
+	if step == "build" || c.saved == nil || c.saved.Command != c.command || c.saved.Inputs != inputs {
+		c.saved = &Checkpoint{Command: c.command, Inputs: inputs, Steps: []CheckpointStep{}}
+	}
+	c.saved.Steps = slices.DeleteFunc(c.saved.Steps, func(s CheckpointStep) bool { return s.Name == step })
+	c.saved.Steps = append(c.saved.Steps, CheckpointStep{Name: step, ImageId: imageId, Time: time.Now().UTC()})
+	content, err := json.MarshalIndent(c.saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteState(c.cli.StateDir, c.build.Config, checkpointState, content)
+}
+
+func (c *checkpoints) imageId(ctx context.Context) (string, error) {
+	image, err := docker.Backend.InspectImage(ctx, c.build.tag())
+	if err != nil || image == nil {
+		return "", err
+	}
+	return image.Id, nil
+}
+
+// Hash of what the build reads: the Dockerfile, the pups config, the extra build flags, and
+// the digest of the base image.
+func (c *checkpoints) inputs(ctx context.Context) (string, error) {
+	if c.conf == nil {
+		// loaded once needed, after the build's preflight checks
+		conf, err := config.LoadConfig(c.cli.ConfDir, c.build.Config, true, c.cli.TemplatesDir, c.cli.Profile...)
+		if err != nil {
+			return "", err
+		}
+		c.conf = conf
+	}
+	hash := sha256.New()
+	hash.Write([]byte(c.conf.Dockerfile(c.build.BakeEnv, c.build.BuildSlim, docker.Runtime.BuildMounts(), "config.yaml"))) //nolint:errcheck
+	hash.Write([]byte(c.conf.Yaml()))                                                                                      //nolint:errcheck
+	hash.Write([]byte(strings.Join(c.build.ExtraFlags, "\x00")))                                                           //nolint:errcheck
+	base, err := docker.Backend.InspectImage(ctx, c.conf.BaseImage)
+	if err != nil {
+		return "", err
+	}
+	if base != nil && len(base.RepoDigests) > 0 {
+		hash.Write([]byte(base.RepoDigests[0])) //nolint:errcheck
+	} else if base != nil {
+		hash.Write([]byte(base.Id)) //nolint:errcheck
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,146 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Checkpoints", func() {
+	var testDir string
+	var stateDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	var ran = func(substr string) int {
+		count := 0
+		for _, cmd := range RanCmds {
+			if strings.Contains(cmd.String(), substr) {
+				count++
+			}
+		}
+		return count
+	}
+
+	var checkpoint = func() ddocker.Checkpoint {
+		content, err := os.ReadFile(filepath.Join(stateDir, "test", "checkpoint.json"))
+		Expect(err).To(BeNil())
+		checkpoint := ddocker.Checkpoint{}
+		Expect(json.Unmarshal(content, &checkpoint)).To(Succeed())
+		return checkpoint
+	}
+
+	var bootstrap = func(resume bool, fromStep string) error {
+		RanCmds = nil
+		runner := ddocker.DockerBootstrapCmd{Config: "test", Resume: resume, FromStep: fromStep, SkipPreflight: true}
+		return runner.Run(cli, ctx)
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		stateDir, _ = os.MkdirTemp("", "ddocker-state")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+			StateDir:     stateDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponses["image inspect"] = []byte(`[{"Id": "sha256:0123456789abcdef", "RepoDigests": ["discourse/base@sha256:fedcba"]}]`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)  //nolint:errcheck
+		os.RemoveAll(stateDir) //nolint:errcheck
+	})
+
+	It("records the steps a bootstrap completed", func() {
+		Expect(bootstrap(false, "")).To(Succeed())
+		checkpoint := checkpoint()
+		Expect(checkpoint.Command).To(Equal("bootstrap"))
+		Expect(checkpoint.Inputs).ToNot(BeEmpty())
+		names := []string{}
+		for _, step := range checkpoint.Steps {
+			names = append(names, step.Name)
+			Expect(step.ImageId).To(Equal("sha256:0123456789abcdef"))
+		}
+		Expect(names).To(Equal([]string{"build", "migrate", "configure"}))
+	})
+
+	It("skips completed steps when resuming", func() {
+		Expect(bootstrap(false, "")).To(Succeed())
+		saved := checkpoint()
+		saved.Steps = saved.Steps[:1]
+		content, _ := json.Marshal(saved)
+		Expect(os.WriteFile(filepath.Join(stateDir, "test", "checkpoint.json"), content, 0644)).To(Succeed())
+
+		Expect(bootstrap(true, "")).To(Succeed())
+		Expect(ran("docker build")).To(Equal(0))
+		Expect(ran("docker run")).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("Skipping build of test, it completed at"))
+	})
+
+	It("runs every step without --resume", func() {
+		Expect(bootstrap(false, "")).To(Succeed())
+		Expect(bootstrap(false, "")).To(Succeed())
+		Expect(ran("docker build")).To(Equal(1))
+	})
+
+	It("rebuilds when the base image changed", func() {
+		Expect(bootstrap(false, "")).To(Succeed())
+		CmdOutputResponses["image inspect"] = []byte(`[{"Id": "sha256:0123456789abcdef", "RepoDigests": ["discourse/base@sha256:abcdef"]}]`)
+		Expect(bootstrap(true, "")).To(Succeed())
+		Expect(ran("docker build")).To(Equal(1))
+		Expect(out.String()).ToNot(ContainSubstring("Skipping"))
+	})
+
+	It("rebuilds when the image changed since", func() {
+		Expect(bootstrap(false, "")).To(Succeed())
+		CmdOutputResponses["image inspect local_discourse/test"] = []byte(`[{"Id": "sha256:9876543210"}]`)
+		Expect(bootstrap(true, "")).To(Succeed())
+		Expect(ran("docker build")).To(Equal(1))
+	})
+
+	It("starts from a step", func() {
+		cli.StateDir = ""
+		Expect(bootstrap(false, "migrate")).To(Succeed())
+		Expect(ran("docker build")).To(Equal(0))
+		Expect(ran("docker run")).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("Skipping build of test, it is before --from-step migrate"))
+	})
+
+	It("rejects unknown steps", func() {
+		Expect(bootstrap(false, "start")).To(MatchError("--from-step must be one of build, migrate, configure"))
+		Expect(RanCmds).To(BeEmpty())
+	})
+
+	It("skips the build of a resumed rebuild, and still replaces the container", func() {
+		Expect((&ddocker.RebuildCmd{Config: "test", SkipPreflight: true}).Run(cli, ctx)).To(Succeed())
+		Expect(checkpoint().Command).To(Equal("rebuild"))
+
+		RanCmds = nil
+		Expect((&ddocker.RebuildCmd{Config: "test", Resume: true, SkipPreflight: true}).Run(cli, ctx)).To(Succeed())
+		Expect(ran("docker build")).To(Equal(0))
+		Expect(ran("--tags=db,precompile")).To(Equal(0))
+		Expect(ran("/sbin/boot")).To(Equal(1))
+		// post-deploy migrations of sites with an external database always run
+		Expect(ran("--tags=db,migrate")).To(Equal(1))
+	})
+})
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * compose
+ */
+type ComposeCmd struct {
+	OutputDir string `name:"output-dir" short:"o" default:"./compose" help:"Directory to write compose projects to. Files are written to a {config} subdirectory." predictor:"dir"`
+	Config    string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+func (r *ComposeCmd) Run(cli *Cli, ctx context.Context) error {
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(r.OutputDir, r.Config)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	configFile := "config.yaml"
+	dockerfile := "Dockerfile"
+	envFile := "secrets.env"
+
+	// the project may be committed, secrets are only written to the env file
+	pups, err := config.PublicYaml()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, configFile), []byte(pups), 0660); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, dockerfile), []byte(config.Dockerfile(false, false, true, configFile)), 0660); err != nil {
+		return err
+	}
+
+	secrets := config.ComposeEnvFile()
+	if secrets == "" {
+		envFile = ""
+	} else if err := os.WriteFile(filepath.Join(dir, envFile), []byte(secrets), 0600); err != nil {
+		return err
+	}
+
+	defaultHostname, _ := os.Hostname()
+	defaultHostname = defaultHostname + "-" + r.Config
+	hostname, err := config.GetDockerHostname(defaultHostname)
+	if err != nil {
+		return err
+	}
+
+	compose, err := config.DockerCompose(hostname, dockerfile, envFile)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose), 0660); err != nil {
+		return err
+	}
+
+	if len(config.DockerArgs) > 0 {
+		fmt.Fprintln(utils.Out, "WARNING: docker_args are not translated to compose, add them manually: "+strings.TrimSpace(config.DockerArgs)) //nolint:errcheck
+	}
+	fmt.Fprintln(utils.Out, "wrote compose project to "+dir) //nolint:errcheck
+	return nil
+}
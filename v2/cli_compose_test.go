@@ -0,0 +1,83 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Compose", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+	AfterEach(func() {
+		os.RemoveAll(testDir) //nolint:errcheck
+	})
+
+	It("keeps known secrets out of the pups config", func() {
+		runner := ddocker.ComposeCmd{Config: "test", OutputDir: testDir}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		dir := filepath.Join(testDir, "test")
+		pups, err := os.ReadFile(filepath.Join(dir, "config.yaml"))
+		Expect(err).To(BeNil())
+		for _, secret := range utils.KnownSecrets {
+			Expect(string(pups)).ToNot(ContainSubstring(secret + ":"))
+		}
+		Expect(string(pups)).ToNot(ContainSubstring("pa$$word"))
+		Expect(string(pups)).To(ContainSubstring("UNICORN_WORKERS:"))
+
+		secrets, err := os.ReadFile(filepath.Join(dir, "secrets.env"))
+		Expect(err).To(BeNil())
+		Expect(string(secrets)).To(ContainSubstring("DISCOURSE_SMTP_PASSWORD"))
+	})
+
+	It("writes a compose project with a build context", func() {
+		runner := ddocker.ComposeCmd{Config: "test", OutputDir: testDir}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(len(RanCmds)).To(Equal(0))
+
+		dir := filepath.Join(testDir, "test")
+		compose, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+		Expect(err).To(BeNil())
+		Expect(string(compose)).To(ContainSubstring("container_name: test"))
+
+		dockerfile, err := os.ReadFile(filepath.Join(dir, "Dockerfile"))
+		Expect(err).To(BeNil())
+		Expect(string(dockerfile)).To(ContainSubstring("RUN --mount=type=bind,source=config.yaml,target=/temp-config.yaml"))
+
+		pups, err := os.ReadFile(filepath.Join(dir, "config.yaml"))
+		Expect(err).To(BeNil())
+		Expect(string(pups)).To(ContainSubstring("_FILE_SEPERATOR_"))
+
+		info, err := os.Stat(filepath.Join(dir, "secrets.env"))
+		Expect(err).To(BeNil())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		Expect(out.String()).To(ContainSubstring("docker_args are not translated"))
+	})
+})
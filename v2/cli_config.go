@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * config show, config explain
+ */
+type ConfigCmd struct {
+	Show    ConfigShowCmd    `cmd:"" name:"show" help:"Print a config after merging its templates."`
+	Explain ConfigExplainCmd `cmd:"" name:"explain" help:"Show which file set each value of a config, and which files it overrode."`
+}
+
+type ConfigShowCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Pups   bool   `name:"pups" help:"Print the pups input builds read instead: each template, the config, and the env with {{config}} replaced."`
+	Redact bool   `name:"redact" help:"Mask known secret env values. Secrets from secret sources are always masked."`
+	Format string `name:"format" default:"yaml" enum:"yaml,json" help:"Output format, yaml or json."`
+}
+
+func (r *ConfigShowCmd) Run(cli *Cli, ctx context.Context) error {
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		return err
+	}
+
+	if r.Pups {
+		docs, err := conf.PupsDocs(r.Redact)
+		if err != nil {
+			return err
+		}
+		if r.Format == "yaml" {
+			_, err := fmt.Fprintln(utils.Out, strings.Join(docs, config.FileSeparator))
+			return err
+		}
+		parsed := []any{}
+		for _, doc := range docs {
+			var value any
+			if err := yaml.Unmarshal([]byte(doc), &value); err != nil {
+				return err
+			}
+			parsed = append(parsed, value)
+		}
+		return writeJson(parsed)
+	}
+
+	masked := conf.Masked(r.Redact)
+	if r.Format == "yaml" {
+		encoder := yaml.NewEncoder(utils.Out)
+		encoder.SetIndent(2)
+		return encoder.Encode(masked)
+	}
+	// through yaml, so json has the same keys
+	content, err := yaml.Marshal(masked)
+	if err != nil {
+		return err
+	}
+	var value any
+	if err := yaml.Unmarshal(content, &value); err != nil {
+		return err
+	}
+	return writeJson(value)
+}
+
+/*
+ * config explain
+ */
+type ConfigExplainCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Key    string `arg:"" optional:"" name:"key" help:"Key to explain, like env.LANG, expose, or env for every env key."`
+}
+
+func (r *ConfigExplainCmd) Run(cli *Cli, ctx context.Context) error {
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		return err
+	}
+
+	sources := []*config.ValueSource{}
+	for _, s := range conf.Sources() {
+		if r.Key == "" || s.Key == r.Key || strings.HasPrefix(s.Key, r.Key+".") || strings.HasPrefix(s.Key, r.Key+"[") {
+			sources = append(sources, s)
+		}
+	}
+	if len(sources) == 0 {
+		return errors.New("no file in " + r.Config + " sets " + r.Key)
+	}
+
+	w := tabwriter.NewWriter(utils.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSET IN\tOVERRODE") //nolint:errcheck
+	for _, s := range sources {
+		overrode := []string{}
+		// latest first, the order they were overridden in
+		for i := len(s.Overrode) - 1; i >= 0; i-- {
+			overrode = append(overrode, s.Overrode[i].String())
+		}
+		if len(overrode) == 0 {
+			overrode = append(overrode, "-")
+		}
+		fmt.Fprintln(w, s.Key+"\t"+s.Source.String()+"\t"+strings.Join(overrode, ", ")) //nolint:errcheck
+	}
+	return w.Flush()
+}
+
+func writeJson(value any) error {
+	encoder := json.NewEncoder(utils.Out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
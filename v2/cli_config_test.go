@@ -0,0 +1,115 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	"github.com/discourse/launcher/v2/utils"
+
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("ConfigShow", func() {
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		ctx = context.Background()
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+		}
+	})
+
+	It("prints the merged config as yaml", func() {
+		runner := ddocker.ConfigShowCmd{Config: "test", Format: "yaml"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		shown := map[string]any{}
+		Expect(yaml.Unmarshal(out.Bytes(), &shown)).To(Succeed())
+		Expect(shown["base_image"]).To(Equal("discourse/base:2.0.20250226-0128"))
+		Expect(shown["templates"]).To(Equal([]any{"templates/web.template.yml"}))
+		env := shown["env"].(map[string]any)
+		// from the template, with {{config}} replaced
+		Expect(env).To(HaveKeyWithValue("RAILS_ENV", "production"))
+		Expect(env).To(HaveKeyWithValue("REPLACED", "test/test/test"))
+		Expect(env).To(HaveKeyWithValue("DISCOURSE_DB_PASSWORD", "SOME_SECRET"))
+	})
+
+	It("redacts known secrets as json", func() {
+		runner := ddocker.ConfigShowCmd{Config: "test", Format: "json", Redact: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		shown := map[string]any{}
+		Expect(json.Unmarshal(out.Bytes(), &shown)).To(Succeed())
+		env := shown["env"].(map[string]any)
+		Expect(env).To(HaveKeyWithValue("DISCOURSE_DB_PASSWORD", "[REDACTED]"))
+		Expect(env).To(HaveKeyWithValue("LANG", "en_US.UTF-8"))
+		Expect(out.String()).ToNot(ContainSubstring("SOME_SECRET"))
+	})
+
+	It("prints the pups input", func() {
+		runner := ddocker.ConfigShowCmd{Config: "test", Format: "yaml", Pups: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(strings.Count(out.String(), "_FILE_SEPERATOR_")).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("SOME_SECRET"))
+
+		out.Reset()
+		runner = ddocker.ConfigShowCmd{Config: "test", Format: "json", Pups: true, Redact: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		docs := []map[string]any{}
+		Expect(json.Unmarshal(out.Bytes(), &docs)).To(Succeed())
+		Expect(docs).To(HaveLen(3))
+		Expect(docs[1]).To(HaveKey("run"))
+		Expect(out.String()).ToNot(ContainSubstring("SOME_SECRET"))
+	})
+})
+
+var _ = Describe("ConfigExplain", func() {
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		ctx = context.Background()
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+		}
+	})
+
+	It("prints where each value was set", func() {
+		runner := ddocker.ConfigExplainCmd{Config: "test"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`env.RAILS_ENV +test/templates/web.template.yml:4 +-\n`))
+		Expect(out.String()).To(MatchRegexp(`expose\[2\] +test/containers/test.yml:19 +-\n`))
+	})
+
+	It("explains a key and the files it overrode", func() {
+		runner := ddocker.ConfigExplainCmd{Config: "test", Key: "env.DISCOURSE_DB_SOCKET"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[1]).To(MatchRegexp(`^env.DISCOURSE_DB_SOCKET +test/containers/test.yml:75 +test/templates/web.template.yml:12$`))
+	})
+
+	It("explains the entries under a key", func() {
+		runner := ddocker.ConfigExplainCmd{Config: "test", Key: "expose"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(strings.Split(strings.TrimSpace(out.String()), "\n")).To(HaveLen(5))
+
+		runner = ddocker.ConfigExplainCmd{Config: "test", Key: "env.MISSING"}
+		Expect(runner.Run(cli, ctx)).To(MatchError("no file in test sets env.MISSING"))
+	})
+})
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * diff
+ */
+
+// Exit statuses of diff, for alerting from cron.
+const (
+	diffRecreate = 2
+	diffRebuild  = 3
+)
+
+type DiffCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+func (r *DiffCmd) Run(cli *Cli, ctx context.Context) error {
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		return err
+	}
+
+	state, err := docker.Backend.ContainerState(ctx, r.Config)
+	if err != nil {
+		return err
+	}
+	var container *docker.ContainerInspect
+	if state != nil {
+		if container, err = docker.Backend.InspectContainer(ctx, state.Id); err != nil {
+			return err
+		}
+	}
+	if container == nil {
+		fmt.Fprintln(utils.Out, r.Config+" has no container, start it with: launcher start "+r.Config) //nolint:errcheck
+		return utils.NewExitStatusError(diffRecreate, r.Config+" has no container")
+	}
+
+	image, err := docker.Backend.InspectImage(ctx, container.Image)
+	if err != nil {
+		return err
+	}
+	latest, err := docker.Backend.InspectImage(ctx, docker.ConfigImage(conf))
+	if err != nil {
+		return err
+	}
+
+	drift := docker.ConfigDrift(conf, container, image, latest)
+	if len(drift) == 0 {
+		fmt.Fprintln(utils.Out, r.Config+" matches its config") //nolint:errcheck
+		return nil
+	}
+
+	rebuild := false
+	category := ""
+	for _, d := range drift {
+		if d.Category != category {
+			category = d.Category
+			fmt.Fprintln(utils.Out, category+":") //nolint:errcheck
+		}
+		fmt.Fprintln(utils.Out, "  "+formatDrift(conf, d)) //nolint:errcheck
+		rebuild = rebuild || d.Rebuild
+	}
+	fmt.Fprintln(utils.Out) //nolint:errcheck
+
+	if rebuild {
+		fmt.Fprintln(utils.Out, "The image needs a rebuild to apply the config: launcher rebuild "+r.Config) //nolint:errcheck
+		return utils.NewExitStatusError(diffRebuild, r.Config+" needs a rebuild")
+	}
+	// restart starts the existing container again, which keeps its old settings
+	fmt.Fprintln(utils.Out, "The container needs recreating to apply the config: launcher destroy "+r.Config+" && launcher start "+r.Config) //nolint:errcheck
+	return utils.NewExitStatusError(diffRecreate, r.Config+" needs a new container")
+}
+
+// "+" is only in the config, "-" only in the container, "~" differs. Secret values are hidden.
+func formatDrift(conf *config.Config, d docker.Drift) string {
+	configValue, containerValue := d.Config, d.Container
+	if d.Category == docker.DriftEnv && conf.IsSecret(d.Key) {
+		if configValue != "" {
+			configValue = "(secret)"
+		}
+		if containerValue != "" {
+			containerValue = "(secret)"
+		}
+	}
+	// multi-line values are shown on one line
+	configValue = strings.ReplaceAll(configValue, "\n", "\\n")
+	containerValue = strings.ReplaceAll(containerValue, "\n", "\\n")
+
+	switch {
+	case d.Container == "":
+		if d.Key == d.Config {
+			return "+ " + d.Key
+		}
+		return "+ " + d.Key + ": " + configValue
+	case d.Config == "":
+		if d.Key == d.Container {
+			return "- " + d.Key
+		}
+		return "- " + d.Key + ": " + containerValue
+	}
+	return "~ " + d.Key + ": " + containerValue + " -> " + configValue
+}
@@ -0,0 +1,129 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Diff", func() {
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var conf *config.Config
+	var env []string
+	var buildHash string
+
+	var respond = func() {
+		ports := map[string]any{}
+		for _, p := range conf.Expose {
+			if host, guest, ok := strings.Cut(p, ":"); ok {
+				ports[guest+"/tcp"] = []map[string]string{{"HostIp": "", "HostPort": host}}
+			}
+		}
+		binds := []string{}
+		for _, v := range conf.Volumes {
+			binds = append(binds, v.Volume.Host+":"+v.Volume.Guest)
+		}
+		inspect, _ := json.Marshal([]map[string]any{{
+			"Id":    "123",
+			"Image": "sha256:1",
+			"State": map[string]any{"Status": "running", "Running": true},
+			"Config": map[string]any{
+				"Image":  "local_discourse/test",
+				"Env":    env,
+				"Labels": map[string]string{docker.DockerArgsLabel: conf.DockerArgs},
+			},
+			"HostConfig": map[string]any{"Binds": binds, "Links": []string{"/data:/test/data"}, "PortBindings": ports},
+		}})
+		image, _ := json.Marshal([]map[string]any{{
+			"Id":     "sha256:1",
+			"Config": map[string]any{"Labels": map[string]string{config.BuildHashLabel: buildHash}},
+		}})
+		CmdOutputResponses["docker ps"] = []byte("123\ttest\tlocal_discourse/test\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n")
+		CmdOutputResponses["docker container inspect"] = inspect
+		CmdOutputResponses["docker image inspect"] = image
+	}
+
+	var exitStatus = func(err error) int {
+		var statusErr *utils.ExitStatusError
+		if errors.As(err, &statusErr) {
+			return statusErr.Status
+		}
+		return 0
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		ctx = context.Background()
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+		}
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		conf, _ = config.LoadConfig("./test/containers", "test", true, "./test")
+		env, _ = conf.GetEnvSlice(true)
+		buildHash = conf.BuildHash()
+	})
+
+	It("exits cleanly when the container matches", func() {
+		respond()
+		runner := ddocker.DiffCmd{Config: "test"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("test matches its config"))
+	})
+
+	It("asks for a new container when env changed, hiding secrets", func() {
+		for i, e := range env {
+			if strings.HasPrefix(e, "LANG=") {
+				env[i] = "LANG=C"
+			}
+			if strings.HasPrefix(e, "DISCOURSE_DB_PASSWORD=") {
+				env[i] = "DISCOURSE_DB_PASSWORD=OLD_SECRET"
+			}
+		}
+		env = append(env, "REMOVED=1")
+		respond()
+
+		runner := ddocker.DiffCmd{Config: "test"}
+		err := runner.Run(cli, ctx)
+		Expect(exitStatus(err)).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("env:\n"))
+		Expect(out.String()).To(ContainSubstring("~ LANG: C -> en_US.UTF-8"))
+		Expect(out.String()).To(ContainSubstring("~ DISCOURSE_DB_PASSWORD: (secret) -> (secret)"))
+		Expect(out.String()).To(ContainSubstring("- REMOVED: 1"))
+		Expect(out.String()).ToNot(ContainSubstring("SECRET"))
+		Expect(out.String()).To(ContainSubstring("launcher destroy test && launcher start test"))
+	})
+
+	It("asks for a rebuild when the build config changed", func() {
+		buildHash = "0000000000000000"
+		respond()
+
+		runner := ddocker.DiffCmd{Config: "test"}
+		err := runner.Run(cli, ctx)
+		Expect(exitStatus(err)).To(Equal(3))
+		Expect(out.String()).To(ContainSubstring("build:\n"))
+		Expect(out.String()).To(ContainSubstring("launcher rebuild test"))
+	})
+
+	It("reports a missing container", func() {
+		runner := ddocker.DiffCmd{Config: "test"}
+		err := runner.Run(cli, ctx)
+		Expect(exitStatus(err)).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("test has no container"))
+	})
+})
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * history
+ */
+
+// State file a site's history is appended to, a json record per line.
+const historyState = "history.jsonl"
+
+type HistoryCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Limit  int    `name:"limit" default:"20" help:"Number of records to show, newest first. 0 shows all."`
+	Format string `name:"format" default:"table" enum:"table,json" help:"Output format, table or json."`
+}
+
+// A command launcher ran for a site.
+type HistoryRecord struct {
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	Config   string    `json:"config"`
+	Profiles []string  `json:"profiles,omitempty"`
+	User     string    `json:"user"`
+	Version  string    `json:"launcher_version"`
+	// Hashes of the config's own files, and of each template, as pups reads them
+	ConfigHash      string            `json:"config_hash,omitempty"`
+	BuildHash       string            `json:"build_hash,omitempty"`
+	Templates       map[string]string `json:"templates,omitempty"`
+	BaseImage       string            `json:"base_image,omitempty"`
+	BaseImageDigest string            `json:"base_image_digest,omitempty"`
+	// The image the command built, or the container was started from
+	Image      string  `json:"image,omitempty"`
+	ImageId    string  `json:"image_id,omitempty"`
+	Duration   float64 `json:"duration"`
+	ExitStatus int     `json:"exit_status"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (r *HistoryCmd) Run(cli *Cli, ctx context.Context) error {
+	records, err := readHistory(cli.StateDir, r.Config)
+	if err != nil {
+		return err
+	}
+	if r.Limit > 0 && len(records) > r.Limit {
+		records = records[len(records)-r.Limit:]
+	}
+	// newest first
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	if r.Format == "json" {
+		encoder := json.NewEncoder(utils.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	}
+	if len(records) == 0 {
+		fmt.Fprintln(utils.Out, "no history for "+r.Config) //nolint:errcheck
+		return nil
+	}
+	w := tabwriter.NewWriter(utils.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCOMMAND\tRESULT\tDURATION\tUSER\tIMAGE\tBASE IMAGE") //nolint:errcheck
+	for _, record := range records {
+		result := "ok"
+		if record.ExitStatus != 0 {
+			result = fmt.Sprintf("exit %d", record.ExitStatus)
+		}
+		duration := (time.Duration(record.Duration * float64(time.Second))).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", //nolint:errcheck
+			record.Time.Local().Format(time.DateTime), record.Command, result, duration,
+			record.User, orDash(shortId(record.ImageId)), orDash(record.BaseImage))
+	}
+	return w.Flush()
+}
+
+// Records of a site's history, oldest first. Lines that don't parse are skipped.
+func readHistory(stateDir string, name string) ([]HistoryRecord, error) {
+	content, err := utils.ReadState(stateDir, name, historyState)
+	if err != nil {
+		return nil, err
+	}
+	records := []HistoryRecord{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		record := HistoryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Commands recorded in history.
+var historyCommands = []string{"build", "configure", "migrate", "bootstrap", "rebuild", "start", "destroy"}
+
+type historyKey struct{}
+
+// A command being recorded in a site's history.
+type historyEntry struct {
+	stateDir string
+	record   HistoryRecord
+	started  time.Time
+	conf     *config.Config
+	// inspected for the record when the command succeeds
+	image string
+}
+
+// Starts recording a command in the site's history. Commands a recorded command runs, like
+// the build of a rebuild, are part of its record. Returns the context to run them with.
+func startHistory(cli *Cli, ctx context.Context, command string, name string) (context.Context, *historyEntry) {
+	if ctx.Value(historyKey{}) != nil || cli.StateDir == "" || !slices.Contains(historyCommands, command) {
+		return ctx, nil
+	}
+	entry := &historyEntry{
+		stateDir: cli.StateDir,
+		started:  time.Now(),
+		record: HistoryRecord{
+			Command:  command,
+			Config:   name,
+			Profiles: cli.Profile,
+			User:     invokingUser(),
+			Version:  utils.Version,
+		},
+	}
+	return context.WithValue(ctx, historyKey{}, entry), entry
+}
+
+// Sets the config a recorded command, or a command it runs, loaded, and the image it builds or
+// runs. The last image set is the one recorded.
+func historyLoaded(ctx context.Context, conf *config.Config, image string) {
+	h, _ := ctx.Value(historyKey{}).(*historyEntry)
+	if h == nil {
+		return
+	}
+	h.conf = conf
+	if image != "" {
+		h.image = image
+	}
+}
+
+// Appends the record once the command is done, with the error it returned. Deferred with the
+// address of a named error result. Failing to record doesn't fail the command.
+func (h *historyEntry) finish(ctx context.Context, err *error) {
+	if h == nil {
+		return
+	}
+	record := h.record
+	record.Time = h.started.UTC()
+	record.Duration = time.Since(h.started).Seconds()
+	if *err != nil {
+		record.ExitStatus = utils.ExitCode(*err)
+		record.Error = (*err).Error()
+	}
+
+	// an interrupted command is still recorded
+	inspectCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if h.conf != nil {
+		record.ConfigHash, record.Templates = h.conf.FileHashes()
+		record.BuildHash = h.conf.BuildHash()
+		record.BaseImage = h.conf.BaseImage
+		if base, inspectErr := docker.Backend.InspectImage(inspectCtx, h.conf.BaseImage); inspectErr == nil && base != nil {
+			record.BaseImageDigest = base.Id
+			if len(base.RepoDigests) > 0 {
+				record.BaseImageDigest = base.RepoDigests[0]
+			}
+		}
+	}
+	if *err == nil && h.image != "" {
+		record.Image = h.image
+		if image, inspectErr := docker.Backend.InspectImage(inspectCtx, h.image); inspectErr == nil && image != nil {
+			record.ImageId = image.Id
+		}
+	}
+
+	line, marshalErr := json.Marshal(record)
+	if marshalErr == nil {
+		marshalErr = utils.AppendState(h.stateDir, record.Config, historyState, append(line, '\n'))
+	}
+	if marshalErr != nil {
+		fmt.Fprintln(utils.Out, "could not record history: "+marshalErr.Error()) //nolint:errcheck
+	}
+}
+
+// Who ran launcher, through sudo when they did.
+func invokingUser() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+func shortId(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	return id[:min(12, len(id))]
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
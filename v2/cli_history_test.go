@@ -0,0 +1,121 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("History", func() {
+	var testDir string
+	var stateDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	var history = func() []ddocker.HistoryRecord {
+		out.Reset()
+		runner := ddocker.HistoryCmd{Config: "test", Format: "json"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		records := []ddocker.HistoryRecord{}
+		Expect(json.Unmarshal(out.Bytes(), &records)).To(Succeed())
+		return records
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		stateDir, _ = os.MkdirTemp("", "ddocker-state")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+			StateDir:     stateDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponses["image inspect"] = []byte(`[{"Id": "sha256:0123456789abcdef", "RepoDigests": ["discourse/base@sha256:fedcba"]}]`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)  //nolint:errcheck
+		os.RemoveAll(stateDir) //nolint:errcheck
+	})
+
+	It("records a bootstrap once, with the builds it ran", func() {
+		runner := ddocker.DockerBootstrapCmd{Config: "test", SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		records := history()
+		Expect(records).To(HaveLen(1))
+		record := records[0]
+		Expect(record.Command).To(Equal("bootstrap"))
+		Expect(record.Config).To(Equal("test"))
+		Expect(record.ExitStatus).To(Equal(0))
+		Expect(record.ConfigHash).To(HaveLen(16))
+		Expect(record.Templates).To(HaveKey(ContainSubstring("web.template.yml")))
+		Expect(record.BaseImageDigest).To(Equal("discourse/base@sha256:fedcba"))
+		Expect(record.Image).To(Equal("local_discourse/test"))
+		Expect(record.ImageId).To(Equal("sha256:0123456789abcdef"))
+	})
+
+	It("records the exit status of failed commands", func() {
+		CmdOutputError = errors.New("build failed")
+		runner := ddocker.DockerBuildCmd{Config: "test", SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).ToNot(Succeed())
+
+		records := history()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].ExitStatus).To(Equal(1))
+		Expect(records[0].Error).To(ContainSubstring("build failed"))
+		Expect(records[0].ImageId).To(BeEmpty())
+	})
+
+	It("shows history newest first", func() {
+		Expect((&ddocker.DockerBuildCmd{Config: "test", SkipPreflight: true}).Run(cli, ctx)).To(Succeed())
+		Expect((&ddocker.DestroyCmd{Config: "test"}).Run(cli, ctx)).To(Succeed())
+
+		out.Reset()
+		runner := ddocker.HistoryCmd{Config: "test", Format: "table", Limit: 20}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(3))
+		Expect(lines[0]).To(HavePrefix("TIME"))
+		Expect(lines[1]).To(ContainSubstring("destroy"))
+		Expect(lines[2]).To(ContainSubstring("build"))
+		Expect(lines[2]).To(ContainSubstring("0123456789ab"))
+
+		out.Reset()
+		runner.Limit = 1
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(strings.Split(strings.TrimSpace(out.String()), "\n")).To(HaveLen(2))
+	})
+
+	It("records nothing for dry runs", func() {
+		Expect((&ddocker.StartCmd{Config: "test", DryRun: true}).Run(cli, ctx)).To(Succeed())
+		_, err := os.Stat(filepath.Join(stateDir, "test", "history.jsonl"))
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+	})
+
+	It("records nothing without a state dir", func() {
+		cli.StateDir = ""
+		Expect((&ddocker.DockerBuildCmd{Config: "test", SkipPreflight: true}).Run(cli, ctx)).To(Succeed())
+		_, err := os.Stat(filepath.Join(stateDir, "test", "history.jsonl"))
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+	})
+})
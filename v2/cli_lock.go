@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Exit status when a site is locked by another launcher command, EX_TEMPFAIL.
+const lockedStatus = 75
+
+type lockKey struct{}
+
+// Takes the lock on a site for a command that changes it. Commands it runs on the same site,
+// like the build of a rebuild, run under its lock. Returns the context to run them with, and
+// the function releasing the lock.
+func lockSite(cli *Cli, ctx context.Context, command string, name string) (context.Context, func(), error) {
+	locked, _ := ctx.Value(lockKey{}).([]string)
+	if slices.Contains(locked, name) {
+		return ctx, func() {}, nil
+	}
+	host, _ := os.Hostname()
+	holder := utils.LockHolder{
+		Pid:     os.Getpid(),
+		Host:    host,
+		User:    invokingUser(),
+		Command: "launcher " + command + " " + name,
+		Started: time.Now().UTC(),
+	}
+	lock, err := utils.AcquireLock(ctx, cli.StateDir, name, holder, cli.WaitLock)
+	var lockedErr *utils.LockedError
+	if errors.As(err, &lockedErr) {
+		fmt.Fprintln(utils.Out, lockedErr.Error()+". Pass --wait-lock to wait for it.") //nolint:errcheck
+		return ctx, nil, utils.NewExitStatusError(lockedStatus, lockedErr.Error())
+	}
+	if err != nil {
+		return ctx, nil, err
+	}
+	release := func() {
+		if err := lock.Release(); err != nil {
+			fmt.Fprintln(utils.Out, "could not release lock: "+err.Error()) //nolint:errcheck
+		}
+	}
+	return context.WithValue(ctx, lockKey{}, append(slices.Clip(locked), name)), release, nil
+}
@@ -0,0 +1,72 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Lock", func() {
+	var testDir string
+	var stateDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		stateDir, _ = os.MkdirTemp("", "ddocker-state")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+			StateDir:     stateDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)  //nolint:errcheck
+		os.RemoveAll(stateDir) //nolint:errcheck
+	})
+
+	It("runs the commands of a rebuild under its lock, and releases it", func() {
+		runner := ddocker.RebuildCmd{Config: "test", SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		_, err := os.Stat(filepath.Join(stateDir, "test", "lock"))
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+	})
+
+	It("fails when another command holds the lock", func() {
+		host, _ := os.Hostname()
+		holder := utils.LockHolder{Pid: os.Getpid(), Host: host, User: "admin", Command: "launcher rebuild test", Started: time.Now()}
+		lock, err := utils.AcquireLock(ctx, stateDir, "test", holder, false)
+		Expect(err).To(BeNil())
+		defer lock.Release() //nolint:errcheck
+
+		runner := ddocker.DockerBuildCmd{Config: "test", SkipPreflight: true}
+		err = runner.Run(cli, ctx)
+		var statusErr *utils.ExitStatusError
+		Expect(errors.As(err, &statusErr)).To(BeTrue())
+		Expect(statusErr.Status).To(Equal(75))
+		Expect(out.String()).To(ContainSubstring("test is locked by pid"))
+		Expect(out.String()).To(ContainSubstring("launcher rebuild test"))
+		Expect(RanCmds).To(BeEmpty())
+	})
+})
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * rollback
+ */
+
+// Rebuild tags the image it replaces as {config}:previous, and as {config}:{time replaced}.
+const previousTag = "previous"
+const historyTagFormat = "20060102-150405"
+
+var historyTagRegexp = regexp.MustCompile(`^\d{8}-\d{6}$`)
+
+// State file holding when post-deploy migrations last ran for a config.
+const postDeployMigrationsState = "post-deploy-migrations"
+
+type RollbackCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	To     string `name:"to" default:"previous" help:"Image tag to roll back to: 'previous', or a timestamp tag kept by rebuild."`
+	Force  bool   `name:"force" help:"Roll back even when post-deploy migrations ran after the image was replaced."`
+}
+
+func (r *RollbackCmd) Run(cli *Cli, ctx context.Context) error {
+	ctx, unlock, err := lockSite(cli, ctx, "rollback", r.Config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		return err
+	}
+	if conf.RunImage != "" {
+		return errors.New(r.Config + " runs " + conf.RunImage + ", rollback only supports images built by rebuild")
+	}
+
+	repo := utils.DefaultNamespace + "/" + r.Config
+	image := repo + ":" + r.To
+	target, err := docker.Backend.InspectImage(ctx, image)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return errors.New("no image " + image + " to roll back to")
+	}
+
+	tags, err := docker.Backend.ImageTags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	replacedAt := imageReplacedAt(tags, r.To, target)
+	migratedAt, err := lastPostDeployMigrations(cli.StateDir, r.Config)
+	if err != nil {
+		return err
+	}
+	if migratedAt.After(replacedAt) {
+		message := fmt.Sprintf("post-deploy migrations ran at %s, after %s was replaced at %s. It may not work with the migrated database",
+			migratedAt.Local().Format(time.DateTime), image, replacedAt.Local().Format(time.DateTime))
+		if !r.Force {
+			return errors.New(message + ", pass --force to roll back anyway")
+		}
+		fmt.Fprintln(utils.Out, "WARNING: "+message) //nolint:errcheck
+	}
+
+	// point the config at the image, so later starts don't bring back the replacement
+	if err := docker.Backend.TagImage(ctx, target.Id, repo); err != nil {
+		return err
+	}
+
+	destroy := DestroyCmd{Config: r.Config}
+	if err := destroy.Run(cli, ctx); err != nil {
+		return err
+	}
+
+	// the database is ahead of the image, there is nothing for it to migrate
+	extraEnv := []string{"MIGRATE_ON_BOOT=0"}
+	if _, precompileOnBoot := conf.Env["PRECOMPILE_ON_BOOT"]; !precompileOnBoot {
+		extraEnv = append(extraEnv, "PRECOMPILE_ON_BOOT=0")
+	}
+	start := StartCmd{Config: r.Config, extraEnv: extraEnv}
+	return start.Run(cli, ctx)
+}
+
+// When an image was replaced by a rebuild, from its timestamp tag. Images without one,
+// like ones tagged by hand, fall back to when they were created.
+func imageReplacedAt(tags map[string]string, tag string, image *docker.ImageInspect) time.Time {
+	history := []string{}
+	if historyTagRegexp.MatchString(tag) {
+		history = append(history, tag)
+	}
+	for _, t := range imageHistory(tags) {
+		if tags[t] == image.Id {
+			history = append(history, t)
+		}
+	}
+	for _, t := range history {
+		if replacedAt, err := time.ParseInLocation(historyTagFormat, t, time.UTC); err == nil {
+			return replacedAt
+		}
+	}
+	if created := image.LauncherCreated(); !created.IsZero() {
+		return created
+	}
+	return image.Created
+}
+
+// Timestamp tags kept by rebuild, newest first.
+func imageHistory(tags map[string]string) []string {
+	history := []string{}
+	for tag := range tags {
+		if historyTagRegexp.MatchString(tag) {
+			history = append(history, tag)
+		}
+	}
+	slices.Sort(history)
+	slices.Reverse(history)
+	return history
+}
+
+// Tags the image a rebuild replaced, so it can be rolled back to, and drops
+// timestamp tags beyond the newest keep.
+func retainImage(ctx context.Context, name string, id string, replacedAt time.Time, keep int) error {
+	repo := utils.DefaultNamespace + "/" + name
+	if err := docker.Backend.TagImage(ctx, id, repo+":"+replacedAt.UTC().Format(historyTagFormat)); err != nil {
+		return err
+	}
+	if err := docker.Backend.TagImage(ctx, id, repo+":"+previousTag); err != nil {
+		return err
+	}
+
+	tags, err := docker.Backend.ImageTags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	history := imageHistory(tags)
+	for _, tag := range history[min(keep, len(history)):] {
+		// images still used by a container can't be removed, they go on a later rebuild
+		if err := docker.Backend.RemoveImage(ctx, repo+":"+tag); err != nil {
+			fmt.Fprintln(utils.Out, "could not remove "+repo+":"+tag+": "+err.Error()) //nolint:errcheck
+		}
+	}
+	return nil
+}
+
+// When post-deploy migrations last ran for a config. Zero when unknown.
+func lastPostDeployMigrations(stateDir string, name string) (time.Time, error) {
+	content, err := utils.ReadState(stateDir, name, postDeployMigrationsState)
+	if err != nil || content == nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, string(content))
+}
+
+func recordPostDeployMigrations(stateDir string, name string) error {
+	return utils.WriteState(stateDir, name, postDeployMigrationsState, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// Records post-deploy migrations for a container about to start that migrates on boot, as
+// booting runs them too. extraEnv overrides the config's MIGRATE_ON_BOOT.
+func recordBootMigrations(stateDir string, name string, conf *config.Config, extraEnv []string) error {
+	migrate, set := conf.Env["MIGRATE_ON_BOOT"]
+	for _, env := range extraEnv {
+		if value, ok := strings.CutPrefix(env, "MIGRATE_ON_BOOT="); ok {
+			migrate, set = value, true
+		}
+	}
+	if !set || migrate == "0" {
+		return nil
+	}
+	return recordPostDeployMigrations(stateDir, name)
+}
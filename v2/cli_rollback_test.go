@@ -0,0 +1,161 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Rollback", func() {
+	var testDir string
+	var stateDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	var ranCmds = func() []string {
+		cmds := []string{}
+		for _, cmd := range RanCmds {
+			cmds = append(cmds, cmd.String())
+		}
+		return cmds
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		stateDir, _ = os.MkdirTemp("", "ddocker-state")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+			StateDir:     stateDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponse = []byte("123\ttest\tlocal_discourse/test\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n" +
+			"456\tweb_only\tlocal_discourse/web_only\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n")
+		CmdOutputResponses["container inspect"] = []byte(`[{"Id": "123", "Image": "sha256:running"}]`)
+		CmdOutputResponses["image inspect"] = []byte(`[{"Id": "sha256:old", "Created": "2026-09-01T00:00:00Z"}]`)
+		CmdOutputResponses["image ls"] = []byte("latest\tsha256:new\n" +
+			"previous\tsha256:old\n" +
+			"20261010-120000\tsha256:old\n" +
+			"20261001-120000\tsha256:older\n")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)  //nolint:errcheck
+		os.RemoveAll(stateDir) //nolint:errcheck
+	})
+
+	Context("when rebuilding", func() {
+		It("keeps the image the site ran, and drops older images", func() {
+			runner := ddocker.RebuildCmd{Config: "web_only", KeepPrevious: 1, SkipPreflight: true}
+			Expect(runner.Run(cli, ctx)).To(Succeed())
+
+			cmds := ranCmds()
+			Expect(cmds).To(ContainElement(MatchRegexp(`docker tag sha256:running local_discourse/web_only:\d{8}-\d{6}$`)))
+			Expect(cmds).To(ContainElement(HaveSuffix("docker tag sha256:running local_discourse/web_only:previous")))
+			Expect(cmds).To(ContainElement(HaveSuffix("docker image rm local_discourse/web_only:20261001-120000")))
+			Expect(cmds).ToNot(ContainElement(HaveSuffix("docker image rm local_discourse/web_only:20261010-120000")))
+		})
+
+		It("keeps no images when asked not to", func() {
+			runner := ddocker.RebuildCmd{Config: "web_only", KeepPrevious: 0, SkipPreflight: true}
+			Expect(runner.Run(cli, ctx)).To(Succeed())
+			Expect(ranCmds()).ToNot(ContainElement(ContainSubstring("docker tag")))
+		})
+
+		It("records when post-deploy migrations ran", func() {
+			runner := ddocker.RebuildCmd{Config: "web_only", SkipPreflight: true}
+			Expect(runner.Run(cli, ctx)).To(Succeed())
+			content, err := os.ReadFile(filepath.Join(stateDir, "web_only", "post-deploy-migrations"))
+			Expect(err).To(BeNil())
+			migratedAt, err := time.Parse(time.RFC3339, string(content))
+			Expect(err).To(BeNil())
+			Expect(migratedAt).To(BeTemporally("~", time.Now(), time.Minute))
+		})
+	})
+
+	It("refuses after a rebuild whose container migrated on boot", func() {
+		// rebuild removes the build dir
+		confDir, _ := os.MkdirTemp("", "ddocker-containers")
+		defer os.RemoveAll(confDir)                                                                                                        //nolint:errcheck
+		os.WriteFile(filepath.Join(confDir, "boot.yml"), []byte("base_image: discourse/base:release\nenv:\n  MIGRATE_ON_BOOT: 1\n"), 0644) //nolint:errcheck
+		cli.ConfDir = confDir
+
+		rebuild := ddocker.RebuildCmd{Config: "boot", SkipPreflight: true}
+		Expect(rebuild.Run(cli, ctx)).To(Succeed())
+		Expect(ranCmds()).ToNot(ContainElement(ContainSubstring("--tags=db,migrate")))
+		_, err := os.Stat(filepath.Join(stateDir, "boot", "post-deploy-migrations"))
+		Expect(err).To(BeNil())
+
+		runner := ddocker.RollbackCmd{Config: "boot", To: "previous"}
+		Expect(runner.Run(cli, ctx)).To(MatchError(ContainSubstring("pass --force to roll back anyway")))
+	})
+
+	It("does not record migrations that skip post-deploy migrations", func() {
+		runner := ddocker.DockerMigrateCmd{Config: "test", SkipPostDeploymentMigrations: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		_, err := os.Stat(filepath.Join(stateDir, "test", "post-deploy-migrations"))
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+	})
+
+	It("starts the previous image", func() {
+		os.MkdirAll(filepath.Join(stateDir, "test"), 0755)                                                            //nolint:errcheck
+		os.WriteFile(filepath.Join(stateDir, "test", "post-deploy-migrations"), []byte("2026-10-05T00:00:00Z"), 0644) //nolint:errcheck
+
+		runner := ddocker.RollbackCmd{Config: "test", To: "previous"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker image inspect local_discourse/test:previous"))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker image ls --no-trunc --format {{.Tag}}\t{{.ID}} local_discourse/test"))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(HaveSuffix("docker tag sha256:old local_discourse/test"))
+
+		// destroy
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^test$"))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker stop --time 600 test"))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker rm test"))
+	})
+
+	It("refuses when post-deploy migrations ran after the image was replaced", func() {
+		os.MkdirAll(filepath.Join(stateDir, "test"), 0755)                                                            //nolint:errcheck
+		os.WriteFile(filepath.Join(stateDir, "test", "post-deploy-migrations"), []byte("2026-10-11T00:00:00Z"), 0644) //nolint:errcheck
+
+		runner := ddocker.RollbackCmd{Config: "test", To: "previous"}
+		Expect(runner.Run(cli, ctx)).To(MatchError(ContainSubstring("pass --force to roll back anyway")))
+		Expect(ranCmds()).ToNot(ContainElement(ContainSubstring("docker tag")))
+		Expect(ranCmds()).ToNot(ContainElement(ContainSubstring("docker rm")))
+
+		runner = ddocker.RollbackCmd{Config: "test", To: "previous", Force: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(ranCmds()).To(ContainElement(HaveSuffix("docker tag sha256:old local_discourse/test")))
+	})
+
+	It("uses the time a timestamp tag was replaced", func() {
+		os.MkdirAll(filepath.Join(stateDir, "test"), 0755)                                                            //nolint:errcheck
+		os.WriteFile(filepath.Join(stateDir, "test", "post-deploy-migrations"), []byte("2026-10-05T00:00:00Z"), 0644) //nolint:errcheck
+
+		runner := ddocker.RollbackCmd{Config: "test", To: "20261001-120000"}
+		Expect(runner.Run(cli, ctx)).To(MatchError(ContainSubstring("post-deploy migrations ran")))
+	})
+})
@@ -3,11 +3,15 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
+	"github.com/Wing924/shellwords"
 	"github.com/discourse/launcher/v2/config"
 	"github.com/discourse/launcher/v2/docker"
 	"github.com/discourse/launcher/v2/utils"
@@ -26,56 +30,137 @@ import (
  */
 
 type StartCmd struct {
-	Config     string `arg:"" name:"config" help:"config" predictor:"config"`
+	Sites      `embed:""`
 	DryRun     bool   `name:"dry-run" short:"n" help:"Do not start, print docker start command and exit."`
 	DockerArgs string `name:"docker-args" help:"Extra arguments to pass when running docker."`
 	RunImage   string `name:"run-image" help:"Start with a custom image."`
 	Supervised bool   `name:"supervised" env:"SUPERVISED" help:"Attach the running container on start."`
+	Wait       bool   `name:"wait" help:"Wait for the container to pass the config's health_check, GET /srv/status by default. Prints container logs and fails when it doesn't."`
+	// zero uses the config's health_check timeout
+	WaitTimeout time.Duration `name:"wait-timeout" help:"How long to wait for the health check. Defaults to the config's health_check timeout, or 10m."`
+
+	Config string `kong:"-"`
 
 	extraEnv []string
 }
 
-func (r *StartCmd) Run(cli *Cli, ctx context.Context) error {
-	//start stopped container first if exists
-	running, _ := docker.ContainerRunning(r.Config)
-
-	if running && !r.DryRun {
-		fmt.Fprintln(utils.Out, "Nothing to do, your container has already started!") //nolint:errcheck
+func (r *StartCmd) Run(cli *Cli, ctx context.Context) (err error) {
+	if r.Config == "" {
+		names, err := r.names(cli)
+		if err != nil {
+			return err
+		}
+		if r.Supervised {
+			if len(names) > 1 {
+				return errors.New("--supervised attaches to a single site")
+			}
+			site := *r
+			site.Config = names[0]
+			return site.Run(cli, ctx)
+		}
+		return runSites(cli, ctx, "start", names, 1, func(cli *Cli, name string) sitePhases {
+			site := *r
+			site.Config = name
+			return sitePhases{deploy: func(ctx context.Context) error { return site.Run(cli, ctx) }, dryRun: r.DryRun}
+		})
+	}
+	// a supervised start runs as long as its container does, too long to hold the lock
+	if !r.DryRun && !r.Supervised {
+		var unlock func()
+		if ctx, unlock, err = lockSite(cli, ctx, "start", r.Config); err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	defer utils.StartPhase("start", r.Config).Finish(&err)
+	if !r.DryRun {
+		var history *historyEntry
+		ctx, history = startHistory(cli, ctx, "start", r.Config)
+		defer history.finish(ctx, &err)
+	}
+	conf, err := r.start(cli, ctx)
+	if err != nil {
+		return err
+	}
+	if conf != nil && !r.DryRun {
+		image := docker.ConfigImage(conf)
+		if r.RunImage != "" {
+			image = r.RunImage
+		}
+		historyLoaded(ctx, conf, image)
+	}
+	if utils.JsonEvents() && !r.DryRun && !r.Supervised {
+		if state, err := docker.Backend.ContainerState(ctx, r.Config); err == nil && state != nil {
+			utils.Emit(utils.Event{Type: utils.EventContainer, Config: r.Config, Container: state.Name, Id: state.Id})
+		}
+	}
+	// supervised containers have exited by now
+	if !r.Wait || r.DryRun || r.Supervised {
 		return nil
 	}
+	if conf == nil {
+		if conf, err = config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...); err != nil {
+			return err
+		}
+	}
+	return waitHealthy(ctx, conf, r.Config, r.WaitTimeout)
+}
 
-	exists, _ := docker.ContainerExists(r.Config)
+// Starts the container, returning the config when it was loaded to create one.
+func (r *StartCmd) start(cli *Cli, ctx context.Context) (*config.Config, error) {
+	//start stopped container first if exists, a dry run prints the run command regardless
+	if !r.DryRun {
+		state, err := docker.Backend.ContainerState(ctx, r.Config)
+		if err != nil {
+			return nil, err
+		}
 
-	if exists && !r.DryRun {
-		fmt.Fprintln(utils.Out, "starting up existing container") //nolint:errcheck
-		cmd := exec.CommandContext(ctx, utils.DockerPath, "start", r.Config)
+		if state != nil && state.Running {
+			fmt.Fprintln(utils.Out, "Nothing to do, your container has already started!") //nolint:errcheck
+			return nil, nil
+		}
 
-		if r.Supervised {
-			docker.TimeoutDockerContainer(cmd, r.Config)
-			cmd.Args = append(cmd.Args, "--attach")
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
+		if state != nil {
+			fmt.Fprintln(utils.Out, "starting up existing container ("+state.Status+")") //nolint:errcheck
+			return nil, docker.Backend.Start(ctx, state.Name, r.Supervised)
 		}
+	}
 
-		fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
 
-		if err := utils.CmdRunner(cmd).Run(); err != nil {
-			return err
+	if err != nil {
+		return nil, err
+	}
+	// the hostname may come from a secret source
+	if !r.DryRun {
+		if err := config.ResolveSecrets(); err != nil {
+			return nil, err
 		}
-
-		return nil
 	}
 
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	// recorded before running, like migrate
+	if !r.DryRun {
+		if err := recordBootMigrations(cli.StateDir, r.Config, config, r.extraEnv); err != nil {
+			return nil, err
+		}
+	}
 
+	runner, err := r.runner(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	fmt.Fprintln(utils.Out, "starting new container...") //nolint:errcheck
+	return config, runner.Run(ctx)
+}
 
+// The runner for a new container of the config.
+func (r *StartCmd) runner(config *config.Config) (docker.DockerRunner, error) {
 	defaultHostname, _ := os.Hostname()
 	defaultHostname = defaultHostname + "-" + r.Config
-	hostname := config.GetDockerHostname(defaultHostname)
+	hostname, err := config.GetDockerHostname(defaultHostname)
+	if err != nil {
+		return docker.DockerRunner{}, err
+	}
 
 	restart := true
 	detatch := true
@@ -86,9 +171,15 @@ func (r *StartCmd) Run(cli *Cli, ctx context.Context) error {
 	}
 
 	extraFlags := strings.Fields(r.DockerArgs)
+	// recorded so diff can tell when docker_args changed
+	dockerArgs := config.DockerArgs
+	if r.DryRun {
+		dockerArgs = shellwords.Escape(dockerArgs)
+	}
+	extraFlags = append(extraFlags, "--label", docker.DockerArgsLabel+"="+dockerArgs)
 	bootCmd := config.GetBootCommand()
 
-	runner := docker.DockerRunner{
+	return docker.DockerRunner{
 		Config:      config,
 		ContainerId: r.Config,
 		DryRun:      r.DryRun,
@@ -99,10 +190,32 @@ func (r *StartCmd) Run(cli *Cli, ctx context.Context) error {
 		ExtraEnv:    r.extraEnv,
 		Hostname:    hostname,
 		Cmd:         []string{bootCmd},
-	}
+	}, nil
+}
 
-	fmt.Fprintln(utils.Out, "starting new container...") //nolint:errcheck
-	return runner.Run(ctx)
+// Waits for a container of the config to pass its health check, printing its logs when it doesn't.
+func waitHealthy(ctx context.Context, conf *config.Config, container string, timeout time.Duration) error {
+	if timeout == 0 {
+		var err error
+		if timeout, err = conf.GetHealthCheckTimeout(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(utils.Out, "waiting for "+container+" to become healthy...") //nolint:errcheck
+	err := docker.WaitHealthy(ctx, conf, container, timeout)
+	if err == nil {
+		fmt.Fprintln(utils.Out, container+" is healthy") //nolint:errcheck
+		return nil
+	}
+	// an interrupted wait says nothing about the container
+	if ctx.Err() != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, "container logs for "+container+":") //nolint:errcheck
+	if logErr := docker.Backend.Logs(ctx, container, utils.Out); logErr != nil {
+		fmt.Fprintln(utils.Out, "could not read logs: "+logErr.Error()) //nolint:errcheck
+	}
+	return err
 }
 
 type RunCmd struct {
@@ -113,7 +226,7 @@ type RunCmd struct {
 }
 
 func (r *RunCmd) Run(cli *Cli, ctx context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
 	if err != nil {
 		return err
 	}
@@ -130,31 +243,67 @@ func (r *RunCmd) Run(cli *Cli, ctx context.Context) error {
 }
 
 type StopCmd struct {
-	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Sites `embed:""`
+
+	Config string `kong:"-"`
 }
 
 func (r *StopCmd) Run(cli *Cli, ctx context.Context) error {
-	exists, _ := docker.ContainerExists(r.Config)
-	if !exists {
+	if r.Config == "" {
+		names, err := r.names(cli)
+		if err != nil {
+			return err
+		}
+		return runSites(cli, ctx, "stop", names, 1, func(cli *Cli, name string) sitePhases {
+			site := StopCmd{Config: name}
+			return sitePhases{deploy: func(ctx context.Context) error { return site.Run(cli, ctx) }}
+		})
+	}
+	ctx, unlock, err := lockSite(cli, ctx, "stop", r.Config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := docker.Backend.ContainerState(ctx, r.Config)
+	if err != nil {
+		return err
+	}
+	if state == nil {
 		fmt.Fprintln(utils.Out, r.Config+" was not found") //nolint:errcheck
 		return nil
 	}
-	cmd := exec.CommandContext(ctx, utils.DockerPath, "stop", "--time", "600", r.Config)
-
-	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
+	if !state.Running {
+		fmt.Fprintln(utils.Out, r.Config+" is not running ("+state.Status+")") //nolint:errcheck
+		return nil
 	}
-	return nil
+	return docker.Backend.Stop(ctx, state.Name, 600*time.Second)
 }
 
 type RestartCmd struct {
-	Config     string `arg:"" name:"config" help:"config" predictor:"config"`
+	Sites      `embed:""`
 	DockerArgs string `name:"docker-args" help:"Extra arguments to pass when running docker."`
 	RunImage   string `name:"run-image" help:"Override the image used for running the container."`
+
+	Config string `kong:"-"`
 }
 
 func (r *RestartCmd) Run(cli *Cli, ctx context.Context) error {
+	if r.Config == "" {
+		names, err := r.names(cli)
+		if err != nil {
+			return err
+		}
+		return runSites(cli, ctx, "restart", names, 1, func(cli *Cli, name string) sitePhases {
+			site := *r
+			site.Config = name
+			return sitePhases{deploy: func(ctx context.Context) error { return site.Run(cli, ctx) }}
+		})
+	}
+	ctx, unlock, err := lockSite(cli, ctx, "restart", r.Config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	start := StartCmd{Config: r.Config, DockerArgs: r.DockerArgs, RunImage: r.RunImage}
 	stop := StopCmd{Config: r.Config}
 
@@ -173,31 +322,34 @@ type DestroyCmd struct {
 	Config string `arg:"" name:"config" help:"config" predictor:"config"`
 }
 
-func (r *DestroyCmd) Run(cli *Cli, ctx context.Context) error {
-	exists, _ := docker.ContainerExists(r.Config)
-
-	if !exists {
-		fmt.Fprintln(utils.Out, r.Config+" was not found") //nolint:errcheck
-		return nil
+func (r *DestroyCmd) Run(cli *Cli, ctx context.Context) (err error) {
+	ctx, unlock, err := lockSite(cli, ctx, "destroy", r.Config)
+	if err != nil {
+		return err
 	}
-
-	cmd := exec.CommandContext(ctx, utils.DockerPath, "stop", "--time", "600", r.Config)
-	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
-
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
+	defer unlock()
+	ctx, history := startHistory(cli, ctx, "destroy", r.Config)
+	defer history.finish(ctx, &err)
+	state, err := docker.Backend.ContainerState(ctx, r.Config)
+	if err != nil {
 		return err
 	}
 
-	cmd = exec.CommandContext(ctx, utils.DockerPath, "rm", r.Config)
-	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	if state == nil {
+		fmt.Fprintln(utils.Out, r.Config+" was not found") //nolint:errcheck
+		return nil
+	}
 
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
+	if state.Running {
+		if err := docker.Backend.Stop(ctx, state.Name, 600*time.Second); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return docker.Backend.Remove(ctx, state.Name, false)
 }
 
+// Interactive sessions need a tty, so enter always uses the docker cli.
 type EnterCmd struct {
 	Config string `arg:"" name:"config" help:"config" predictor:"config"`
 }
@@ -220,49 +372,144 @@ type LogsCmd struct {
 }
 
 func (r *LogsCmd) Run(cli *Cli, ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, utils.DockerPath, "logs", r.Config)
-	output, err := utils.CmdRunner(cmd).Output()
-
-	if err != nil {
-		return err
-	}
-
-	if _, err = utils.Out.Write(output); err != nil {
+	if err := docker.Backend.Logs(ctx, r.Config, utils.Out); err != nil {
 		return err
 	}
-	if _, err = utils.Out.Write([]byte("\n")); err != nil {
+	if _, err := utils.Out.Write([]byte("\n")); err != nil {
 		return err
 	}
 	return nil
 }
 
 type RebuildCmd struct {
-	Config    string `arg:"" name:"config" help:"config" predictor:"config"`
-	FullBuild bool   `name:"full-build" help:"Run a full build image even when migrate on boot and precompile on boot are present in the config. Saves a fully built image with environment baked in. Without this flag, if MIGRATE_ON_BOOT is set in config it will defer migration until container start, and if PRECOMPILE_ON_BOOT is set in the config, it will defer configure step until container start."`
-	Clean     bool   `help:"runs cleanup commands after rebuilding."`
+	Sites     `embed:""`
+	Parallel  int  `name:"parallel" default:"1" help:"Number of sites to build at once. The rest of the rebuild, which stops and starts sites, is done one site at a time."`
+	FullBuild bool `name:"full-build" help:"Run a full build image even when migrate on boot and precompile on boot are present in the config. Saves a fully built image with environment baked in. Without this flag, if MIGRATE_ON_BOOT is set in config it will defer migration until container start, and if PRECOMPILE_ON_BOOT is set in the config, it will defer configure step until container start."`
+	Clean     bool `help:"runs cleanup commands after rebuilding."`
+	// tagged as local_discourse/{config}:previous and local_discourse/{config}:{time replaced}
+	KeepPrevious  int           `name:"keep-previous" default:"1" env:"LAUNCHER_KEEP_PREVIOUS" help:"Number of replaced images to keep, to roll back to with 'launcher rollback'. 0 keeps none."`
+	Wait          bool          `name:"wait" default:"true" negatable:"" help:"Wait for the new container to pass the config's health_check before running post-deploy migrations. Prints container logs and fails when it doesn't."`
+	WaitTimeout   time.Duration `name:"wait-timeout" help:"How long to wait for the health check. Defaults to the config's health_check timeout, or 10m."`
+	BlueGreen     bool          `name:"blue-green" help:"Start the new container next to the old one, and only replace it once the new one is healthy. Needs an external database, and alternate host ports in the config's blue_green expose when expose publishes ports."`
+	SkipPreflight bool          `name:"skip-preflight" help:"Rebuild without first checking the config for problems that would fail the build."`
+	Resume        bool          `name:"resume" help:"Skip the build, migrate, and configure steps the last rebuild completed, when the Dockerfile, config, and base image haven't changed since, and the image is still the one it left. The container is always replaced."`
+	FromStep      string        `name:"from-step" placeholder:"STEP" help:"Skip the steps before this one: build, migrate, or configure."`
+
+	Config string `kong:"-"`
 }
 
-func (r *RebuildCmd) Run(cli *Cli, ctx context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+// What a rebuild's build leaves for the rest of the rebuild.
+type rebuiltImage struct {
+	config     *config.Config
+	previous   string
+	replacedAt time.Time
+	steps      *checkpoints
+}
 
+func (r *RebuildCmd) Run(cli *Cli, ctx context.Context) (err error) {
+	if err := checkFromStep(r.FromStep); err != nil {
+		return err
+	}
+	if r.Config == "" {
+		names, err := r.names(cli)
+		if err != nil {
+			return err
+		}
+		return runSites(cli, ctx, "rebuild", names, r.Parallel, func(cli *Cli, name string) sitePhases {
+			site := *r
+			site.Config = name
+			var image *rebuiltImage
+			return sitePhases{
+				build: func(ctx context.Context, stdout io.Writer, stderr io.Writer) (err error) {
+					image, err = site.build(cli, ctx, stdout, stderr)
+					return err
+				},
+				deploy: func(ctx context.Context) error {
+					return site.deploy(cli, ctx, image)
+				},
+			}
+		})
+	}
+	ctx, unlock, err := lockSite(cli, ctx, "rebuild", r.Config)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+	ctx, history := startHistory(cli, ctx, "rebuild", r.Config)
+	defer history.finish(ctx, &err)
+	image, err := r.build(cli, ctx, nil, nil)
+	if err != nil {
+		return err
+	}
+	return r.deploy(cli, ctx, image)
+}
+
+// Builds the new image, before the running site is touched.
+func (r *RebuildCmd) build(cli *Cli, ctx context.Context, stdout io.Writer, stderr io.Writer) (*rebuiltImage, error) {
+	if !r.SkipPreflight {
+		if err := preflight(cli, r.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Profile...)
+
+	if err != nil {
+		return nil, err
+	}
+	historyLoaded(ctx, config, docker.ConfigImage(config))
+	// the database host decides how the site is migrated, and may come from a secret source
+	if err := config.ResolveSecrets(); err != nil {
+		return nil, err
+	}
+
+	if r.BlueGreen {
+		externalDb, err := config.ExternalDb()
+		if err != nil {
+			return nil, err
+		}
+		if !externalDb {
+			return nil, errors.New("--blue-green needs an external database, standalone sites stop for migrations")
+		}
+		if err := docker.CheckBlueGreen(config); err != nil {
+			return nil, err
+		}
+	}
+
+	image := &rebuiltImage{config: config, replacedAt: time.Now()}
+	if r.KeepPrevious > 0 {
+		if image.previous, err = siteImage(ctx, r.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	build := DockerBuildCmd{Config: r.Config, SkipPreflight: true, stdout: stdout, stderr: stderr}
+	if image.steps, err = loadCheckpoints(cli, "rebuild", build, r.Resume, r.FromStep); err != nil {
+		return nil, err
+	}
+	if err := image.steps.run(ctx, "build", func() error { return build.Run(cli, ctx) }); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// Replaces the site's container with one of the new image.
+func (r *RebuildCmd) deploy(cli *Cli, ctx context.Context, image *rebuiltImage) error {
+	config := image.config
+	previous := image.previous
 
 	// if we're not in an all-in-one setup, we can run migrations while the app is running
-	externalDb := config.Env["DISCOURSE_DB_SOCKET"] == "" && config.Env["DISCOURSE_DB_HOST"] != ""
+	externalDb, err := config.ExternalDb()
+	if err != nil {
+		return err
+	}
 
-	build := DockerBuildCmd{Config: r.Config}
 	configure := DockerConfigureCmd{Config: r.Config}
 	stop := StopCmd{Config: r.Config}
 	destroy := DestroyCmd{Config: r.Config}
 	clean := CleanupCmd{}
 	extraEnv := []string{}
 
-	if err := build.Run(cli, ctx); err != nil {
-		return err
-	}
-
 	if !externalDb {
 		if err := stop.Run(cli, ctx); err != nil {
 			return err
@@ -279,7 +526,7 @@ func (r *RebuildCmd) Run(cli *Cli, ctx context.Context) error {
 			migrate.SkipPostDeploymentMigrations = true
 		}
 
-		if err := migrate.Run(cli, ctx); err != nil {
+		if err := image.steps.run(ctx, "migrate", func() error { return migrate.Run(cli, ctx) }); err != nil {
 			return err
 		}
 
@@ -289,21 +536,36 @@ func (r *RebuildCmd) Run(cli *Cli, ctx context.Context) error {
 	_, precompileOnBoot := config.Env["PRECOMPILE_ON_BOOT"]
 
 	if !precompileOnBoot || r.FullBuild {
-		if err := configure.Run(cli, ctx); err != nil {
+		if err := image.steps.run(ctx, "configure", func() error { return configure.Run(cli, ctx) }); err != nil {
 			return err
 		}
 
 		extraEnv = append(extraEnv, "PRECOMPILE_ON_BOOT=0")
 	}
 
-	if err := destroy.Run(cli, ctx); err != nil {
-		return err
+	if previous != "" {
+		if err := retainImage(ctx, r.Config, previous, image.replacedAt, r.KeepPrevious); err != nil {
+			return err
+		}
 	}
 
-	start := StartCmd{Config: r.Config, extraEnv: extraEnv}
+	if r.BlueGreen {
+		if err := r.swapContainers(cli, ctx, config, extraEnv); err != nil {
+			return err
+		}
+	} else {
+		if err := destroy.Run(cli, ctx); err != nil {
+			return err
+		}
+
+		start := StartCmd{Config: r.Config, Wait: r.Wait, WaitTimeout: r.WaitTimeout, extraEnv: extraEnv}
 
-	if err := start.Run(cli, ctx); err != nil {
-		return err
+		if err := start.Run(cli, ctx); err != nil {
+			if previous != "" && ctx.Err() == nil {
+				fmt.Fprintln(utils.Out, "Roll back to the previous image with: launcher rollback "+r.Config) //nolint:errcheck
+			}
+			return err
+		}
 	}
 
 	// run post deploy migrations since we've rebooted
@@ -323,18 +585,33 @@ func (r *RebuildCmd) Run(cli *Cli, ctx context.Context) error {
 	return nil
 }
 
-type CleanupCmd struct{}
-
-func (r *CleanupCmd) Run(cli *Cli, ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, utils.DockerPath, "container", "prune", "--filter", "until=1h")
-
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
+// Id of the image a site runs, or local_discourse/{config} when it has no container.
+// A failed rebuild may have already replaced the tag. Empty when there is neither.
+func siteImage(ctx context.Context, name string) (string, error) {
+	state, err := docker.Backend.ContainerState(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if state != nil {
+		container, err := docker.Backend.InspectContainer(ctx, state.Id)
+		if err != nil {
+			return "", err
+		}
+		if container != nil {
+			return container.Image, nil
+		}
 	}
+	image, err := docker.Backend.InspectImage(ctx, utils.DefaultNamespace+"/"+name)
+	if err != nil || image == nil {
+		return "", err
+	}
+	return image.Id, nil
+}
 
-	cmd = exec.CommandContext(ctx, utils.DockerPath, "image", "prune", "--all", "--filter", "until=1h")
+type CleanupCmd struct{}
 
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
+func (r *CleanupCmd) Run(cli *Cli, ctx context.Context) error {
+	if err := docker.Backend.Prune(ctx, "1h"); err != nil {
 		return err
 	}
 
@@ -350,7 +627,7 @@ func (r *CleanupCmd) Run(cli *Cli, ctx context.Context) error {
 			fmt.Fprintln(utils.Out, "removing old PostgreSQL data cluster at /var/discourse/shared/standalone/postgres_data_old...") //nolint:errcheck
 			os.RemoveAll("/var/discourse/shared/standalone/postgres_data_old")                                                       //nolint:errcheck
 		} else {
-			fmt.Println("canceled removing old PostgreSQL data")
+			fmt.Fprintln(utils.Out, "canceled removing old PostgreSQL data") //nolint:errcheck
 			return nil
 		}
 	}
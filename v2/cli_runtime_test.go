@@ -6,7 +6,9 @@ import (
 
 	"bytes"
 	"context"
+	"errors"
 	"os"
+	"strings"
 
 	ddocker "github.com/discourse/launcher/v2"
 	. "github.com/discourse/launcher/v2/test_utils"
@@ -37,13 +39,10 @@ var _ = Describe("Runtime", func() {
 
 	Context("When running run commands", func() {
 		var checkStartCmd = func() {
-			Expect(len(RanCmds)).To(Equal(3))
+			Expect(len(RanCmds)).To(Equal(2))
 
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps --quiet --filter name=test"))
-
-			cmd = GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^test$"))
 
 			cmd = GetLastCommand()
 			Expect(cmd.String()).To(ContainSubstring("docker run"))
@@ -56,14 +55,14 @@ var _ = Describe("Runtime", func() {
 			Expect(len(RanCmds)).To(Equal(1))
 
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps --quiet --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^test$"))
 		}
 
 		var checkStopCmd = func() {
 			Expect(len(RanCmds)).To(Equal(2))
 
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^test$"))
 			cmd = GetLastCommand()
 			Expect(cmd.String()).To(ContainSubstring("docker stop --time 600 test"))
 		}
@@ -72,7 +71,7 @@ var _ = Describe("Runtime", func() {
 			Expect(len(RanCmds)).To(Equal(1))
 
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^test$"))
 		}
 
 		Context("without a running container", func() {
@@ -89,11 +88,64 @@ var _ = Describe("Runtime", func() {
 			})
 		})
 
+		It("prints the run command of a dry run when docker ps fails", func() {
+			CmdOutputError = errors.New("cannot connect to the docker daemon")
+			runner := ddocker.StartCmd{Config: "test", DryRun: true}
+			Expect(runner.Run(cli, ctx)).To(Succeed())
+			Expect(RanCmds).To(BeEmpty())
+			Expect(out.String()).To(ContainSubstring("--name test local_discourse/test /sbin/boot"))
+		})
+
+		Context("with a similarly named container", func() {
+			BeforeEach(func() {
+				CmdOutputResponse = []byte("123\ttest2\tlocal_discourse/test2\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n")
+			})
+
+			It("should start a new container", func() {
+				runner := ddocker.StartCmd{Config: "test"}
+				runner.Run(cli, ctx) //nolint:errcheck
+				checkStartCmd()
+			})
+
+			It("should not stop the other container", func() {
+				runner := ddocker.StopCmd{Config: "test"}
+				runner.Run(cli, ctx) //nolint:errcheck
+				checkStopCmdWhenMissing()
+				Expect(out.String()).To(ContainSubstring("test was not found"))
+			})
+		})
+
+		Context("with a stopped container", func() {
+			BeforeEach(func() {
+				CmdOutputResponse = []byte("123\ttest\tlocal_discourse/test\tExited (0) 5 minutes ago\t2026-10-16 10:00:00 +0000 UTC\n")
+			})
+
+			It("should start the existing container", func() {
+				runner := ddocker.StartCmd{Config: "test"}
+				runner.Run(cli, ctx) //nolint:errcheck
+				Expect(len(RanCmds)).To(Equal(2))
+				GetLastCommand()
+				cmd := GetLastCommand()
+				Expect(cmd.String()).To(ContainSubstring("docker start test"))
+			})
+
+			It("should remove without stopping on destroy", func() {
+				runner := ddocker.DestroyCmd{Config: "test"}
+				runner.Run(cli, ctx) //nolint:errcheck
+				Expect(len(RanCmds)).To(Equal(2))
+				GetLastCommand()
+				cmd := GetLastCommand()
+				Expect(cmd.String()).To(ContainSubstring("docker rm test"))
+			})
+		})
+
 		Context("with a running container", func() {
 			BeforeEach(func() {
-				//response should be non-empty, indicating a running container
-				response := []byte{123}
-				CmdOutputResponse = response
+				// the fake runner answers every ps the same way, so list each container under test
+				CmdOutputResponse = []byte("" +
+					"123\ttest\tlocal_discourse/test\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n" +
+					"456\tweb_only\tlocal_discourse/web_only\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n" +
+					"789\tstandalone\tlocal_discourse/standalone\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n")
 			})
 
 			It("should not run start commands", func() {
@@ -109,7 +161,7 @@ var _ = Describe("Runtime", func() {
 			})
 
 			It("should keep running during commits, and be post-deploy migration aware when using a web only container", func() {
-				runner := ddocker.RebuildCmd{Config: "web_only"}
+				runner := ddocker.RebuildCmd{Config: "web_only", SkipPreflight: true}
 				runner.Run(cli, ctx) //nolint:errcheck
 
 				//initial build
@@ -133,7 +185,7 @@ var _ = Describe("Runtime", func() {
 
 				// destroying
 				cmd = GetLastCommand()
-				Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet --filter name=web_only"))
+				Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^web_only$"))
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker stop --time 600 web_only"))
 				cmd = GetLastCommand()
@@ -142,7 +194,7 @@ var _ = Describe("Runtime", func() {
 				// starting container --run command won't run because
 				// tests already believe we're running
 				cmd = GetLastCommand()
-				Expect(cmd.String()).To(ContainSubstring("docker ps --quiet"))
+				Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^web_only$"))
 
 				// run post-deploy migrations
 				cmd = GetLastCommand()
@@ -151,8 +203,25 @@ var _ = Describe("Runtime", func() {
 				Expect(len(RanCmds)).To(Equal(0))
 			})
 
+			It("should not run post-deploy migrations when the new container is not healthy", func() {
+				CmdOutputResponses["container inspect"] = []byte(`[{"Id": "456", "State": {"Status": "exited", "Running": false}}]`)
+				CmdOutputResponses["docker logs"] = []byte("boot failed")
+				runner := ddocker.RebuildCmd{Config: "web_only", Wait: true, SkipPreflight: true}
+				Expect(runner.Run(cli, ctx)).To(MatchError("web_only is exited"))
+
+				migrations := 0
+				for _, cmd := range RanCmds {
+					if strings.Contains(cmd.String(), "--tags=db,migrate") {
+						migrations++
+					}
+				}
+				Expect(migrations).To(Equal(1))
+				Expect(RanCmds[len(RanCmds)-1].String()).To(ContainSubstring("docker logs web_only"))
+				Expect(out.String()).To(ContainSubstring("container logs for web_only:\nboot failed"))
+			})
+
 			It("should stop with standalone", func() {
-				runner := ddocker.RebuildCmd{Config: "standalone"}
+				runner := ddocker.RebuildCmd{Config: "standalone", SkipPreflight: true}
 
 				runner.Run(cli, ctx) //nolint:errcheck
 
@@ -162,7 +231,7 @@ var _ = Describe("Runtime", func() {
 				cmd = GetLastCommand()
 
 				// stop
-				Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet --filter name=standalone"))
+				Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^standalone$"))
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker stop"))
 
@@ -183,7 +252,7 @@ var _ = Describe("Runtime", func() {
 
 				// run destroy
 				cmd = GetLastCommand()
-				Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet"))
+				Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^standalone$"))
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker stop"))
 				cmd = GetLastCommand()
@@ -191,7 +260,7 @@ var _ = Describe("Runtime", func() {
 
 				// run start (we think we're already started here so this is just ps)
 				cmd = GetLastCommand()
-				Expect(cmd.String()).To(ContainSubstring("docker ps --quiet"))
+				Expect(cmd.String()).To(ContainSubstring("docker ps --all --no-trunc --filter name=^standalone$"))
 				Expect(len(RanCmds)).To(Equal(0))
 
 				// Ensure we clean up the temp dir after building
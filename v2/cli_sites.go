@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * commands run on several sites
+ */
+
+// Sites a command runs on: the configs named, or every config in the conf dir. Commands taking
+// Sites run on their Config alone when it is set, as when other commands run them.
+type Sites struct {
+	Configs []string `arg:"" optional:"" name:"config" help:"Configs to run on." predictor:"config"`
+	All     bool     `name:"all" help:"Run on every config in the conf dir."`
+}
+
+func (s Sites) names(cli *Cli) ([]string, error) {
+	return siteNames(cli, s.Configs, s.All)
+}
+
+func siteNames(cli *Cli, configs []string, all bool) ([]string, error) {
+	if all && len(configs) > 0 {
+		return nil, errors.New("pass configs, or --all, not both")
+	}
+	names := slices.Clone(configs)
+	if all {
+		if names = utils.ConfigNames(cli.ConfDir); len(names) == 0 {
+			return nil, errors.New("no configs in " + cli.ConfDir)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("pass a config, or --all")
+	}
+	unique := []string{}
+	for _, name := range names {
+		if !slices.Contains(unique, name) {
+			unique = append(unique, name)
+		}
+	}
+	return unique, nil
+}
+
+// A site's part of a command run on several sites. Either phase may be nil.
+type sitePhases struct {
+	// Runs on up to --parallel sites at once, writing docker output to stdout and stderr.
+	build func(ctx context.Context, stdout io.Writer, stderr io.Writer) error
+	// Runs on one site at a time once all builds are done, so sites aren't down all at once.
+	deploy func(ctx context.Context) error
+	// A dry run changes nothing, it takes no lock and isn't recorded in history.
+	dryRun bool
+}
+
+// A site of a command run on several sites.
+type siteRun struct {
+	name    string
+	phases  sitePhases
+	ctx     context.Context
+	unlock  func()
+	history *historyEntry
+	started time.Time
+	ended   time.Time
+	// whether it started, and whether all its phases ran
+	ran  bool
+	done bool
+	err  error
+}
+
+// Takes the site's lock, and starts recording it in history.
+func (s *siteRun) begin(cli *Cli, ctx context.Context, command string) bool {
+	s.started = time.Now()
+	s.ended = s.started
+	s.ran = true
+	if s.phases.dryRun {
+		s.ctx = ctx
+		return true
+	}
+	if s.ctx, s.unlock, s.err = lockSite(cli, ctx, command, s.name); s.err != nil {
+		return false
+	}
+	s.ctx, s.history = startHistory(cli, s.ctx, command, s.name)
+	return true
+}
+
+// Runs a phase of the site, done when it is the last one.
+func (s *siteRun) run(phase func() error, last bool) {
+	s.err = phase()
+	s.ended = time.Now()
+	s.done = last && s.err == nil
+}
+
+func (s *siteRun) end() {
+	if s.unlock == nil {
+		return
+	}
+	s.history.finish(s.ctx, &s.err)
+	s.unlock()
+	s.unlock = nil
+}
+
+func (s *siteRun) result(ctx context.Context) string {
+	switch {
+	case s.err != nil && ctx.Err() != nil:
+		return "cancelled"
+	case s.err != nil:
+		return "failed"
+	case !s.done:
+		return "cancelled"
+	}
+	return "ok"
+}
+
+// Runs a command on several sites: builds on up to parallel sites at once, then the rest
+// one site at a time. A failed site doesn't stop the others, and is reported in the summary
+// printed at the end. Once ctx is cancelled, sites not started yet are skipped. A single site
+// runs the same, without prefixing its output with its name or a summary.
+func runSites(cli *Cli, ctx context.Context, command string, names []string, parallel int, phases func(cli *Cli, name string) sitePhases) error {
+	sites := []*siteRun{}
+	for _, name := range names {
+		siteCli := *cli
+		if cli.BuildDir != "" && len(names) > 1 {
+			// builds running at once each need their own build dir
+			siteCli.BuildDir = filepath.Join(cli.BuildDir, name)
+		}
+		sites = append(sites, &siteRun{name: name, phases: phases(&siteCli, name)})
+	}
+
+	several := len(sites) > 1
+
+	queue := make(chan *siteRun)
+	wg := sync.WaitGroup{}
+	for range min(max(parallel, 1), len(sites)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range queue {
+				if ctx.Err() != nil || !site.begin(cli, ctx, command) {
+					continue
+				}
+				if !several {
+					site.run(func() error { return site.phases.build(site.ctx, utils.Stdout, utils.Stderr) }, site.phases.deploy == nil)
+					continue
+				}
+				stdout := utils.NewSiteWriter(site.name, "stdout")
+				stderr := utils.NewSiteWriter(site.name, "stderr")
+				site.run(func() error { return site.phases.build(site.ctx, stdout, stderr) }, site.phases.deploy == nil)
+				stdout.Close() //nolint:errcheck
+				stderr.Close() //nolint:errcheck
+			}
+		}()
+	}
+	for _, site := range sites {
+		if site.phases.build != nil {
+			queue <- site
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	for _, site := range sites {
+		if site.phases.deploy == nil || site.err != nil || ctx.Err() != nil {
+			continue
+		}
+		if site.phases.build == nil && !site.begin(cli, ctx, command) {
+			continue
+		}
+		if several {
+			fmt.Fprintln(utils.Out, "==> "+command+" "+site.name) //nolint:errcheck
+		}
+		site.run(func() error { return site.phases.deploy(site.ctx) }, true)
+	}
+
+	failed := 0
+	for _, site := range sites {
+		site.end()
+		if site.result(ctx) != "ok" {
+			failed++
+		}
+	}
+	if site := sites[0]; !several {
+		if site.err == nil && !site.done {
+			return ctx.Err()
+		}
+		return site.err
+	}
+	if err := writeSitesSummary(ctx, sites); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return utils.NewExitStatusError(1, fmt.Sprintf("%s failed for %d of %d sites", command, failed, len(sites)))
+	}
+	return nil
+}
+
+func writeSitesSummary(ctx context.Context, sites []*siteRun) error {
+	w := tabwriter.NewWriter(utils.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nSITE\tRESULT\tDURATION\tERROR") //nolint:errcheck
+	for _, site := range sites {
+		duration, message := "-", "-"
+		if site.ran {
+			duration = site.ended.Sub(site.started).Round(time.Second).String()
+		}
+		if site.err != nil {
+			message, _, _ = strings.Cut(site.err.Error(), "\n")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", site.name, site.result(ctx), duration, message) //nolint:errcheck
+	}
+	return w.Flush()
+}
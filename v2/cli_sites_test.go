@@ -0,0 +1,143 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Several sites", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	var ranCmds = func() []string {
+		cmds := []string{}
+		for _, cmd := range RanCmds {
+			cmds = append(cmds, cmd.String())
+		}
+		return cmds
+	}
+
+	var indexOf = func(cmds []string, substr string) int {
+		for i, cmd := range cmds {
+			if strings.Contains(cmd, substr) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		utils.Stdout = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	AfterEach(func() {
+		utils.Stdout = os.Stdout
+		os.RemoveAll(testDir) //nolint:errcheck
+	})
+
+	It("builds sites, then deploys them one at a time", func() {
+		runner := ddocker.RebuildCmd{Sites: ddocker.Sites{Configs: []string{"test", "web_only"}}, Parallel: 2, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		cmds := ranCmds()
+		lastBuild := max(indexOf(cmds, "--tag local_discourse/test "), indexOf(cmds, "--tag local_discourse/web_only "))
+		Expect(indexOf(cmds, "docker build")).To(BeNumerically(">=", 0))
+		Expect(lastBuild).To(BeNumerically("<", indexOf(cmds, "docker run")))
+		Expect(out.String()).To(ContainSubstring("==> rebuild test"))
+		Expect(out.String()).To(MatchRegexp(`test\s+ok`))
+		Expect(out.String()).To(MatchRegexp(`web_only\s+ok`))
+	})
+
+	It("takes the build flags after the configs", func() {
+		runner := ddocker.DockerBuildCmd{Args: []string{"test", "web_only", "--platform", "linux/amd64"}, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		cmds := ranCmds()
+		Expect(cmds).To(HaveLen(2))
+		for _, cmd := range cmds {
+			Expect(cmd).To(ContainSubstring("--platform linux/amd64"))
+		}
+	})
+
+	It("reports failed sites, and runs the others", func() {
+		runner := ddocker.DockerBuildCmd{Args: []string{"missing", "test"}, Parallel: 2, SkipPreflight: true}
+		err := runner.Run(cli, ctx)
+		var statusErr *utils.ExitStatusError
+		Expect(errors.As(err, &statusErr)).To(BeTrue())
+		Expect(err.Error()).To(Equal("build failed for 1 of 2 sites"))
+		Expect(out.String()).To(MatchRegexp(`missing\s+failed`))
+		Expect(out.String()).To(MatchRegexp(`test\s+ok`))
+		Expect(ranCmds()).To(ContainElement(ContainSubstring("local_discourse/test")))
+	})
+
+	It("does not deploy sites whose build failed", func() {
+		CmdOutputError = errors.New("build failed")
+		runner := ddocker.RebuildCmd{Sites: ddocker.Sites{Configs: []string{"test", "web_only"}}, SkipPreflight: true}
+		Expect(runner.Run(cli, ctx)).ToNot(Succeed())
+		Expect(indexOf(ranCmds(), "docker run")).To(Equal(-1))
+		Expect(out.String()).ToNot(ContainSubstring("==> rebuild"))
+	})
+
+	It("skips sites once cancelled", func() {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		runner := ddocker.StopCmd{Sites: ddocker.Sites{Configs: []string{"test", "web_only"}}}
+		Expect(runner.Run(cli, cancelled)).ToNot(Succeed())
+		Expect(RanCmds).To(BeEmpty())
+		Expect(out.String()).To(MatchRegexp(`test\s+cancelled\s+-`))
+	})
+
+	It("takes no locks and records no history on dry runs", func() {
+		cli.StateDir = filepath.Join(testDir, "state")
+		runner := ddocker.StartCmd{Sites: ddocker.Sites{Configs: []string{"test", "web_only"}}, DryRun: true}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		_, err := os.Stat(cli.StateDir)
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+
+		holder := utils.LockHolder{Pid: os.Getpid(), Command: "launcher rebuild test", Started: time.Now()}
+		lock, err := utils.AcquireLock(ctx, cli.StateDir, "test", holder, false)
+		Expect(err).To(BeNil())
+		defer lock.Release() //nolint:errcheck
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(out.String()).ToNot(ContainSubstring("locked"))
+		_, err = os.Stat(filepath.Join(cli.StateDir, "test", "history.jsonl"))
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+	})
+
+	It("needs configs or --all", func() {
+		runner := ddocker.StopCmd{}
+		Expect(runner.Run(cli, ctx)).To(MatchError("pass a config, or --all"))
+	})
+
+	It("runs a single site without a summary", func() {
+		runner := ddocker.StopCmd{Sites: ddocker.Sites{Configs: []string{"test"}}}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(out.String()).ToNot(ContainSubstring("RESULT"))
+	})
+})
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * status
+ */
+type StatusCmd struct {
+	Format  string   `name:"format" default:"table" enum:"table,json" help:"Output format, table or json."`
+	Configs []string `arg:"" optional:"" name:"config" help:"configs to report on. Defaults to all configs in the conf dir." predictor:"config"`
+}
+
+type SiteStatus struct {
+	Config  string `json:"config"`
+	Exists  bool   `json:"exists"`
+	Running bool   `json:"running"`
+	Status  string `json:"status,omitempty"`
+	// Image the container runs, and the image local_discourse/{config} currently points to
+	Image         string     `json:"image,omitempty"`
+	ImageId       string     `json:"image_id,omitempty"`
+	LatestImage   string     `json:"latest_image"`
+	LatestImageId string     `json:"latest_image_id,omitempty"`
+	ImageCurrent  bool       `json:"image_current"`
+	ImageCreated  *time.Time `json:"image_created,omitempty"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	Uptime        int64      `json:"uptime_seconds,omitempty"`
+	RestartCount  int        `json:"restart_count"`
+	Ports         []string   `json:"ports"`
+	// Env keys that differ between the config and the container. Values are omitted, they may be secrets.
+	EnvDrift []string `json:"env_drift"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func (r *StatusCmd) Run(cli *Cli, ctx context.Context) error {
+	configs := r.Configs
+	if len(configs) == 0 {
+		configs = utils.ConfigNames(cli.ConfDir)
+	}
+
+	statuses := []*SiteStatus{}
+	for _, name := range configs {
+		status, err := siteStatus(ctx, cli, name)
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, status)
+	}
+
+	if r.Format == "json" {
+		encoder := json.NewEncoder(utils.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+	return writeStatusTable(statuses)
+}
+
+// Errors talking to docker are returned, config errors are reported on the status.
+func siteStatus(ctx context.Context, cli *Cli, name string) (*SiteStatus, error) {
+	status := &SiteStatus{
+		Config:      name,
+		LatestImage: utils.DefaultNamespace + "/" + name,
+		Ports:       []string{},
+		EnvDrift:    []string{},
+	}
+
+	conf, err := config.LoadConfig(cli.ConfDir, name, true, cli.TemplatesDir, cli.Profile...)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.LatestImage = docker.ConfigImage(conf)
+	}
+
+	latest, err := docker.Backend.InspectImage(ctx, status.LatestImage)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil {
+		status.LatestImageId = latest.Id
+	}
+
+	state, err := docker.Backend.ContainerState(ctx, name)
+	if err != nil || state == nil {
+		return status, err
+	}
+	container, err := docker.Backend.InspectContainer(ctx, state.Id)
+	if err != nil || container == nil {
+		return status, err
+	}
+
+	status.Exists = true
+	status.Running = container.State.Running
+	status.Status = state.Status
+	status.Image = container.Config.Image
+	status.ImageId = container.Image
+	status.ImageCurrent = latest != nil && latest.Id == container.Image
+	status.RestartCount = container.RestartCount
+	status.Ports = container.PublishedPorts()
+
+	if container.State.Running && !container.State.StartedAt.IsZero() {
+		startedAt := container.State.StartedAt
+		status.StartedAt = &startedAt
+		status.Uptime = int64(time.Since(startedAt).Seconds())
+	}
+
+	image, err := docker.Backend.InspectImage(ctx, container.Image)
+	if err != nil {
+		return nil, err
+	}
+	if image != nil {
+		if created := image.LauncherCreated(); !created.IsZero() {
+			status.ImageCreated = &created
+		}
+	}
+
+	if conf != nil {
+		for _, d := range docker.ConfigDrift(conf, container, image, latest) {
+			if d.Category == docker.DriftEnv {
+				status.EnvDrift = append(status.EnvDrift, d.Key)
+			}
+		}
+	}
+
+	return status, nil
+}
+
+func writeStatusTable(statuses []*SiteStatus) error {
+	w := tabwriter.NewWriter(utils.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONFIG\tCONTAINER\tIMAGE\tBUILT\tUPTIME\tRESTARTS\tPORTS\tENV") //nolint:errcheck
+	for _, s := range statuses {
+		container := "missing"
+		image := "-"
+		built := "-"
+		uptime := "-"
+		restarts := "-"
+		ports := "-"
+		env := "-"
+		if s.Exists {
+			container = s.Status
+			image = "outdated"
+			if s.ImageCurrent {
+				image = "current"
+			}
+			if s.ImageCreated != nil {
+				built = s.ImageCreated.Local().Format(time.DateTime)
+			}
+			if s.StartedAt != nil {
+				uptime = (time.Duration(s.Uptime) * time.Second).String()
+			}
+			restarts = strconv.Itoa(s.RestartCount)
+			if len(s.Ports) > 0 {
+				ports = strings.Join(s.Ports, ",")
+			}
+			env = "ok"
+			if len(s.EnvDrift) > 0 {
+				env = "drift: " + strings.Join(s.EnvDrift, ",")
+			}
+		}
+		if s.Error != "" {
+			env = "config error: " + s.Error
+		}
+		fmt.Fprintln(w, strings.Join([]string{s.Config, container, image, built, uptime, restarts, ports, env}, "\t")) //nolint:errcheck
+	}
+	return w.Flush()
+}
@@ -0,0 +1,105 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	"github.com/discourse/launcher/v2/config"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Status", func() {
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		ctx = context.Background()
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+		}
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	It("reports missing containers", func() {
+		CmdOutputResponses["docker image inspect"] = []byte("[]")
+		runner := ddocker.StatusCmd{Configs: []string{"test"}, Format: "json"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+
+		statuses := []ddocker.SiteStatus{}
+		Expect(json.Unmarshal(out.Bytes(), &statuses)).To(Succeed())
+		Expect(statuses).To(HaveLen(1))
+		Expect(statuses[0].Exists).To(BeFalse())
+		Expect(statuses[0].LatestImage).To(Equal("local_discourse/test"))
+	})
+
+	Context("with a running container", func() {
+		BeforeEach(func() {
+			conf, err := config.LoadConfig("./test/containers", "test", true, "./test")
+			Expect(err).To(BeNil())
+			confEnv, err := conf.GetEnvSlice(true)
+			Expect(err).To(BeNil())
+			env := []string{}
+			for _, e := range confEnv {
+				if strings.HasPrefix(e, "DISCOURSE_HOSTNAME=") {
+					e = "DISCOURSE_HOSTNAME=old.example.com"
+				}
+				env = append(env, e)
+			}
+			inspect, _ := json.Marshal([]map[string]any{{
+				"Id":           "123",
+				"Image":        "sha256:old",
+				"RestartCount": 2,
+				"State":        map[string]any{"Status": "running", "Running": true, "StartedAt": "2026-10-16T10:00:00.123456789Z"},
+				"Config":       map[string]any{"Image": "local_discourse/test", "Env": env},
+				"NetworkSettings": map[string]any{"Ports": map[string]any{
+					"80/tcp":  []map[string]string{{"HostIp": "0.0.0.0", "HostPort": "80"}, {"HostIp": "::", "HostPort": "80"}},
+					"100/tcp": nil,
+				}},
+			}})
+			CmdOutputResponses["docker ps"] = []byte("123\ttest\tlocal_discourse/test\tUp 2 hours\t2026-10-16 10:00:00 +0000 UTC\n")
+			CmdOutputResponses["docker container inspect"] = inspect
+			CmdOutputResponses["docker image inspect local_discourse/test"] = []byte(`[{"Id":"sha256:new"}]`)
+			CmdOutputResponses["docker image inspect sha256:old"] = []byte(`[{"Id":"sha256:old","Config":{"Labels":{"org.opencontainers.image.created":"2026-10-15T08:00:00Z"}}}]`)
+		})
+
+		It("reports container and image state as json", func() {
+			runner := ddocker.StatusCmd{Configs: []string{"test"}, Format: "json"}
+			Expect(runner.Run(cli, ctx)).To(Succeed())
+
+			statuses := []ddocker.SiteStatus{}
+			Expect(json.Unmarshal(out.Bytes(), &statuses)).To(Succeed())
+			status := statuses[0]
+			Expect(status.Exists).To(BeTrue())
+			Expect(status.Running).To(BeTrue())
+			Expect(status.Status).To(Equal("Up 2 hours"))
+			Expect(status.ImageCurrent).To(BeFalse())
+			Expect(status.ImageId).To(Equal("sha256:old"))
+			Expect(status.LatestImageId).To(Equal("sha256:new"))
+			Expect(status.ImageCreated.UTC().Format("2006-01-02T15")).To(Equal("2026-10-15T08"))
+			Expect(status.RestartCount).To(Equal(2))
+			Expect(status.Ports).To(Equal([]string{"80:80/tcp"}))
+			Expect(status.EnvDrift).To(Equal([]string{"DISCOURSE_HOSTNAME"}))
+			Expect(out.String()).ToNot(ContainSubstring("old.example.com"))
+		})
+
+		It("reports a table", func() {
+			runner := ddocker.StatusCmd{Configs: []string{"test"}, Format: "table"}
+			Expect(runner.Run(cli, ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("CONFIG"))
+			Expect(out.String()).To(MatchRegexp(`test\s+Up 2 hours\s+outdated`))
+			Expect(out.String()).To(ContainSubstring("drift: DISCOURSE_HOSTNAME"))
+		})
+	})
+})
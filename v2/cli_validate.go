@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * validate
+ */
+type ValidateCmd struct {
+	Configs []string `arg:"" optional:"" name:"config" help:"configs to validate." predictor:"config"`
+	All     bool     `name:"all" help:"Validate all configs in the conf dir."`
+	Strict  bool     `name:"strict" help:"Fail on warnings too."`
+}
+
+func (r *ValidateCmd) Run(cli *Cli, ctx context.Context) error {
+	names := r.Configs
+	if r.All {
+		names = utils.ConfigNames(cli.ConfDir)
+	}
+	if len(names) == 0 {
+		return errors.New("pass a config to validate, or --all")
+	}
+
+	errorCount, warningCount := 0, 0
+	validated := map[string]*config.Config{}
+	problems := map[string][]config.Problem{}
+	for _, name := range names {
+		validated[name], problems[name] = config.Validate(cli.ConfDir, name, cli.TemplatesDir, cli.Profile...)
+	}
+	for _, name := range names {
+		if validated[name] != nil {
+			problems[name] = append(problems[name], r.portProblems(cli, name, validated)...)
+		}
+		slices.SortStableFunc(problems[name], func(a, b config.Problem) int {
+			return cmp.Or(strings.Compare(a.File, b.File), a.Line-b.Line)
+		})
+		for _, p := range problems[name] {
+			if p.Warning {
+				warningCount++
+			} else {
+				errorCount++
+			}
+			fmt.Fprintln(utils.Out, p.String()) //nolint:errcheck
+		}
+	}
+
+	summary := fmt.Sprintf("%d errors, %d warnings", errorCount, warningCount)
+	fmt.Fprintln(utils.Out, summary) //nolint:errcheck
+	if errorCount > 0 || (r.Strict && warningCount > 0) {
+		return utils.NewExitStatusError(1, summary)
+	}
+	return nil
+}
+
+// Host ports the config publishes that another config in the conf dir publishes too, so the
+// two can't run at the same time.
+func (r *ValidateCmd) portProblems(cli *Cli, name string, validated map[string]*config.Config) []config.Problem {
+	conf := validated[name]
+	problems := []config.Problem{}
+	ports := conf.PublishedPorts()
+	for _, other := range utils.ConfigNames(cli.ConfDir) {
+		if other == name {
+			continue
+		}
+		otherConf, ok := validated[other]
+		if !ok {
+			// configs that don't load are reported when they are validated
+			otherConf, _ = config.LoadConfig(cli.ConfDir, other, true, cli.TemplatesDir, cli.Profile...)
+			validated[other] = otherConf
+		}
+		if otherConf == nil {
+			continue
+		}
+		for _, port := range ports {
+			for _, otherPort := range otherConf.PublishedPorts() {
+				if port.Conflicts(otherPort) {
+					problems = append(problems, config.Problem{
+						File:    port.Source.File,
+						Line:    port.Source.Line,
+						Message: "host port " + strconv.Itoa(port.Port) + " is also published by " + other + " at " + otherPort.Source.String(),
+						Warning: true,
+					})
+					break
+				}
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,85 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	ddocker "github.com/discourse/launcher/v2"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Validate", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	var writeConfig = func(name string, content string) {
+		os.WriteFile(filepath.Join(testDir, name), []byte(content), 0644) //nolint:errcheck
+	}
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		os.MkdirAll(filepath.Join(testDir, "containers"), 0755) //nolint:errcheck
+		os.MkdirAll(filepath.Join(testDir, "templates"), 0755)  //nolint:errcheck
+		writeConfig("templates/web.yml", "base_image: discourse/base:release\n")
+		writeConfig("containers/app.yml", "templates:\n  - templates/web.yml\nexpose:\n  - \"80:80\"\n")
+		writeConfig("containers/other.yml", "templates:\n  - templates/web.yml\nexpose:\n  - \"127.0.0.1:80:80\"\n")
+		cli = &ddocker.Cli{
+			ConfDir:      filepath.Join(testDir, "containers"),
+			TemplatesDir: testDir,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir) //nolint:errcheck
+	})
+
+	It("warns about host ports other configs publish", func() {
+		runner := ddocker.ValidateCmd{Configs: []string{"app"}}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(filepath.Join(testDir, "containers", "app.yml") +
+			":4: warning: host port 80 is also published by other at " + filepath.Join(testDir, "containers", "other.yml") + ":4"))
+		Expect(out.String()).To(HaveSuffix("0 errors, 1 warnings\n"))
+
+		runner = ddocker.ValidateCmd{Configs: []string{"app"}, Strict: true}
+		var statusErr *utils.ExitStatusError
+		Expect(errors.As(runner.Run(cli, ctx), &statusErr)).To(BeTrue())
+	})
+
+	It("compares host ports with the selected profiles loaded", func() {
+		writeConfig("containers/app.staging.yml", "expose:\n  - \"8080:8080\"\n")
+		writeConfig("containers/other.staging.yml", "expose:\n  - \"8080:80\"\n")
+		runner := ddocker.ValidateCmd{Configs: []string{"app"}}
+		cli.Profile = []string{"staging"}
+		Expect(runner.Run(cli, ctx)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(filepath.Join(testDir, "containers", "app.staging.yml") +
+			":2: warning: host port 8080 is also published by other at " + filepath.Join(testDir, "containers", "other.staging.yml") + ":2"))
+		Expect(out.String()).To(HaveSuffix("0 errors, 2 warnings\n"))
+	})
+
+	It("exits 1 when any config has errors", func() {
+		writeConfig("containers/broken.yml", "templates:\n  - templates/missing.yml\n")
+		runner := ddocker.ValidateCmd{All: true}
+		err := runner.Run(cli, ctx)
+		var statusErr *utils.ExitStatusError
+		Expect(errors.As(err, &statusErr)).To(BeTrue())
+		Expect(statusErr.Status).To(Equal(1))
+		Expect(out.String()).To(ContainSubstring("broken.yml:2: template templates/missing.yml is not in "))
+		Expect(out.String()).To(HaveSuffix("1 errors, 2 warnings\n"))
+	})
+
+	It("needs a config or --all", func() {
+		runner := ddocker.ValidateCmd{}
+		Expect(runner.Run(cli, ctx)).To(MatchError("pass a config to validate, or --all"))
+	})
+})
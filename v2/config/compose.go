@@ -0,0 +1,151 @@
+package config
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/discourse/launcher/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+type composeBuild struct {
+	Context    string            `yaml:"context"`
+	Dockerfile string            `yaml:"dockerfile"`
+	ShmSize    string            `yaml:"shm_size"`
+	Args       map[string]string `yaml:"args,omitempty"`
+}
+
+type composeService struct {
+	Image         string            `yaml:"image"`
+	Build         *composeBuild     `yaml:"build,omitempty"`
+	ContainerName string            `yaml:"container_name"`
+	Hostname      string            `yaml:"hostname,omitempty"`
+	Command       []string          `yaml:"command,omitempty"`
+	Restart       string            `yaml:"restart"`
+	StdinOpen     bool              `yaml:"stdin_open"`
+	ShmSize       string            `yaml:"shm_size"`
+	Environment   map[string]string `yaml:"environment,omitempty"`
+	EnvFile       []string          `yaml:"env_file,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty"`
+	Ports         []string          `yaml:"ports,omitempty"`
+	Expose        []string          `yaml:"expose,omitempty"`
+	Volumes       []string          `yaml:"volumes,omitempty"`
+	ExternalLinks []string          `yaml:"external_links,omitempty"`
+}
+
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+// Escape compose variable interpolation, values are passed through literally.
+func composeEscape(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+// Generates a docker-compose.yml equivalent to running the container with launcher.
+// Known secrets are left out of the compose file, and are expected in envFile
+// when it is not empty. The build context is expected to contain dockerfile and
+// the pups config written by WriteYamlConfig.
+func (config *Config) DockerCompose(hostname string, dockerfile string, envFile string) (string, error) {
+	service := composeService{
+		ContainerName: config.Name,
+		Hostname:      composeEscape(hostname),
+		Restart:       "always",
+		StdinOpen:     true,
+		ShmSize:       "512m",
+		Environment:   map[string]string{},
+		Labels:        map[string]string{},
+	}
+
+	if len(config.RunImage) > 0 {
+		service.Image = config.RunImage
+	} else {
+		service.Image = utils.DefaultNamespace + "/" + config.Name
+		service.Build = &composeBuild{
+			Context:    ".",
+			Dockerfile: dockerfile,
+			ShmSize:    "512m",
+			Args:       map[string]string{},
+		}
+	}
+
+	if bootCmd := config.GetBootCommand(); bootCmd != "" {
+		service.Command = []string{composeEscape(bootCmd)}
+	}
+
+	for k, v := range config.Env {
+		if config.IsSecret(k) {
+			continue
+		}
+		service.Environment[k] = composeEscape(v)
+		if service.Build != nil {
+			service.Build.Args[k] = composeEscape(v)
+		}
+	}
+
+	if envFile != "" {
+		service.EnvFile = []string{envFile}
+	}
+
+	for k, v := range config.Labels {
+		service.Labels[k] = composeEscape(v)
+	}
+
+	for _, v := range config.Expose {
+		if strings.Contains(v, ":") {
+			service.Ports = append(service.Ports, v)
+		} else {
+			service.Expose = append(service.Expose, v)
+		}
+	}
+
+	for _, v := range config.Volumes {
+		service.Volumes = append(service.Volumes, v.Volume.Host+":"+v.Volume.Guest)
+	}
+
+	// linked containers are managed outside of this compose project
+	for _, v := range config.Links {
+		service.ExternalLinks = append(service.ExternalLinks, v.Link.Name+":"+v.Link.Alias)
+	}
+
+	compose := composeFile{Services: map[string]composeService{config.Name: service}}
+	out, err := yaml.Marshal(compose)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Generates a compose env_file containing only known secrets, so the generated
+// compose file may be committed without them.
+func (config *Config) ComposeEnvFile() string {
+	keys := []string{}
+	for k := range config.Env {
+		if config.IsSecret(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	builder := strings.Builder{}
+	for _, k := range keys {
+		if config.SecretPending(k) {
+			// files and commands are left to whoever runs the project
+			builder.WriteString("# " + k + " is set from a secret source in the launcher config, set it here\n")
+			builder.WriteString(k + "=\n")
+			continue
+		}
+		builder.WriteString(k + "=" + envFileQuote(config.Env[k]) + "\n")
+	}
+	return builder.String()
+}
+
+// Single quoted values are taken literally by compose. Fall back to double
+// quotes with escapes when the value itself contains a single quote.
+func envFileQuote(value string) string {
+	if !strings.Contains(value, "'") {
+		return "'" + value + "'"
+	}
+	replacer := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "$", "\\$", "\n", "\\n")
+	return "\"" + replacer.Replace(value) + "\""
+}
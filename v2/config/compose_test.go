@@ -0,0 +1,57 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/launcher/v2/config"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Compose", func() {
+	var conf *config.Config
+	BeforeEach(func() {
+		conf, _ = config.LoadConfig("../test/containers", "test", true, "../test")
+	})
+
+	It("generates a compose service from config", func() {
+		compose, err := conf.DockerCompose("test-host", "Dockerfile", "secrets.env")
+		Expect(err).To(BeNil())
+
+		parsed := map[string]map[string]map[string]any{}
+		Expect(yaml.Unmarshal([]byte(compose), &parsed)).To(Succeed())
+		service := parsed["services"]["test"]
+		Expect(service["image"]).To(Equal("local_discourse/test"))
+		Expect(service["hostname"]).To(Equal("test-host"))
+		Expect(service["command"]).To(Equal([]any{"/sbin/boot"}))
+		Expect(service["ports"]).To(Equal([]any{"80:80", "443:443"}))
+		Expect(service["expose"]).To(Equal([]any{"90"}))
+		Expect(service["volumes"]).To(ContainElement("/var/discourse/shared/web-only:/shared"))
+		Expect(service["external_links"]).To(Equal([]any{"data:data"}))
+		Expect(service["env_file"]).To(Equal([]any{"secrets.env"}))
+		Expect(service["environment"]).To(HaveKeyWithValue("REPLACED", "test/test/test"))
+		Expect(service["build"]).To(HaveKeyWithValue("dockerfile", "Dockerfile"))
+	})
+
+	It("keeps known secrets out of the compose file", func() {
+		compose, err := conf.DockerCompose("test-host", "Dockerfile", "secrets.env")
+		Expect(err).To(BeNil())
+		Expect(compose).ToNot(ContainSubstring("SOME_SECRET"))
+		Expect(compose).ToNot(ContainSubstring("DISCOURSE_DB_PASSWORD"))
+	})
+
+	It("escapes compose interpolation in values", func() {
+		conf.Env["NOT_A_SECRET"] = "pa$$word"
+		compose, err := conf.DockerCompose("test-host", "Dockerfile", "")
+		Expect(err).To(BeNil())
+		Expect(compose).To(ContainSubstring("NOT_A_SECRET: pa$$$$word"))
+		Expect(compose).ToNot(ContainSubstring("env_file"))
+	})
+
+	It("writes known secrets to an env file", func() {
+		envFile := conf.ComposeEnvFile()
+		Expect(envFile).To(ContainSubstring("DISCOURSE_DB_PASSWORD='SOME_SECRET'\n"))
+		Expect(envFile).To(ContainSubstring("DISCOURSE_SMTP_PASSWORD='pa$$word'\n"))
+		Expect(envFile).ToNot(ContainSubstring("LANG="))
+	})
+})
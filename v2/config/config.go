@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -8,8 +10,8 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
-	"dario.cat/mergo"
 	"github.com/discourse/launcher/v2/utils"
 
 	"gopkg.in/yaml.v3"
@@ -17,6 +19,20 @@ import (
 
 const defaultBootCommand = "/sbin/boot"
 
+const defaultHealthCheckTimeout = 10 * time.Minute
+
+const noBaseImageMessage = "no base image specified in config, set base image with `base_image: {imagename}`"
+
+// Separates the yaml documents pups reads: templates, the config, then the env with {{config}} replaced.
+const FileSeparator = "_FILE_SEPERATOR_"
+
+// Image label holding the config's BuildHash.
+const BuildHashLabel = "org.discourse.launcher.build-hash"
+
+// Build arg the pups step of the Dockerfile reads, so cached builds of it are only reused
+// for the same key.
+const CacheKeyArg = "launcher_cache_key"
+
 var defaultBakeEnv = []string{
 	"RAILS_ENV",
 	"UNICORN_WORKERS",
@@ -39,52 +55,198 @@ type VolumeObject struct {
 	Volume Volume `yaml:"volume"`
 }
 
+type Link struct {
+	Name  string `yaml:"name"`
+	Alias string `yaml:"alias"`
+}
+
+type LinkObject struct {
+	Link Link `yaml:"link"`
+}
+
+// How start --wait and rebuild tell a container is up. Without a command, GETs path on the
+// host port published for port, or from inside the container when it isn't published.
+type HealthCheck struct {
+	Path string `yaml:"path,omitempty"`
+	Port string `yaml:"port,omitempty"`
+	// Run with sh -c in the container instead, healthy when it exits 0
+	Command string `yaml:"command,omitempty"`
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// Settings for rebuild --blue-green, which starts the new container next to the old one.
+type BlueGreen struct {
+	// Published ports for every other deploy, as the old container holds the ports in expose
+	Expose []string `yaml:"expose,omitempty"`
+}
+
 type Config struct {
-	Name          string `yaml:"-"`
-	rawYaml       []string
-	BaseImage     string            `yaml:"base_image,omitempty"`
-	BaseImageSlim string            `yaml:"base_image_slim,omitempty"`
-	UpdatePups    bool              `yaml:"update_pups,omitempty"`
-	RunImage      string            `yaml:"run_image,omitempty"`
-	BootCommand   string            `yaml:"boot_command,omitempty"`
-	NoBootCommand bool              `yaml:"no_boot_command,omitempty"`
-	DockerArgs    string            `yaml:"docker_args,omitempty"`
-	Templates     []string          `yaml:"templates,omitempty"`
-	Expose        []string          `yaml:"expose,omitempty"`
-	Env           map[string]string `yaml:"env,omitempty"`
-	Labels        map[string]string `yaml:"labels,omitempty"`
-	Volumes       []VolumeObject    `yaml:"volumes,omitempty"`
-	Links         []struct {
-		Link struct {
-			Name  string `yaml:"name"`
-			Alias string `yaml:"alias"`
-		} `yaml:"link"`
-	} `yaml:"links,omitempty"`
+	Name string `yaml:"-"`
+	// profile overlays merged over the config, in order
+	Profiles []string `yaml:"-"`
+	rawYaml  []string
+	// env keys set from secret sources
+	sourcedSecrets []string
+	// secret files and commands not read or run yet, by env key
+	pendingSecrets map[string]secretRef
+	// where values were set, by key
+	sources map[string]*ValueSource
+	// variables for ${VAR} interpolation
+	vars varLookup
+	// files merged into the config, in order, for rawYaml
+	files []string
+	// the files that are templates
+	templateFiles []string
+	// templates the config or its profiles delete, which are never merged
+	deletedTemplates []string
+	BaseImage        string            `yaml:"base_image,omitempty"`
+	BaseImageSlim    string            `yaml:"base_image_slim,omitempty"`
+	UpdatePups       bool              `yaml:"update_pups,omitempty"`
+	RunImage         string            `yaml:"run_image,omitempty"`
+	BootCommand      string            `yaml:"boot_command,omitempty"`
+	NoBootCommand    bool              `yaml:"no_boot_command,omitempty"`
+	DockerArgs       string            `yaml:"docker_args,omitempty"`
+	Templates        []string          `yaml:"templates,omitempty"`
+	Expose           []string          `yaml:"expose,omitempty"`
+	Env              map[string]string `yaml:"env,omitempty"`
+	Labels           map[string]string `yaml:"labels,omitempty"`
+	Volumes          []VolumeObject    `yaml:"volumes,omitempty"`
+	HealthCheck      HealthCheck       `yaml:"health_check,omitempty"`
+	BlueGreen        BlueGreen         `yaml:"blue_green,omitempty"`
+	Links            []LinkObject      `yaml:"links,omitempty"`
 }
 
-func (config *Config) loadTemplate(templateDir string, template string) error {
-	template_filename := filepath.Join(templateDir, template)
-	content, err := os.ReadFile(template_filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("template file does not exist: " + template_filename)
+// Finds a template in a search path of directories, separated like PATH, the first
+// directory holding it wins. Empty when no directory holds it.
+func findTemplate(templatesDir string, template string) string {
+	dirs := filepath.SplitList(templatesDir)
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		filename := filepath.Join(dir, template)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
 		}
-		return err
 	}
-	templateConfig := &Config{}
-	if err := yaml.Unmarshal(content, templateConfig); err != nil {
-		return err
+	return ""
+}
+
+func missingTemplate(templatesDir string, template string) string {
+	return "template " + template + " is not in " + templatesDir
+}
+
+// Merges a template into the config, after the templates it includes. Templates are merged
+// once, where they are first included, and not at all when the config or a profile deletes
+// them. loading holds the templates including this one.
+func (config *Config) loadTemplate(templatesDir string, template string, includedBy string, loading []string) error {
+	if slices.Contains(config.deletedTemplates, template) {
+		return nil
 	}
-	if err := mergo.Merge(config, templateConfig, mergo.WithOverride); err != nil {
+	template_filename := findTemplate(templatesDir, template)
+	if template_filename == "" {
+		return fmt.Errorf("%s: %s: %w", includedBy, missingTemplate(templatesDir, template), os.ErrNotExist)
+	}
+	if slices.Contains(loading, template_filename) {
+		return errors.New("template cycle: " + strings.Join(append(loading, template_filename), " -> "))
+	}
+	if slices.Contains(config.files, template_filename) {
+		return nil
+	}
+	file, err := readConfigFile(template_filename, config.vars)
+	if err != nil {
 		return err
 	}
-	config.rawYaml = append(config.rawYaml, string(content[:]))
+	for _, d := range file.deletions {
+		if d.key == "templates" {
+			// templates it would delete may already be merged
+			return fmt.Errorf("%s:%d: %s deletes templates in configs and profiles, not in templates", template_filename, d.line, deleteTag)
+		}
+	}
+	loading = slices.Concat(loading, []string{template_filename})
+	for _, t := range file.templates {
+		if err := config.loadTemplate(templatesDir, t, template_filename, loading); err != nil {
+			return err
+		}
+	}
+	config.templateFiles = append(config.templateFiles, template_filename)
+	return config.merge(file)
+}
+
+// Reads the files of a config or a profile, and the templates they delete.
+func (config *Config) readFiles(dir string, name string) ([]*configFile, error) {
+	filenames, err := utils.ConfigFiles(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	files := []*configFile{}
+	for _, filename := range filenames {
+		file, err := readConfigFile(filename, config.vars)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range file.deletions {
+			if d.key != "templates" {
+				continue
+			}
+			template := ""
+			if err := d.item.Decode(&template); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", filename, d.line, err)
+			}
+			config.deletedTemplates = append(config.deletedTemplates, template)
+		}
+		// a later file may include a deleted template again
+		config.deletedTemplates = slices.DeleteFunc(config.deletedTemplates, func(t string) bool {
+			return slices.Contains(file.templates, t)
+		})
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Merges the files of a config, or of a profile when profile is set, after the templates
+// they include.
+func (config *Config) loadFiles(files []*configFile, templatesDir string, includeTemplates bool, profile bool) error {
+	if includeTemplates {
+		for _, file := range files {
+			for _, t := range file.templates {
+				if err := config.loadTemplate(templatesDir, t, file.filename, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	merge := config.merge
+	if profile {
+		merge = config.mergeProfile
+	}
+	for _, file := range files {
+		if err := merge(file); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func LoadConfig(dir string, configName string, includeTemplates bool, templatesDir string) (*Config, error) {
+// Loads a config over its templates, then the overlays of any profiles over it. Configs are
+// containers/{config}.yml, .yaml, or a containers/{config}/ directory of files.
+func LoadConfig(dir string, configName string, includeTemplates bool, templatesDir string, profiles ...string) (*Config, error) {
+	config, err := loadConfig(dir, configName, includeTemplates, templatesDir, profiles...)
+	if err != nil {
+		return nil, err
+	}
+	if config.BaseImage == "" {
+		return nil, errors.New(noBaseImageMessage)
+	}
+	return config, nil
+}
+
+// Loads a config without checking it has a base image.
+func loadConfig(dir string, configName string, includeTemplates bool, templatesDir string, profiles ...string) (*Config, error) {
 	config := &Config{
 		Name:        configName,
+		Profiles:    profiles,
 		BootCommand: defaultBootCommand,
 	}
 
@@ -95,61 +257,57 @@ func LoadConfig(dir string, configName string, includeTemplates bool, templatesD
 		return nil, errors.New(msg)
 	}
 
-	config_filename := filepath.Join(dir, config.Name+".yml")
-	content, err := os.ReadFile(config_filename)
-
+	fileVars, err := readEnvFiles(dir, config.Name, profiles)
 	if err != nil {
 		return nil, err
 	}
+	config.vars = newVarLookup(fileVars)
 
-	baseConfig := &Config{}
-
-	if err := yaml.Unmarshal(content, baseConfig); err != nil {
+	files, err := config.readFiles(dir, config.Name)
+	if err != nil {
 		return nil, err
 	}
-
-	if includeTemplates {
-		for _, t := range baseConfig.Templates {
-			if err := config.loadTemplate(templatesDir, t); err != nil {
-				return nil, err
-			}
-		}
-	}
-
-	if err := mergo.Merge(config, baseConfig, mergo.WithOverride); err != nil {
+	// profiles are read before any template is merged, as they may delete templates
+	profileFiles, err := config.readProfiles(dir, profiles)
+	if err != nil {
 		return nil, err
 	}
 
-	config.rawYaml = append(config.rawYaml, string(content[:]))
-
-	if err != nil {
+	if err := config.loadFiles(files, templatesDir, includeTemplates, false); err != nil {
 		return nil, err
 	}
+	for i, profile := range profiles {
+		if err := config.loadFiles(profileFiles[i], templatesDir, includeTemplates, true); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile, err)
+		}
+	}
 
 	for k, v := range config.Labels {
 		val := strings.ReplaceAll(v, "{{config}}", config.Name)
 		config.Labels[k] = val
 	}
 
+	publicEnv := map[string]string{}
 	for k, v := range config.Env {
+		if config.HasSecretSource(k) {
+			continue
+		}
 		val := strings.ReplaceAll(v, "{{config}}", config.Name)
 		config.Env[k] = val
+		publicEnv[k] = val
 	}
 
 	// Append env to final raw yaml to replace {{config}} entries
 	// This allows pups to also get the properly replaced {{config}} values
 	// as pups does not do any replacement on its own.
 	// Appending env ensures last write wins.
-	envStr, err := yaml.Marshal(Config{Env: config.Env})
+	// Secrets from secret sources are left out, pups reads them from the container env.
+	envStr, err := yaml.Marshal(Config{Env: publicEnv})
 	if err != nil {
 		return nil, err
 	}
 	config.rawYaml = append(config.rawYaml, string(envStr))
 
-	if config.BaseImage == "" {
-		return nil, errors.New("no base image specified in config, set base image with `base_image: {imagename}`")
-	}
-
 	if config.BaseImageSlim == "" {
 		config.BaseImageSlim = config.BaseImage
 	}
@@ -170,13 +328,19 @@ func (config *Config) ValidateConfig(parentError error) error {
 }
 
 func (config *Config) Yaml() string {
-	return strings.Join(config.rawYaml, "_FILE_SEPERATOR_")
+	return strings.Join(config.rawYaml, FileSeparator)
 }
 
-func (config *Config) Dockerfile(bakeEnv bool, buildSlim bool, configFile string) string {
+// Without buildMounts the config is expected to be mounted at /temp-config.yaml by the builder,
+// for builders that don't understand RUN --mount.
+func (config *Config) Dockerfile(bakeEnv bool, buildSlim bool, buildMounts bool, configFile string) string {
 	if configFile == "" {
 		configFile = "config.yaml"
 	}
+	runWithConfig := "RUN "
+	if buildMounts {
+		runWithConfig = "RUN --mount=type=bind,source=" + configFile + ",target=/temp-config.yaml "
+	}
 	builder := strings.Builder{}
 	builder.WriteString("ARG dockerfile_from_image=" + config.BaseImage + "\n")
 	builder.WriteString("ARG dockerfile_from_image_slim=" + config.BaseImageSlim + "\n")
@@ -188,7 +352,8 @@ func (config *Config) Dockerfile(bakeEnv bool, buildSlim bool, configFile string
 		builder.WriteString(config.dockerfileDefaultEnvs() + "\n")
 	}
 	builder.WriteString(config.dockerfileExpose() + "\n")
-	builder.WriteString("RUN --mount=type=bind,source=" + configFile + ",target=/temp-config.yaml ")
+	builder.WriteString("ARG " + CacheKeyArg + "\n")
+	builder.WriteString(runWithConfig)
 	builder.WriteString(
 		"cat /temp-config.yaml | /usr/local/bin/pups --skip-tags=precompile,migrate,db --stdin\n")
 	builder.WriteString("CMD [\"" + config.GetBootCommand() + "\"]\n")
@@ -227,15 +392,57 @@ func (config *Config) Dockerfile(bakeEnv bool, buildSlim bool, configFile string
 		builder.WriteString("COPY --chown=discourse:discourse --from=discourse-builder /var/www/discourse/frontend/discourse/node_modules/@highlightjs/cdn-assets/ /var/www/discourse/frontend/discourse/node_modules/@highlightjs/cdn-assets/\n")
 		builder.WriteString("COPY --chown=discourse:discourse --from=discourse-builder /var/www/discourse/node_modules/@discourse/moment-timezone-names-translations/locales /var/www/discourse/node_modules/@discourse/moment-timezone-names-translations/locales\n")
 		builder.WriteString("COPY --chown=discourse:discourse --from=discourse-builder /var/www/discourse/frontend/discourse/node_modules/moment/locale /var/www/discourse/frontend/discourse/node_modules/moment/locale\n")
-		builder.WriteString("RUN --mount=type=bind,source=" + configFile + ",target=/temp-config.yaml ")
+		builder.WriteString(runWithConfig)
 		builder.WriteString(
 			"cat /temp-config.yaml | /usr/local/bin/pups --skip-tags=build,precompile,migrate,db --stdin\n")
 		builder.WriteString("CMD [\"" + config.GetBootCommand() + "\"]\n")
 	}
 
+	builder.WriteString("LABEL " + BuildHashLabel + "=\"" + config.BuildHash() + "\"\n")
+
 	return builder.String()
 }
 
+// Config keys applied when a container is created, rather than baked in by pups.
+var runtimeKeys = []string{"env", "labels", "volumes", "expose", "links", "docker_args", "run_image", "health_check", "blue_green"}
+
+// Hash of the config that goes into building an image, such as templates, params, and pups
+// run and hooks, but not container settings like env or volumes. Built images are labeled with it,
+// so a config that needs a rebuild can be told apart from one that only needs a new container.
+func (config *Config) BuildHash() string {
+	hash := sha256.New()
+	for _, content := range config.rawYaml {
+		doc := map[string]any{}
+		if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+			hash.Write([]byte(content)) //nolint:errcheck
+			continue
+		}
+		for _, k := range runtimeKeys {
+			delete(doc, k)
+		}
+		// yaml sorts map keys, so equal docs marshal the same
+		normalized, _ := yaml.Marshal(doc)
+		hash.Write(normalized) //nolint:errcheck
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// Hashes of the files merged into the config as pups reads them: one of the config's own files
+// and profiles together, and one for each template, by filename.
+func (config *Config) FileHashes() (string, map[string]string) {
+	configHash := sha256.New()
+	templates := map[string]string{}
+	for i, filename := range config.files {
+		if slices.Contains(config.templateFiles, filename) {
+			sum := sha256.Sum256([]byte(config.rawYaml[i]))
+			templates[filename] = hex.EncodeToString(sum[:])[:16]
+			continue
+		}
+		configHash.Write([]byte(config.rawYaml[i])) //nolint:errcheck
+	}
+	return hex.EncodeToString(configHash.Sum(nil))[:16], templates
+}
+
 func (config *Config) WriteYamlConfig(dir string, configFile string) error {
 	if configFile == "" {
 		configFile = "config.yaml"
@@ -247,6 +454,19 @@ func (config *Config) WriteYamlConfig(dir string, configFile string) error {
 	return nil
 }
 
+// Whether the site's database runs outside its container, so it can be migrated while the site runs.
+func (config *Config) ExternalDb() (bool, error) {
+	socket, err := config.EnvValue("DISCOURSE_DB_SOCKET")
+	if err != nil {
+		return false, err
+	}
+	host, err := config.EnvValue("DISCOURSE_DB_HOST")
+	if err != nil {
+		return false, err
+	}
+	return socket == "" && host != "", nil
+}
+
 func (config *Config) GetBootCommand() string {
 	if len(config.BootCommand) > 0 {
 		return config.BootCommand
@@ -257,16 +477,20 @@ func (config *Config) GetBootCommand() string {
 	}
 }
 
-func (config *Config) GetEnvSlice(includeKnownSecrets bool) []string {
+func (config *Config) GetEnvSlice(includeKnownSecrets bool) ([]string, error) {
 	envs := []string{}
-	for k, v := range config.Env {
-		if !includeKnownSecrets && slices.Contains(utils.KnownSecrets, k) {
+	for k := range config.Env {
+		if !includeKnownSecrets && config.IsSecret(k) {
 			continue
 		}
+		v, err := config.EnvValue(k)
+		if err != nil {
+			return nil, err
+		}
 		envs = append(envs, k+"="+v)
 	}
 	slices.Sort(envs)
-	return envs
+	return envs, nil
 }
 
 func (config *Config) GetDockerArgs() []string {
@@ -276,7 +500,7 @@ func (config *Config) GetDockerArgs() []string {
 func (config *Config) dockerfileEnvs() string {
 	builder := []string{}
 	for k := range config.Env {
-		if !slices.Contains(utils.KnownSecrets, k) {
+		if !config.IsSecret(k) {
 			builder = append(builder, k+"=${"+k+"}")
 		}
 	}
@@ -304,7 +528,7 @@ func (config *Config) dockerfileDefaultEnvs() string {
 func (config *Config) dockerfileArgs() string {
 	builder := []string{}
 	for k := range config.Env {
-		if !slices.Contains(utils.KnownSecrets, k) {
+		if !config.IsSecret(k) {
 			builder = append(builder, "ARG "+k)
 		}
 	}
@@ -325,13 +549,28 @@ func (config *Config) dockerfileExpose() string {
 	return strings.Join(builder, "\n")
 }
 
-func (config *Config) GetDockerHostname(defaultHostname string) string {
+// How long to wait for the health check to pass, 10 minutes unless the config sets a duration like "20m".
+func (config *Config) GetHealthCheckTimeout() (time.Duration, error) {
+	if config.HealthCheck.Timeout == "" {
+		return defaultHealthCheckTimeout, nil
+	}
+	timeout, err := time.ParseDuration(config.HealthCheck.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("health_check timeout: %w", err)
+	}
+	return timeout, nil
+}
+
+func (config *Config) GetDockerHostname(defaultHostname string) (string, error) {
 	_, exists := config.Env["DOCKER_USE_HOSTNAME"]
 	re := regexp.MustCompile(`[^a-zA-Z-]`)
 	hostname := defaultHostname
 	if exists {
-		hostname = config.Env["DISCOURSE_HOSTNAME"]
+		var err error
+		if hostname, err = config.EnvValue("DISCOURSE_HOSTNAME"); err != nil {
+			return "", err
+		}
 	}
 	hostname = string(re.ReplaceAll([]byte(hostname), []byte("-"))[:])
-	return hostname
+	return hostname, nil
 }
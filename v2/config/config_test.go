@@ -6,6 +6,7 @@ import (
 
 	"errors"
 	"os"
+	"time"
 
 	"github.com/discourse/launcher/v2/config"
 )
@@ -46,7 +47,7 @@ var _ = Describe("Config", func() {
 	})
 
 	It("can convert pups config to dockerfile format and bake in default env", func() {
-		dockerfile := conf.Dockerfile(false, false, "config.yaml")
+		dockerfile := conf.Dockerfile(false, false, true, "config.yaml")
 		Expect(dockerfile).To(ContainSubstring(`FROM ${dockerfile_from_image} AS discourse-full
 ARG LANG
 ARG LANGUAGE
@@ -68,6 +69,7 @@ ENV RAILS_ENV=${RAILS_ENV} \
 EXPOSE 443
 EXPOSE 80
 EXPOSE 90
+ARG launcher_cache_key
 RUN --mount=type=bind,source=config.yaml,target=/temp-config.yaml cat /temp-config.yaml | /usr/local/bin/pups --skip-tags=precompile,migrate,db --stdin
 CMD ["/sbin/boot"]`))
 
@@ -76,7 +78,7 @@ CMD ["/sbin/boot"]`))
 	})
 
 	It("can generate a dockerfile with all env baked into the image", func() {
-		dockerfile := conf.Dockerfile(true, false, "config.yaml")
+		dockerfile := conf.Dockerfile(true, false, true, "config.yaml")
 		Expect(dockerfile).To(ContainSubstring(`FROM ${dockerfile_from_image} AS discourse-full
 ARG LANG
 ARG LANGUAGE
@@ -103,6 +105,7 @@ ENV LANG=${LANG} \
 EXPOSE 443
 EXPOSE 80
 EXPOSE 90
+ARG launcher_cache_key
 RUN --mount=type=bind,source=config.yaml,target=/temp-config.yaml cat /temp-config.yaml | /usr/local/bin/pups --skip-tags=precompile,migrate,db --stdin
 CMD ["/sbin/boot"]`))
 		Expect(dockerfile).ToNot(ContainSubstring(`discourse-builder`))
@@ -110,7 +113,7 @@ CMD ["/sbin/boot"]`))
 	})
 
 	It("can generate configuration for a slim image from a multistage build", func() {
-		dockerfile := conf.Dockerfile(false, true, "config.yaml")
+		dockerfile := conf.Dockerfile(false, true, true, "config.yaml")
 		Expect(dockerfile).To(ContainSubstring(`FROM ${dockerfile_from_image} AS discourse-full
 ARG LANG
 ARG LANGUAGE
@@ -132,6 +135,7 @@ ENV RAILS_ENV=${RAILS_ENV} \
 EXPOSE 443
 EXPOSE 80
 EXPOSE 90
+ARG launcher_cache_key
 RUN --mount=type=bind,source=config.yaml,target=/temp-config.yaml cat /temp-config.yaml | /usr/local/bin/pups --skip-tags=precompile,migrate,db --stdin
 CMD ["/sbin/boot"]
 
@@ -191,12 +195,40 @@ COPY --chown=discourse:discourse --from=discourse-builder --exclude=.git --exclu
 		})
 	})
 
+	It("defaults the health check timeout", func() {
+		config := config.Config{}
+		Expect(config.GetHealthCheckTimeout()).To(Equal(10 * time.Minute))
+		config.HealthCheck.Timeout = "20m"
+		Expect(config.GetHealthCheckTimeout()).To(Equal(20 * time.Minute))
+		config.HealthCheck.Timeout = "20"
+		_, err := config.GetHealthCheckTimeout()
+		Expect(err).To(MatchError(ContainSubstring("health_check timeout")))
+	})
+
 	It("should error if no base config LoadConfig to load yaml configuration", func() {
 		_, err := config.LoadConfig("../test/containers", "test-no-base-image", true, "../test")
 		Expect(err).ToNot(BeNil())
 		Expect(err.Error()).To(Equal("no base image specified in config, set base image with `base_image: {imagename}`"))
 	})
 
+	It("loads .yaml configs and config directories", func() {
+		os.WriteFile(testDir+"/yaml.yaml", []byte("base_image: discourse/base:yaml\n"), 0644) //nolint:errcheck
+		conf, err := config.LoadConfig(testDir, "yaml", true, "../test")
+		Expect(err).To(BeNil())
+		Expect(conf.BaseImage).To(Equal("discourse/base:yaml"))
+
+		os.MkdirAll(testDir+"/split", 0755)                                                                                        //nolint:errcheck
+		os.WriteFile(testDir+"/split/split.yml", []byte("templates:\n  - templates/web.template.yml\nenv:\n  FROM: main\n"), 0644) //nolint:errcheck
+		os.WriteFile(testDir+"/split/10-env.yml", []byte("env:\n  FROM: env\n  ENV_ONLY: 'yes'\n"), 0644)                          //nolint:errcheck
+		os.WriteFile(testDir+"/split/20-override.yml", []byte("env:\n  FROM: override\n"), 0644)                                   //nolint:errcheck
+		conf, err = config.LoadConfig(testDir, "split", true, "../test")
+		Expect(err).To(BeNil())
+		Expect(conf.Env["FROM"]).To(Equal("override"))
+		Expect(conf.Env["ENV_ONLY"]).To(Equal("yes"))
+		Expect(conf.Source("env.FROM").Source.File).To(Equal(testDir + "/split/20-override.yml"))
+		Expect(conf.BaseImage).ToNot(BeEmpty())
+	})
+
 	It("should be able to run LoadConfig to load yaml configuration", func() {
 		conf, err := config.LoadConfig("../test/containers", "test-incompatible-plugin", true, "../test")
 		Expect(err).To(BeNil())
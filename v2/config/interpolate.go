@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ${VAR} and ${VAR:-default}, from the launcher's environment or containers/{config}.env.
+// $${ is a literal ${.
+var varRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:-)([^}]*))?\}`)
+
+var envFileLineRegexp = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+
+// Top-level keys interpolated: scalars, values of maps, and entries of lists.
+var interpolatedKeys = []string{"env", "labels", "volumes", "expose", "docker_args", "base_image", "run_image"}
+
+// Looks up variables for interpolation. The launcher's environment wins over the env file.
+type varLookup func(name string) (string, bool)
+
+func newVarLookup(fileVars map[string]string) varLookup {
+	return func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := fileVars[name]
+		return value, ok
+	}
+}
+
+// Reads KEY=value lines, with # comments, optional export, and optionally quoted values.
+// A missing file has no variables.
+func readEnvFile(filename string) (map[string]string, error) {
+	vars := map[string]string{}
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return vars, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		match := envFileLineRegexp.FindStringSubmatch(text)
+		if match == nil {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", filename, line)
+		}
+		value := match[2]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[match[1]] = value
+	}
+	return vars, scanner.Err()
+}
+
+func interpolate(value string, lookup varLookup) (string, error) {
+	var err error
+	result := varRegexp.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		parts := varRegexp.FindStringSubmatch(match)
+		name, hasDefault, defaultValue := parts[1], parts[2] != "", parts[3]
+		if v, ok := lookup(name); ok && (v != "" || !hasDefault) {
+			return v
+		}
+		if hasDefault {
+			return defaultValue
+		}
+		if err == nil {
+			err = fmt.Errorf("${%s} is not set, set it in the environment or the config's .env file, or give a default with ${%s:-default}", name, name)
+		}
+		return match
+	})
+	return result, err
+}
+
+// Interpolates the values of interpolatedKeys in a yaml document. Returns whether any changed.
+func interpolateDoc(filename string, doc *yaml.Node, lookup varLookup) (bool, error) {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return false, nil
+	}
+	changed := false
+	var walk func(node *yaml.Node) error
+	walk = func(node *yaml.Node) error {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			value, err := interpolate(node.Value, lookup)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, node.Line, err)
+			}
+			if value != node.Value {
+				node.Value = value
+				node.Tag = "!!str"
+				changed = true
+			}
+		case yaml.MappingNode:
+			// values only, keys aren't interpolated
+			for i := 1; i < len(node.Content); i += 2 {
+				if err := walk(node.Content[i]); err != nil {
+					return err
+				}
+			}
+		case yaml.SequenceNode:
+			for _, item := range node.Content {
+				if err := walk(item); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i].Value, root.Content[i+1]
+		if !slices.Contains(interpolatedKeys, key) {
+			continue
+		}
+		nodes := []*yaml.Node{value}
+		if key == "volumes" {
+			nodes = volumeHostNodes(value)
+		}
+		for _, node := range nodes {
+			if err := walk(node); err != nil {
+				return false, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+// Host paths of a volumes list, guest paths are left alone.
+func volumeHostNodes(volumes *yaml.Node) []*yaml.Node {
+	hosts := []*yaml.Node{}
+	for _, item := range volumes.Content {
+		for _, volume := range mappingValues(item, "volume") {
+			hosts = append(hosts, mappingValues(volume, "host")...)
+		}
+	}
+	return hosts
+}
+
+func mappingValues(node *yaml.Node, key string) []*yaml.Node {
+	values := []*yaml.Node{}
+	if node.Kind != yaml.MappingNode {
+		return values
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			values = append(values, node.Content[i+1])
+		}
+	}
+	return values
+}
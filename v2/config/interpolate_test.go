@@ -0,0 +1,77 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"os"
+	"path/filepath"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Interpolation", func() {
+	var testDir string
+	var confDir string
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		confDir = filepath.Join(testDir, "containers")
+		os.MkdirAll(confDir, 0755)                  //nolint:errcheck
+		os.Setenv("LAUNCHER_TEST_HOSTNAME", "prod") //nolint:errcheck
+		os.WriteFile(filepath.Join(confDir, "app.env"), []byte(`# staging host
+LAUNCHER_TEST_HOSTNAME=staging
+export LAUNCHER_TEST_PORT="8080"
+LAUNCHER_TEST_TAG='2.0.20250226-0128'
+`), 0644) //nolint:errcheck
+		os.WriteFile(filepath.Join(confDir, "app.yml"), []byte(`base_image: discourse/base:${LAUNCHER_TEST_TAG}
+expose:
+  - "${LAUNCHER_TEST_PORT}:80"
+docker_args: --memory ${LAUNCHER_TEST_MEMORY:-2g}
+volumes:
+  - volume:
+      host: /var/discourse/${LAUNCHER_TEST_HOSTNAME}
+      guest: /shared/${LAUNCHER_TEST_HOSTNAME}
+labels:
+  host: ${LAUNCHER_TEST_HOSTNAME}
+env:
+  DISCOURSE_HOSTNAME: ${LAUNCHER_TEST_HOSTNAME}.example.org
+  LITERAL: $${LAUNCHER_TEST_HOSTNAME} pa$$word
+run:
+  - exec: echo ${LAUNCHER_TEST_HOSTNAME}
+`), 0644) //nolint:errcheck
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("LAUNCHER_TEST_HOSTNAME") //nolint:errcheck
+		os.RemoveAll(testDir)                 //nolint:errcheck
+	})
+
+	It("interpolates from the environment, then the config's env file", func() {
+		conf, err := config.LoadConfig(confDir, "app", true, testDir)
+		Expect(err).To(BeNil())
+		Expect(conf.BaseImage).To(Equal("discourse/base:2.0.20250226-0128"))
+		Expect(conf.Expose).To(Equal([]string{"8080:80"}))
+		Expect(conf.DockerArgs).To(Equal("--memory 2g"))
+		Expect(conf.Volumes[0].Volume.Host).To(Equal("/var/discourse/prod"))
+		Expect(conf.Volumes[0].Volume.Guest).To(Equal("/shared/${LAUNCHER_TEST_HOSTNAME}"))
+		Expect(conf.Labels).To(HaveKeyWithValue("host", "prod"))
+		Expect(conf.Env).To(HaveKeyWithValue("DISCOURSE_HOSTNAME", "prod.example.org"))
+		Expect(conf.Env).To(HaveKeyWithValue("LITERAL", "${LAUNCHER_TEST_HOSTNAME} pa$$word"))
+	})
+
+	It("gives pups the interpolated values", func() {
+		conf, err := config.LoadConfig(confDir, "app", true, testDir)
+		Expect(err).To(BeNil())
+		Expect(conf.Yaml()).To(ContainSubstring("DISCOURSE_HOSTNAME: prod.example.org"))
+		Expect(conf.Yaml()).To(ContainSubstring("base_image: discourse/base:2.0.20250226-0128"))
+		// pups steps are left to the shell
+		Expect(conf.Yaml()).To(ContainSubstring("echo ${LAUNCHER_TEST_HOSTNAME}"))
+	})
+
+	It("fails on unset variables without a default", func() {
+		os.Remove(filepath.Join(confDir, "app.env")) //nolint:errcheck
+		_, err := config.LoadConfig(confDir, "app", true, testDir)
+		Expect(err).To(MatchError(ContainSubstring(filepath.Join(confDir, "app.yml") + ":1: ${LAUNCHER_TEST_TAG} is not set")))
+	})
+})
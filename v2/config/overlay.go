@@ -0,0 +1,265 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Entries tagged !delete remove what the files before set, in env, labels, params, and lists:
+//
+//	env:
+//	  DISCOURSE_CDN_URL: !delete
+//	expose:
+//	  - !delete "443:443"
+//	volumes:
+//	  - !delete {volume: {guest: /var/log}}
+const deleteTag = "!delete"
+
+var profileNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// An entry a file removes from the files before it.
+type deletion struct {
+	key  string
+	line int
+	// the key of a map entry
+	entry string
+	// a list entry, matched on its identity
+	item *yaml.Node
+}
+
+// Lists a profile adds to rather than replaces. A profile entry with the identity of an entry
+// already in the list overrides it: volumes by guest path, links by name.
+var profileLists = []string{"templates", "expose", "volumes", "links", "blue_green.expose"}
+
+func stringIdentity(s string) string { return s }
+
+func volumeIdentity(v VolumeObject) string { return v.Volume.Guest }
+
+func linkIdentity(l LinkObject) string { return l.Link.Name }
+
+// Removes the entries tagged !delete from a yaml document. Returns the deletions, and nodes
+// tagged !delete where they can't delete anything.
+func extractDeletions(doc *yaml.Node) ([]deletion, []*yaml.Node) {
+	deletions := []deletion{}
+	misplaced := []*yaml.Node{}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return deletions, misplaced
+	}
+
+	var extract func(key string, node *yaml.Node)
+	extract = func(key string, node *yaml.Node) {
+		switch {
+		case slices.Contains(mapKeys, key) && node.Kind == yaml.MappingNode:
+			kept := []*yaml.Node{}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i+1].Tag == deleteTag {
+					deletions = append(deletions, deletion{key: key, line: node.Content[i].Line, entry: node.Content[i].Value})
+					continue
+				}
+				kept = append(kept, node.Content[i], node.Content[i+1])
+			}
+			node.Content = kept
+		case slices.Contains(profileLists, key) && node.Kind == yaml.SequenceNode:
+			kept := []*yaml.Node{}
+			for _, item := range node.Content {
+				if item.Tag == deleteTag {
+					item.Tag = ""
+					deletions = append(deletions, deletion{key: key, line: item.Line, item: item})
+					continue
+				}
+				kept = append(kept, item)
+			}
+			node.Content = kept
+		case key == "blue_green" && node.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				extract(key+"."+node.Content[i].Value, node.Content[i+1])
+			}
+		}
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		extract(root.Content[i].Value, root.Content[i+1])
+	}
+
+	var find func(node *yaml.Node)
+	find = func(node *yaml.Node) {
+		if node.Tag == deleteTag {
+			misplaced = append(misplaced, node)
+		}
+		for _, child := range node.Content {
+			find(child)
+		}
+	}
+	find(root)
+	return deletions, misplaced
+}
+
+func misplacedDeleteMessage() string {
+	return deleteTag + " only removes entries of env, labels, params, and " + strings.Join(profileLists, ", ")
+}
+
+// Removes what a file's deletions name from the config merged so far.
+func (config *Config) applyDeletions(file *configFile) error {
+	for _, d := range file.deletions {
+		if d.item == nil {
+			config.deleteEntry(d.key, d.entry)
+			continue
+		}
+		var err error
+		switch d.key {
+		case "templates":
+			config.Templates, err = deleteListItem(config, d, config.Templates, stringIdentity)
+		case "expose":
+			config.Expose, err = deleteListItem(config, d, config.Expose, stringIdentity)
+		case "volumes":
+			config.Volumes, err = deleteListItem(config, d, config.Volumes, volumeIdentity)
+		case "links":
+			config.Links, err = deleteListItem(config, d, config.Links, linkIdentity)
+		case "blue_green.expose":
+			config.BlueGreen.Expose, err = deleteListItem(config, d, config.BlueGreen.Expose, stringIdentity)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", file.filename, d.line, err)
+		}
+	}
+	return nil
+}
+
+// Deletes a map entry, from the config and from the yaml pups reads.
+func (config *Config) deleteEntry(key string, entry string) {
+	switch key {
+	case "env":
+		delete(config.Env, entry)
+		config.sourcedSecrets = slices.DeleteFunc(config.sourcedSecrets, func(s string) bool { return s == entry })
+		delete(config.pendingSecrets, entry)
+	case "labels":
+		delete(config.Labels, entry)
+	}
+	delete(config.sources, key+"."+entry)
+
+	for i, content := range config.rawYaml {
+		doc := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(content), doc); err != nil || len(doc.Content) == 0 {
+			continue
+		}
+		deleted := false
+		for _, entries := range mappingValues(doc.Content[0], key) {
+			for j := 0; j+1 < len(entries.Content); j += 2 {
+				if entries.Content[j].Value == entry {
+					entries.Content = slices.Delete(entries.Content, j, j+2)
+					deleted = true
+					break
+				}
+			}
+		}
+		if deleted {
+			if encoded, err := encodeDoc(doc); err == nil {
+				config.rawYaml[i] = string(encoded)
+			}
+		}
+	}
+}
+
+// Deletes the entries of a list with the identity of a deletion's item.
+func deleteListItem[T any](config *Config, d deletion, list []T, identity func(T) string) ([]T, error) {
+	var item T
+	if err := d.item.Decode(&item); err != nil {
+		return nil, err
+	}
+	id := identity(item)
+	if id == "" {
+		return nil, errors.New(d.key + ": nothing identifies the entry to delete")
+	}
+	kept := []T{}
+	for _, entry := range list {
+		if identity(entry) == id {
+			config.deleteListSource(d.key, len(kept))
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept, nil
+}
+
+// Adds a profile's list entries to a list, overriding entries with the same identity. Sets
+// the index each entry ended up at.
+func appendList(list reflect.Value, entries reflect.Value, indexes []int) reflect.Value {
+	list = reflect.AppendSlice(reflect.MakeSlice(list.Type(), 0, list.Len()+entries.Len()), list)
+	for j := 0; j < entries.Len(); j++ {
+		entry := entries.Index(j)
+		i := 0
+		for ; i < list.Len(); i++ {
+			if listIdentity(list.Index(i).Interface()) == listIdentity(entry.Interface()) {
+				break
+			}
+		}
+		if i == list.Len() {
+			list = reflect.Append(list, entry)
+		} else {
+			list.Index(i).Set(entry)
+		}
+		indexes[j] = i
+	}
+	return list
+}
+
+func listIdentity(entry any) string {
+	switch e := entry.(type) {
+	case string:
+		return stringIdentity(e)
+	case VolumeObject:
+		return volumeIdentity(e)
+	case LinkObject:
+		return linkIdentity(e)
+	}
+	return ""
+}
+
+// Reads the overlays of profiles, containers/{config}.{profile}.yml or any other form of
+// config. They are merged over the config after the templates they include that the config
+// doesn't.
+func (config *Config) readProfiles(dir string, profiles []string) ([][]*configFile, error) {
+	profileFiles := [][]*configFile{}
+	for _, profile := range profiles {
+		if !profileNameRegexp.MatchString(profile) {
+			return nil, errors.New("profile name '" + profile + "' must only have lower case letters, digits, - and _")
+		}
+		files, err := config.readFiles(dir, config.Name+"."+profile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile, err)
+		}
+		profileFiles = append(profileFiles, files)
+	}
+	return profileFiles, nil
+}
+
+// Variables for a config and its profiles, later env files win.
+func readEnvFiles(dir string, configName string, profiles []string) (map[string]string, error) {
+	vars := map[string]string{}
+	names := []string{configName}
+	for _, profile := range profiles {
+		names = append(names, configName+"."+profile)
+	}
+	for _, name := range names {
+		fileVars, err := readEnvFile(filepath.Join(dir, name+".env"))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range fileVars {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+func listEntryKey(key string, i int) string {
+	return key + "[" + strconv.Itoa(i) + "]"
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Checks that would otherwise fail a build part way through, after pulling the base image.
+// Problems are listed together, errors loading the config are returned.
+func Preflight(dir string, configName string, templatesDir string, profiles ...string) ([]Problem, error) {
+	config, err := loadConfig(dir, configName, true, templatesDir, profiles...)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []Problem{}
+	if config.BaseImage == "" {
+		problems = append(problems, config.problemAt("base_image", noBaseImageMessage))
+	}
+	for i, content := range config.rawYaml[:len(config.files)] {
+		doc := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(content), doc); err != nil || len(doc.Content) == 0 {
+			continue
+		}
+		problems = append(problems, bundledPluginProblems(config.files[i], doc.Content[0])...)
+	}
+
+	// the checks web.template.yml runs in the build
+	if config.Env["DISCOURSE_HOSTNAME"] == "discourse.example.com" {
+		problems = append(problems, config.problemAt("env.DISCOURSE_HOSTNAME", "domain is not configured, DISCOURSE_HOSTNAME is still discourse.example.com"))
+	}
+	if config.Env["DISCOURSE_SMTP_ADDRESS"] == "smtp.example.com" {
+		problems = append(problems, config.problemAt("env.DISCOURSE_SMTP_ADDRESS", "mail is not configured, DISCOURSE_SMTP_ADDRESS is still smtp.example.com"))
+	}
+	if strings.HasPrefix(config.Env["DISCOURSE_CDN_URL"], "//") {
+		problems = append(problems, config.problemAt("env.DISCOURSE_CDN_URL", "DISCOURSE_CDN_URL must have a protocol, like https:"))
+	}
+	// a database host from a secret file or command isn't read before building
+	if external, err := config.ExternalDb(); err == nil && external && config.Env["DISCOURSE_DB_PASSWORD"] == "" && !config.SecretPending("DISCOURSE_DB_PASSWORD") {
+		problems = append(problems, config.problemAt("env.DISCOURSE_DB_PASSWORD", "DISCOURSE_DB_PASSWORD is empty, set the password of the database at "+config.Env["DISCOURSE_DB_HOST"]))
+	}
+	return problems, nil
+}
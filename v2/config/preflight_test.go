@@ -0,0 +1,61 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"os"
+	"path/filepath"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Preflight", func() {
+	It("passes a config ready to build", func() {
+		testDir, _ := os.MkdirTemp("", "ddocker-test")
+		defer os.RemoveAll(testDir) //nolint:errcheck
+		os.WriteFile(filepath.Join(testDir, "app.yml"), []byte(`base_image: discourse/base:release
+env:
+  DISCOURSE_HOSTNAME: forum.example.org
+  DISCOURSE_SMTP_ADDRESS: smtp.example.org
+  DISCOURSE_DB_HOST: data
+  DISCOURSE_DB_PASSWORD: SOME_SECRET
+`), 0644) //nolint:errcheck
+
+		problems, err := config.Preflight(testDir, "app", testDir)
+		Expect(err).To(BeNil())
+		Expect(problems).To(BeEmpty())
+	})
+
+	It("reports the example values left in a sample config", func() {
+		problems, err := config.Preflight("../test/containers", "test", "../test")
+		Expect(err).To(BeNil())
+		messages := []string{}
+		for _, p := range problems {
+			messages = append(messages, p.Message)
+		}
+		Expect(messages).To(ConsistOf(
+			ContainSubstring("domain is not configured"),
+			ContainSubstring("mail is not configured"),
+		))
+	})
+
+	It("reports a missing base image with the other problems", func() {
+		testDir, _ := os.MkdirTemp("", "ddocker-test")
+		defer os.RemoveAll(testDir) //nolint:errcheck
+		filename := filepath.Join(testDir, "app.yml")
+		os.WriteFile(filename, []byte("env:\n  DISCOURSE_SMTP_ADDRESS: smtp.example.com\n  DISCOURSE_CDN_URL: //cdn.example.org\n"), 0644) //nolint:errcheck
+
+		problems, err := config.Preflight(testDir, "app", testDir)
+		Expect(err).To(BeNil())
+		messages := []string{}
+		for _, p := range problems {
+			messages = append(messages, p.String())
+		}
+		Expect(messages).To(ConsistOf(
+			filename+": no base image specified in config, set base image with `base_image: {imagename}`",
+			filename+":2: mail is not configured, DISCOURSE_SMTP_ADDRESS is still smtp.example.com",
+			filename+":3: DISCOURSE_CDN_URL must have a protocol, like https:",
+		))
+	})
+})
@@ -0,0 +1,181 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Profiles", func() {
+	var testDir string
+	var confDir string
+
+	var writeFile = func(name string, content string) string {
+		filename := filepath.Join(testDir, name)
+		os.WriteFile(filename, []byte(content), 0644) //nolint:errcheck
+		return filename
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		confDir = filepath.Join(testDir, "containers")
+		os.MkdirAll(confDir, 0755)                             //nolint:errcheck
+		os.MkdirAll(filepath.Join(testDir, "templates"), 0755) //nolint:errcheck
+		writeFile("templates/web.yml", "base_image: discourse/base:release\n")
+		writeFile("templates/debug.yml", "env:\n  DEBUG: '1'\n")
+		writeFile("containers/app.yml", `templates:
+  - templates/web.yml
+expose:
+  - "80:80"
+  - "443:443"
+volumes:
+  - volume:
+      host: /var/discourse/shared/app
+      guest: /shared
+  - volume:
+      host: /var/discourse/shared/app/log
+      guest: /var/log
+env:
+  DISCOURSE_HOSTNAME: forum.example.org
+  DISCOURSE_CDN_URL: https://cdn.example.org
+labels:
+  app: "{{config}}"
+params:
+  version: stable
+`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir) //nolint:errcheck
+	})
+
+	It("loads the config alone without profiles", func() {
+		conf, err := config.LoadConfig(confDir, "app", true, testDir)
+		Expect(err).To(BeNil())
+		Expect(conf.Profiles).To(BeEmpty())
+		Expect(conf.Env["DISCOURSE_HOSTNAME"]).To(Equal("forum.example.org"))
+	})
+
+	It("merges a profile over the config, adding to its lists", func() {
+		profile := writeFile("containers/app.staging.yml", `templates:
+  - templates/debug.yml
+expose:
+  - "8080:8080"
+volumes:
+  - volume:
+      host: /var/discourse/staging
+      guest: /shared
+  - volume:
+      host: /tmp/uploads
+      guest: /uploads
+env:
+  DISCOURSE_HOSTNAME: staging.example.org
+labels:
+  stage: staging
+`)
+		conf, err := config.LoadConfig(confDir, "app", true, testDir, "staging")
+		Expect(err).To(BeNil())
+		Expect(conf.Profiles).To(Equal([]string{"staging"}))
+		Expect(conf.Env["DISCOURSE_HOSTNAME"]).To(Equal("staging.example.org"))
+		Expect(conf.Env["DISCOURSE_CDN_URL"]).To(Equal("https://cdn.example.org"))
+		Expect(conf.Env["DEBUG"]).To(Equal("1"))
+		Expect(conf.Labels).To(Equal(map[string]string{"app": "app", "stage": "staging"}))
+		Expect(conf.Expose).To(Equal([]string{"80:80", "443:443", "8080:8080"}))
+		Expect(conf.Volumes).To(HaveLen(3))
+		Expect(conf.Volumes[0].Volume.Host).To(Equal("/var/discourse/staging"))
+		Expect(conf.Volumes[1].Volume.Guest).To(Equal("/var/log"))
+		Expect(conf.Volumes[2].Volume.Guest).To(Equal("/uploads"))
+
+		Expect(conf.Source("env.DISCOURSE_HOSTNAME").Source).To(Equal(config.Source{File: profile, Line: 13}))
+		Expect(conf.Source("expose[2]").Source).To(Equal(config.Source{File: profile, Line: 4}))
+		Expect(conf.Source("volumes[0]").Source).To(Equal(config.Source{File: profile, Line: 6}))
+		Expect(conf.Source("volumes[0]").Overrode).To(HaveLen(1))
+		Expect(conf.Source("volumes[2]").Source).To(Equal(config.Source{File: profile, Line: 9}))
+	})
+
+	It("deletes entries tagged !delete", func() {
+		base := filepath.Join(confDir, "app.yml")
+		writeFile("containers/app.staging.yml", `env:
+  DISCOURSE_CDN_URL: !delete
+labels:
+  app: !delete
+params:
+  version: !delete
+expose:
+  - !delete "80:80"
+volumes:
+  - !delete {volume: {guest: /shared}}
+`)
+		conf, err := config.LoadConfig(confDir, "app", true, testDir, "staging")
+		Expect(err).To(BeNil())
+		Expect(conf.Env).ToNot(HaveKey("DISCOURSE_CDN_URL"))
+		Expect(conf.Labels).To(BeEmpty())
+		Expect(conf.Expose).To(Equal([]string{"443:443"}))
+		Expect(conf.Volumes).To(HaveLen(1))
+		Expect(conf.Volumes[0].Volume.Guest).To(Equal("/var/log"))
+		Expect(conf.Yaml()).ToNot(ContainSubstring("cdn.example.org"))
+		Expect(conf.Yaml()).ToNot(ContainSubstring("version: stable"))
+
+		Expect(conf.Source("env.DISCOURSE_CDN_URL")).To(BeNil())
+		Expect(conf.Source("expose[0]").Source).To(Equal(config.Source{File: base, Line: 5}))
+		Expect(conf.Source("expose[1]")).To(BeNil())
+		Expect(conf.Source("volumes[0]").Source).To(Equal(config.Source{File: base, Line: 10}))
+	})
+
+	It("doesn't merge templates a profile deletes", func() {
+		writeFile("templates/ssl.yml", "expose:\n  - \"443:443\"\nenv:\n  DISCOURSE_FORCE_HTTPS: true\nhooks:\n  after_ssl:\n    - exec: certbot\n")
+		writeFile("containers/app.yml", "templates:\n  - templates/web.yml\n  - templates/ssl.yml\n")
+		writeFile("containers/app.staging.yml", "templates:\n  - !delete templates/ssl.yml\n  - templates/debug.yml\n")
+		conf, err := config.LoadConfig(confDir, "app", true, testDir, "staging")
+		Expect(err).To(BeNil())
+		Expect(conf.Templates).To(Equal([]string{"templates/web.yml", "templates/debug.yml"}))
+		Expect(conf.Env).To(Equal(map[string]string{"DEBUG": "1"}))
+		Expect(conf.Expose).To(BeEmpty())
+		Expect(conf.Yaml()).ToNot(ContainSubstring("certbot"))
+		Expect(conf.Source("env.DISCOURSE_FORCE_HTTPS")).To(BeNil())
+
+		conf, err = config.LoadConfig(confDir, "app", true, testDir)
+		Expect(err).To(BeNil())
+		Expect(conf.Expose).To(Equal([]string{"443:443"}))
+	})
+
+	It("merges later profiles over earlier ones, with their env files", func() {
+		writeFile("containers/app.env", "HOST=forum.example.org\nCDN=cdn.example.org\n")
+		writeFile("containers/app.staging.env", "HOST=staging.example.org\n")
+		writeFile("containers/app.staging.yml", "env:\n  DISCOURSE_HOSTNAME: ${HOST}\n  DISCOURSE_CDN_URL: https://${CDN}\n")
+		writeFile("containers/app.eu.yml", "env:\n  DISCOURSE_CDN_URL: https://eu.${CDN}\n")
+		conf, err := config.LoadConfig(confDir, "app", true, testDir, "staging", "eu")
+		Expect(err).To(BeNil())
+		Expect(conf.Env["DISCOURSE_HOSTNAME"]).To(Equal("staging.example.org"))
+		Expect(conf.Env["DISCOURSE_CDN_URL"]).To(Equal("https://eu.cdn.example.org"))
+	})
+
+	It("errors on missing profiles and misplaced !delete", func() {
+		_, err := config.LoadConfig(confDir, "app", true, testDir, "missing")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(HavePrefix("profile missing: "))
+
+		_, err = config.LoadConfig(confDir, "app", true, testDir, "Bad.Name")
+		Expect(err).ToNot(BeNil())
+
+		profile := writeFile("containers/app.staging.yml", "base_image: !delete\n")
+		_, err = config.LoadConfig(confDir, "app", true, testDir, "staging")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(profile + ":1: !delete only removes"))
+
+		_, problems := config.Validate(confDir, "app", testDir, "staging")
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].File).To(Equal(profile))
+		Expect(strings.HasPrefix(problems[0].Message, "!delete")).To(BeTrue())
+
+		template := writeFile("templates/web.yml", "base_image: discourse/base:release\ntemplates:\n  - !delete templates/debug.yml\n")
+		_, err = config.LoadConfig(confDir, "app", true, testDir)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(template + ":3: !delete deletes templates in configs and profiles"))
+	})
+})
@@ -0,0 +1,300 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Where a config value was set.
+type Source struct {
+	File string
+	Line int
+}
+
+func (s Source) String() string {
+	return s.File + ":" + strconv.Itoa(s.Line)
+}
+
+// The file that set a value of the merged config, and the earlier files it overrode.
+type ValueSource struct {
+	Key string
+	Source
+	Overrode []Source
+}
+
+// Config keys whose entries are map entries, merged entry by entry.
+var mapKeys = []string{"env", "labels", "params"}
+
+// Pups keys holding steps rather than settings, pups merges them and their entries aren't tracked.
+var stepKeys = []string{"run", "hooks"}
+
+// A config or template file, parsed once.
+type configFile struct {
+	filename string
+	// the file's mapping, interpolated and without deletions, nil when it sets nothing
+	root      *yaml.Node
+	templates []string
+	secrets   map[string]secretRef
+	// the file as pups reads it, interpolated and without secret sources
+	content   []byte
+	deletions []deletion
+}
+
+func readConfigFile(filename string, lookup varLookup) (*configFile, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		return nil, err
+	}
+	file := &configFile{filename: filename, content: content}
+	deletions, misplaced := extractDeletions(doc)
+	if len(misplaced) > 0 {
+		return nil, fmt.Errorf("%s:%d: %s", filename, misplaced[0].Line, misplacedDeleteMessage())
+	}
+	file.deletions = deletions
+
+	interpolated, err := interpolateDoc(filename, doc, lookup)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+		file.root = doc.Content[0]
+		for _, templates := range mappingValues(file.root, "templates") {
+			if err := templates.Decode(&file.templates); err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+		}
+	}
+	// the merge reads secret sources from the file, pups reads a copy without them
+	pupsDoc := copyNode(doc)
+	file.secrets, err = extractSecrets(pupsDoc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if interpolated || len(file.secrets) > 0 || len(file.deletions) > 0 {
+		if file.content, err = encodeDoc(pupsDoc); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func copyNode(node *yaml.Node) *yaml.Node {
+	copied := *node
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copied.Content[i] = copyNode(child)
+	}
+	return &copied
+}
+
+// Merges a file into the config, over the files before it.
+func (config *Config) merge(file *configFile) error {
+	return config.mergeFile(file, false)
+}
+
+// Merges a profile overlay into the config, its lists add to the config's lists.
+func (config *Config) mergeProfile(file *configFile) error {
+	return config.mergeFile(file, true)
+}
+
+func (config *Config) mergeFile(file *configFile, appendLists bool) error {
+	if err := config.applyDeletions(file); err != nil {
+		return err
+	}
+	if config.sources == nil {
+		config.sources = map[string]*ValueSource{}
+	}
+	m := &merger{config: config, file: file, appendLists: appendLists}
+	if file.root != nil {
+		if err := m.mapping("", reflect.ValueOf(config).Elem(), file.root); err != nil {
+			return fmt.Errorf("%s: %w", file.filename, err)
+		}
+	}
+	if err := config.mergeSecrets(m.plainEnv, file.secrets); err != nil {
+		return fmt.Errorf("%s: %w", file.filename, err)
+	}
+	config.rawYaml = append(config.rawYaml, string(file.content))
+	config.files = append(config.files, file.filename)
+	return nil
+}
+
+// Merges a file into the config key by key, recording where each value was set. A key the
+// file sets overrides the value before it, even with an empty value or false, and keys without
+// a value set nothing. Map entries override entries, lists replace the lists before, unless a
+// profile adds to them.
+type merger struct {
+	config      *Config
+	file        *configFile
+	appendLists bool
+	// env keys the file sets in plain text
+	plainEnv []string
+}
+
+// Merges a mapping into target, a struct, or an invalid value for settings only pups reads.
+func (m *merger) mapping(prefix string, target reflect.Value, node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolveAlias(node.Content[i+1])
+		name := key.Value
+		if prefix != "" {
+			name = prefix + "." + key.Value
+		}
+		if prefix == "" && slices.Contains(stepKeys, key.Value) || value.ShortTag() == "!!null" {
+			continue
+		}
+		field := yamlField(target, key.Value)
+		var err error
+		switch {
+		case prefix == "" && slices.Contains(mapKeys, key.Value) && value.Kind == yaml.MappingNode:
+			err = m.entries(name, field, value)
+		case value.Kind == yaml.SequenceNode && (!field.IsValid() || field.Kind() == reflect.Slice):
+			err = m.list(name, key.Line, field, value)
+		case value.Kind == yaml.MappingNode && (!field.IsValid() || field.Kind() == reflect.Struct):
+			err = m.mapping(name, field, value)
+		default:
+			m.record(name, key.Line)
+			err = decodeField(name, field, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merges the entries of a map, like env.
+func (m *merger) entries(name string, field reflect.Value, node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolveAlias(node.Content[i+1])
+		m.record(name+"."+key.Value, key.Line)
+		// secret sources are merged by mergeSecrets
+		if !field.IsValid() || name == "env" && value.Kind == yaml.MappingNode {
+			continue
+		}
+		entry := reflect.New(field.Type().Elem())
+		if err := value.Decode(entry.Interface()); err != nil {
+			return fmt.Errorf("%s.%s: %w", name, key.Value, err)
+		}
+		if field.IsNil() {
+			field.Set(reflect.MakeMap(field.Type()))
+		}
+		field.SetMapIndex(reflect.ValueOf(key.Value), entry.Elem())
+		if name == "env" {
+			m.plainEnv = append(m.plainEnv, key.Value)
+		}
+	}
+	return nil
+}
+
+// Merges a list, replacing the list before, or adding to it for profiles.
+func (m *merger) list(name string, line int, field reflect.Value, node *yaml.Node) error {
+	appended := m.appendLists && slices.Contains(profileLists, name)
+	indexes := make([]int, len(node.Content))
+	for j := range indexes {
+		indexes[j] = j
+	}
+	if field.IsValid() {
+		entries := reflect.New(field.Type())
+		if err := node.Decode(entries.Interface()); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if appended {
+			field.Set(appendList(field, entries.Elem(), indexes))
+		} else {
+			field.Set(entries.Elem())
+		}
+	}
+	if !appended {
+		for key := range m.config.sources {
+			if strings.HasPrefix(key, name+"[") {
+				delete(m.config.sources, key)
+			}
+		}
+	}
+	m.record(name, line)
+	for j, item := range node.Content {
+		m.record(listEntryKey(name, indexes[j]), item.Line)
+	}
+	return nil
+}
+
+func (m *merger) record(key string, line int) {
+	source := &ValueSource{Key: key, Source: Source{File: m.file.filename, Line: line}}
+	if previous, ok := m.config.sources[key]; ok {
+		source.Overrode = append(slices.Clone(previous.Overrode), previous.Source)
+	}
+	m.config.sources[key] = source
+}
+
+// The field of a struct with a yaml key, invalid when there is none.
+func yamlField(target reflect.Value, key string) reflect.Value {
+	if !target.IsValid() || target.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	for i := 0; i < target.NumField(); i++ {
+		tag, _, _ := strings.Cut(target.Type().Field(i).Tag.Get("yaml"), ",")
+		if tag != "" && tag != "-" && tag == key {
+			return target.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// Sets a field to a node's value, replacing what it held.
+func decodeField(name string, field reflect.Value, node *yaml.Node) error {
+	if !field.IsValid() {
+		return nil
+	}
+	value := reflect.New(field.Type())
+	if err := node.Decode(value.Interface()); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(value.Elem())
+	return nil
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		return node.Alias
+	}
+	return node
+}
+
+// Drops the source of a deleted list entry, moving the sources of the entries after it up.
+func (config *Config) deleteListSource(key string, i int) {
+	delete(config.sources, listEntryKey(key, i))
+	for j := i + 1; ; j++ {
+		source, ok := config.sources[listEntryKey(key, j)]
+		if !ok {
+			return
+		}
+		delete(config.sources, source.Key)
+		source.Key = listEntryKey(key, j-1)
+		config.sources[source.Key] = source
+	}
+}
+
+// Where each value of the config was set, sorted by key. Lists have a source for the list,
+// and one for each of its entries.
+func (config *Config) Sources() []*ValueSource {
+	sources := []*ValueSource{}
+	for _, s := range config.sources {
+		sources = append(sources, s)
+	}
+	slices.SortFunc(sources, func(a, b *ValueSource) int { return strings.Compare(a.Key, b.Key) })
+	return sources
+}
+
+// Where a value of the config was set, nil when no file set it.
+func (config *Config) Source(key string) *ValueSource {
+	return config.sources[key]
+}
@@ -0,0 +1,100 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"os"
+	"path/filepath"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Provenance", func() {
+	var testDir string
+	var conf *config.Config
+	var template string
+	var base string
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		os.MkdirAll(filepath.Join(testDir, "containers"), 0755) //nolint:errcheck
+		os.MkdirAll(filepath.Join(testDir, "templates"), 0755)  //nolint:errcheck
+		os.Setenv("LAUNCHER_TEST_SECRET", "secret")             //nolint:errcheck
+		template = filepath.Join(testDir, "templates", "web.yml")
+		base = filepath.Join(testDir, "containers", "app.yml")
+		os.WriteFile(template, []byte(`base_image: discourse/base:release
+update_pups: true
+expose:
+  - "80:80"
+  - "443:443"
+env:
+  LANG: en_US.UTF-8
+  RAILS_ENV: production
+health_check:
+  path: /srv/status
+run:
+  - exec: echo "hello"
+`), 0644) //nolint:errcheck
+		os.WriteFile(base, []byte(`templates:
+  - templates/web.yml
+update_pups: false
+expose:
+  - "8080:80"
+volumes: []
+env:
+  LANG: C.UTF-8
+  API_TOKEN: {env: LAUNCHER_TEST_SECRET}
+health_check:
+  path: /health
+`), 0644) //nolint:errcheck
+
+		var err error
+		conf, err = config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, testDir)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("LAUNCHER_TEST_SECRET") //nolint:errcheck
+		os.RemoveAll(testDir)               //nolint:errcheck
+	})
+
+	It("records the file and line that set a value", func() {
+		Expect(conf.Source("base_image").Source).To(Equal(config.Source{File: template, Line: 1}))
+		Expect(conf.Source("env.RAILS_ENV").Source).To(Equal(config.Source{File: template, Line: 8}))
+		Expect(conf.Source("env.API_TOKEN").Source).To(Equal(config.Source{File: base, Line: 9}))
+		Expect(conf.Source("run")).To(BeNil())
+	})
+
+	It("records the files a value overrode", func() {
+		lang := conf.Source("env.LANG")
+		Expect(lang.Source).To(Equal(config.Source{File: base, Line: 8}))
+		Expect(lang.Overrode).To(Equal([]config.Source{{File: template, Line: 7}}))
+		Expect(conf.Source("health_check.path").Overrode).To(HaveLen(1))
+	})
+
+	It("overrides with false and empty values", func() {
+		Expect(conf.UpdatePups).To(BeFalse())
+		Expect(conf.Source("update_pups").Source).To(Equal(config.Source{File: base, Line: 3}))
+		Expect(conf.Source("update_pups").Overrode).To(Equal([]config.Source{{File: template, Line: 2}}))
+		Expect(conf.Volumes).To(BeEmpty())
+		Expect(conf.Source("volumes").Source).To(Equal(config.Source{File: base, Line: 6}))
+	})
+
+	It("replaces the entries of overridden lists", func() {
+		Expect(conf.Source("expose").Source).To(Equal(config.Source{File: base, Line: 4}))
+		Expect(conf.Source("expose[0]").Source).To(Equal(config.Source{File: base, Line: 5}))
+		Expect(conf.Source("expose[1]")).To(BeNil())
+	})
+
+	It("lists sources by key", func() {
+		keys := []string{}
+		for _, s := range conf.Sources() {
+			keys = append(keys, s.Key)
+		}
+		Expect(keys).To(Equal([]string{
+			"base_image", "env.API_TOKEN", "env.LANG", "env.RAILS_ENV", "expose", "expose[0]",
+			"health_check.path", "templates", "templates[0]", "update_pups", "volumes",
+		}))
+	})
+})
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Replaces secret values in configs shown to users.
+const RedactedValue = "[REDACTED]"
+
+// A copy of the config to show users. Secrets from secret sources are always masked,
+// and with redact, known secrets too.
+func (config *Config) Masked(redact bool) *Config {
+	masked := *config
+	masked.Env = map[string]string{}
+	for k, v := range config.Env {
+		if config.HasSecretSource(k) || (redact && config.IsSecret(k)) {
+			v = RedactedValue
+		}
+		masked.Env[k] = v
+	}
+	return &masked
+}
+
+// The yaml documents pups reads, see Yaml. With redact, known secret env values are masked.
+func (config *Config) PupsDocs(redact bool) ([]string, error) {
+	if !redact {
+		return slices.Clone(config.rawYaml), nil
+	}
+	return config.editSecretEnv(func(env *yaml.Node, i int) {
+		if env.Content[i+1].Kind == yaml.ScalarNode {
+			env.Content[i+1].SetString(RedactedValue)
+		}
+	})
+}
+
+// The yaml pups reads, see Yaml, without known secret env, for files written next to a
+// compose project. Its containers get them from the env file instead.
+func (config *Config) PublicYaml() (string, error) {
+	docs, err := config.editSecretEnv(func(env *yaml.Node, i int) {
+		env.Content = slices.Delete(env.Content, i, i+2)
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(docs, FileSeparator), nil
+}
+
+// The yaml documents pups reads, with edit applied to each known secret env entry, at i in env.
+func (config *Config) editSecretEnv(edit func(env *yaml.Node, i int)) ([]string, error) {
+	docs := []string{}
+	for _, content := range config.rawYaml {
+		doc := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(content), doc); err != nil {
+			return nil, err
+		}
+		edited := false
+		if env := envNode(doc); env != nil {
+			// backwards, edit may delete the entry
+			for i := len(env.Content) - 2; i >= 0; i -= 2 {
+				if config.IsSecret(env.Content[i].Value) {
+					edit(env, i)
+					edited = true
+				}
+			}
+		}
+		if !edited {
+			docs = append(docs, content)
+			continue
+		}
+		encoded, err := encodeDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, string(encoded))
+	}
+	return docs, nil
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/discourse/launcher/v2/utils"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Env values may reference a secret instead of holding it:
+//
+//	DISCOURSE_DB_PASSWORD: {file: /etc/discourse/db_pass}
+//	DISCOURSE_SMTP_PASSWORD: {env: SMTP_PASSWORD}
+//	DISCOURSE_SECRET_KEY_BASE: {command: "pass show discourse/secret_key_base"}
+var secretSources = []string{"file", "env", "command"}
+
+// A secret source referenced by an env value, like {file: /etc/discourse/db_pass}.
+type secretRef struct {
+	source string
+	ref    string
+}
+
+// Secrets from files and commands already resolved by this process, so a command that loads a
+// config several times reads each file and runs each command once.
+var resolvedSecrets = map[secretRef]string{}
+var resolvedSecretsMu sync.Mutex
+
+// Resolves the value of a secret source.
+func resolveSecret(key string, secret secretRef) (string, error) {
+	resolvedSecretsMu.Lock()
+	defer resolvedSecretsMu.Unlock()
+	if value, ok := resolvedSecrets[secret]; ok {
+		return value, nil
+	}
+	var value string
+	switch secret.source {
+	case "file":
+		content, err := os.ReadFile(secret.ref)
+		if err != nil {
+			return "", fmt.Errorf("env %s: %w", key, err)
+		}
+		value = strings.TrimRight(string(content), "\r\n")
+	case "env":
+		env, ok := os.LookupEnv(secret.ref)
+		if !ok {
+			return "", fmt.Errorf("env %s: environment variable %s is not set", key, secret.ref)
+		}
+		// read each time, the environment is not the process's to cache
+		return env, nil
+	case "command":
+		cmd := exec.Command("sh", "-c", secret.ref)
+		// let password managers prompt
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		output, err := utils.CmdRunner(cmd).Output()
+		if err != nil {
+			return "", fmt.Errorf("env %s: command %q failed: %w", key, secret.ref, err)
+		}
+		value = strings.TrimRight(string(output), "\r\n")
+	default:
+		return "", fmt.Errorf("env %s: unknown secret source '%s', expected one of %s", key, secret.source, strings.Join(secretSources, ", "))
+	}
+	resolvedSecrets[secret] = value
+	return value, nil
+}
+
+// Removes env entries with secret sources from a yaml document, so neither the reference nor
+// the secret reaches pups or the build context. Returns the references by env key.
+func extractSecrets(doc *yaml.Node) (map[string]secretRef, error) {
+	secrets := map[string]secretRef{}
+	env := envNode(doc)
+	if env == nil {
+		return secrets, nil
+	}
+
+	kept := []*yaml.Node{}
+	for i := 0; i+1 < len(env.Content); i += 2 {
+		key, value := env.Content[i], env.Content[i+1]
+		if value.Kind != yaml.MappingNode {
+			kept = append(kept, key, value)
+			continue
+		}
+		if len(value.Content) != 2 || value.Content[1].Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("env %s: expected a single secret source, one of %s", key.Value, strings.Join(secretSources, ", "))
+		}
+		secret := secretRef{source: value.Content[0].Value, ref: value.Content[1].Value}
+		if !slices.Contains(secretSources, secret.source) {
+			return nil, fmt.Errorf("env %s: unknown secret source '%s', expected one of %s", key.Value, secret.source, strings.Join(secretSources, ", "))
+		}
+		secrets[key.Value] = secret
+	}
+	if len(secrets) > 0 {
+		env.Content = kept
+	}
+	return secrets, nil
+}
+
+// The env mapping of a yaml document, nil when it has none.
+func envNode(doc *yaml.Node) *yaml.Node {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	root := doc.Content[0]
+	var env *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "env" && root.Content[i+1].Kind == yaml.MappingNode {
+			env = root.Content[i+1]
+		}
+	}
+	return env
+}
+
+func encodeDoc(doc *yaml.Node) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sets secrets from a document merged into the config. Env the document sets in plain text
+// replaces secrets from earlier documents. Secrets from env are resolved right away, files and
+// commands are left for ResolveSecrets, with an empty value until then.
+func (config *Config) mergeSecrets(plainEnv []string, secrets map[string]secretRef) error {
+	for _, k := range plainEnv {
+		config.sourcedSecrets = slices.DeleteFunc(config.sourcedSecrets, func(s string) bool { return s == k })
+		delete(config.pendingSecrets, k)
+	}
+	if len(secrets) > 0 && config.Env == nil {
+		config.Env = map[string]string{}
+	}
+	for k, secret := range secrets {
+		value := ""
+		delete(config.pendingSecrets, k)
+		if secret.source == "env" {
+			var err error
+			if value, err = resolveSecret(k, secret); err != nil {
+				return err
+			}
+		} else {
+			if config.pendingSecrets == nil {
+				config.pendingSecrets = map[string]secretRef{}
+			}
+			config.pendingSecrets[k] = secret
+		}
+		config.Env[k] = value
+		if !slices.Contains(config.sourcedSecrets, k) {
+			config.sourcedSecrets = append(config.sourcedSecrets, k)
+		}
+	}
+	return nil
+}
+
+// Reads the secret files and runs the secret commands of the config's env. Only commands that
+// run containers need them, others leave them unresolved, without side effects.
+func (config *Config) ResolveSecrets() error {
+	keys := []string{}
+	for k := range config.pendingSecrets {
+		keys = append(keys, k)
+	}
+	// in the order a password manager prompts, the same each time
+	slices.Sort(keys)
+	for _, k := range keys {
+		value, err := resolveSecret(k, config.pendingSecrets[k])
+		if err != nil {
+			return err
+		}
+		config.Env[k] = value
+		delete(config.pendingSecrets, k)
+	}
+	return nil
+}
+
+// An env value read before its secret file or command was, see ResolveSecrets.
+type SecretPendingError struct {
+	Key string
+}
+
+func (e *SecretPendingError) Error() string {
+	return "env " + e.Key + " comes from a secret source that wasn't read yet"
+}
+
+// An env value. Secrets from files and commands are an error until ResolveSecrets reads them,
+// rather than an empty value.
+func (config *Config) EnvValue(k string) (string, error) {
+	if config.SecretPending(k) {
+		return "", &SecretPendingError{Key: k}
+	}
+	return config.Env[k], nil
+}
+
+// Whether env comes from a secret file or command that isn't resolved yet, see ResolveSecrets.
+func (config *Config) SecretPending(k string) bool {
+	_, ok := config.pendingSecrets[k]
+	return ok
+}
+
+// Whether env is a known secret, or comes from a secret source.
+func (config *Config) IsSecret(k string) bool {
+	return slices.Contains(utils.KnownSecrets, k) || config.HasSecretSource(k)
+}
+
+// Whether env comes from a secret source. These values are never printed.
+func (config *Config) HasSecretSource(k string) bool {
+	return slices.Contains(config.sourcedSecrets, k)
+}
@@ -0,0 +1,122 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Secret sources", func() {
+	var testDir string
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		os.MkdirAll(filepath.Join(testDir, "containers"), 0755)                      //nolint:errcheck
+		os.MkdirAll(filepath.Join(testDir, "templates"), 0755)                       //nolint:errcheck
+		os.WriteFile(filepath.Join(testDir, "db_pass"), []byte("from-file\n"), 0600) //nolint:errcheck
+		os.Setenv("LAUNCHER_TEST_SMTP", "from-env")                                  //nolint:errcheck
+		os.WriteFile(filepath.Join(testDir, "templates", "web.yml"), []byte(`
+env:
+  TEMPLATE_SECRET: {env: LAUNCHER_TEST_SMTP}
+  OVERRIDDEN: {env: LAUNCHER_TEST_SMTP}
+`), 0644) //nolint:errcheck
+		os.WriteFile(filepath.Join(testDir, "containers", "app.yml"), []byte(`
+base_image: discourse/base:release
+templates:
+  - templates/web.yml
+env:
+  LANG: en_US.UTF-8
+  OVERRIDDEN: plain
+  DISCOURSE_DB_PASSWORD: {file: `+filepath.Join(testDir, "db_pass")+`}
+  DISCOURSE_SMTP_PASSWORD: {env: LAUNCHER_TEST_SMTP}
+  API_TOKEN: {command: "echo from-command"}
+run:
+  - exec: echo "hello"
+`), 0644) //nolint:errcheck
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("LAUNCHER_TEST_SMTP") //nolint:errcheck
+		os.RemoveAll(testDir)             //nolint:errcheck
+	})
+
+	It("resolves secrets from files, env, and commands", func() {
+		conf, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, testDir)
+		Expect(err).To(BeNil())
+		Expect(conf.SecretPending("API_TOKEN")).To(BeTrue())
+		Expect(conf.SecretPending("DISCOURSE_SMTP_PASSWORD")).To(BeFalse())
+		Expect(conf.Env).To(HaveKeyWithValue("API_TOKEN", ""))
+		Expect(conf.ResolveSecrets()).To(Succeed())
+		Expect(conf.SecretPending("API_TOKEN")).To(BeFalse())
+		Expect(conf.EnvValue("API_TOKEN")).To(Equal("from-command"))
+		Expect(conf.Env).To(HaveKeyWithValue("DISCOURSE_DB_PASSWORD", "from-file"))
+		Expect(conf.Env).To(HaveKeyWithValue("DISCOURSE_SMTP_PASSWORD", "from-env"))
+		Expect(conf.Env).To(HaveKeyWithValue("API_TOKEN", "from-command"))
+		Expect(conf.Env).To(HaveKeyWithValue("TEMPLATE_SECRET", "from-env"))
+		Expect(conf.Env).To(HaveKeyWithValue("OVERRIDDEN", "plain"))
+		Expect(conf.HasSecretSource("API_TOKEN")).To(BeTrue())
+		Expect(conf.HasSecretSource("OVERRIDDEN")).To(BeFalse())
+		Expect(conf.IsSecret("DISCOURSE_DB_PASSWORD")).To(BeTrue())
+	})
+
+	It("fails to read secrets from files and commands before they are resolved", func() {
+		conf, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, testDir)
+		Expect(err).To(BeNil())
+		_, err = conf.EnvValue("DISCOURSE_DB_PASSWORD")
+		var pending *config.SecretPendingError
+		Expect(errors.As(err, &pending)).To(BeTrue())
+		Expect(pending.Key).To(Equal("DISCOURSE_DB_PASSWORD"))
+		_, err = conf.GetEnvSlice(true)
+		Expect(err).To(MatchError(ContainSubstring("wasn't read yet")))
+		Expect(conf.EnvValue("DISCOURSE_SMTP_PASSWORD")).To(Equal("from-env"))
+	})
+
+	It("runs secret commands once, and only when resolved", func() {
+		counter := filepath.Join(testDir, "runs")
+		os.WriteFile(filepath.Join(testDir, "containers", "app.yml"), []byte("base_image: discourse/base:release\nenv:\n  API_TOKEN: {command: \"echo run >> "+counter+"; echo from-command\"}\n"), 0644) //nolint:errcheck
+		confs := []*config.Config{}
+		for range 3 {
+			conf, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, testDir)
+			Expect(err).To(BeNil())
+			confs = append(confs, conf)
+		}
+		_, err := os.Stat(counter)
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+		for _, conf := range confs {
+			Expect(conf.ResolveSecrets()).To(Succeed())
+			Expect(conf.Env).To(HaveKeyWithValue("API_TOKEN", "from-command"))
+		}
+		runs, _ := os.ReadFile(counter)
+		Expect(string(runs)).To(Equal("run\n"))
+	})
+
+	It("keeps secrets and their references out of the pups config and build", func() {
+		conf, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, testDir)
+		Expect(err).To(BeNil())
+		for _, leaked := range []string{"from-file", "from-env", "from-command", "db_pass", "LAUNCHER_TEST_SMTP", "API_TOKEN"} {
+			Expect(conf.Yaml()).ToNot(ContainSubstring(leaked))
+			Expect(conf.Dockerfile(true, false, true, "config.yaml")).ToNot(ContainSubstring(leaked))
+		}
+		Expect(conf.Yaml()).To(ContainSubstring(`exec: echo "hello"`))
+		Expect(conf.Yaml()).To(ContainSubstring("OVERRIDDEN: plain"))
+		env, err := conf.GetEnvSlice(false)
+		Expect(err).To(BeNil())
+		Expect(env).To(Equal([]string{"LANG=en_US.UTF-8", "OVERRIDDEN=plain"}))
+	})
+
+	It("fails on unknown sources, and missing secrets", func() {
+		os.WriteFile(filepath.Join(testDir, "containers", "app.yml"), []byte("base_image: discourse/base:release\nenv:\n  A: {vault: secret/a}\n"), 0644) //nolint:errcheck
+		_, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, testDir)
+		Expect(err).To(MatchError(ContainSubstring("env A: unknown secret source 'vault'")))
+
+		os.Unsetenv("LAUNCHER_TEST_SMTP")                                                                                                                         //nolint:errcheck
+		os.WriteFile(filepath.Join(testDir, "containers", "app.yml"), []byte("base_image: discourse/base:release\nenv:\n  A: {env: LAUNCHER_TEST_SMTP}\n"), 0644) //nolint:errcheck
+		_, err = config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, testDir)
+		Expect(err).To(MatchError(ContainSubstring("environment variable LAUNCHER_TEST_SMTP is not set")))
+	})
+})
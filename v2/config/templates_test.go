@@ -0,0 +1,94 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Template includes", func() {
+	var testDir string
+	var orgDir string
+	var templatesDir string
+
+	var write = func(filename string, content string) {
+		os.MkdirAll(filepath.Dir(filename), 0755)     //nolint:errcheck
+		os.WriteFile(filename, []byte(content), 0644) //nolint:errcheck
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		orgDir = filepath.Join(testDir, "org")
+		templatesDir = testDir + string(filepath.ListSeparator) + orgDir
+		write(filepath.Join(testDir, "templates", "base.yml"), `base_image: discourse/base:release
+env:
+  FROM_BASE: base
+  OVERRIDDEN: base
+`)
+		write(filepath.Join(testDir, "templates", "web.yml"), `templates:
+  - templates/base.yml
+env:
+  OVERRIDDEN: web
+`)
+		write(filepath.Join(orgDir, "templates", "org.yml"), `templates:
+  - templates/base.yml
+env:
+  FROM_ORG: org
+`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir) //nolint:errcheck
+	})
+
+	It("merges included templates first, and each template once", func() {
+		write(filepath.Join(testDir, "containers", "app.yml"), "templates:\n  - templates/web.yml\n  - templates/org.yml\n")
+		conf, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, templatesDir)
+		Expect(err).To(BeNil())
+		Expect(conf.Env).To(HaveKeyWithValue("FROM_BASE", "base"))
+		Expect(conf.Env).To(HaveKeyWithValue("FROM_ORG", "org"))
+		// base was included again by org.yml, after web.yml overrode it
+		Expect(conf.Env).To(HaveKeyWithValue("OVERRIDDEN", "web"))
+		Expect(strings.Count(conf.Yaml(), "OVERRIDDEN: base")).To(Equal(1))
+		Expect(conf.Source("env.FROM_ORG").File).To(Equal(filepath.Join(orgDir, "templates", "org.yml")))
+	})
+
+	It("uses the first directory in the search path holding a template", func() {
+		write(filepath.Join(orgDir, "templates", "web.yml"), "env:\n  OVERRIDDEN: org\n")
+		write(filepath.Join(testDir, "containers", "app.yml"), "templates:\n  - templates/web.yml\n")
+		conf, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, templatesDir)
+		Expect(err).To(BeNil())
+		Expect(conf.Env).To(HaveKeyWithValue("OVERRIDDEN", "web"))
+	})
+
+	It("names the file including a missing template", func() {
+		write(filepath.Join(testDir, "templates", "web.yml"), "templates:\n  - templates/missing.yml\n")
+		write(filepath.Join(testDir, "containers", "app.yml"), "templates:\n  - templates/web.yml\n")
+		_, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, templatesDir)
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring(filepath.Join(testDir, "templates", "web.yml") + ": template templates/missing.yml is not in " + templatesDir)))
+
+		_, problems := config.Validate(filepath.Join(testDir, "containers"), "app", templatesDir)
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].String()).To(Equal(filepath.Join(testDir, "templates", "web.yml") + ":2: template templates/missing.yml is not in " + templatesDir))
+	})
+
+	It("fails on cycles", func() {
+		write(filepath.Join(testDir, "templates", "base.yml"), "templates:\n  - templates/web.yml\n")
+		write(filepath.Join(testDir, "containers", "app.yml"), "templates:\n  - templates/web.yml\n")
+		_, err := config.LoadConfig(filepath.Join(testDir, "containers"), "app", true, templatesDir)
+		web := filepath.Join(testDir, "templates", "web.yml")
+		base := filepath.Join(testDir, "templates", "base.yml")
+		Expect(err).To(MatchError("template cycle: " + web + " -> " + base + " -> " + web))
+
+		_, problems := config.Validate(filepath.Join(testDir, "containers"), "app", templatesDir)
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].Message).To(ContainSubstring("template cycle"))
+	})
+})
@@ -0,0 +1,461 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/discourse/launcher/v2/utils"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Example values from the sample configs, which need replacing before a site works.
+var placeholderValues = []string{"discourse.example.com", "smtp.example.com", "SOME_SECRET"}
+
+// Top-level keys read by pups rather than launcher.
+var pupsKeys = []string{"params", "run", "hooks"}
+
+var yamlErrorRegexp = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+var yamlTypeErrorRegexp = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// {{config}}, and near misses like {{ config }}
+var configPlaceholderRegexp = regexp.MustCompile(`(?i)\{\{\s*config\s*\}\}`)
+
+// [[ip:][host port]:]container port[/protocol], ports may be ranges
+var exposeRegexp = regexp.MustCompile(`^(?:(?:(\d{1,3}(?:\.\d{1,3}){3}|\[[0-9a-fA-F:.]+\]):)?(\d+(?:-\d+)?)?:)?(\d+(?:-\d+)?)(?:/(tcp|udp|sctp))?$`)
+
+var bundledPluginRegexp = func() *regexp.Regexp {
+	plugins := []string{}
+	for _, plugin := range utils.BundledPlugins {
+		plugins = append(plugins, regexp.QuoteMeta(plugin))
+	}
+	return regexp.MustCompile(`git clone https://github\.com/discourse/(` + strings.Join(plugins, "|") + `)(?:\.git)?(?:\s|/|$)`)
+}()
+
+// A problem validate found in a config or template.
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+	// Warnings are things that may be intended, they don't fail validation
+	Warning bool
+}
+
+func (p Problem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location += ":" + strconv.Itoa(p.Line)
+	}
+	if p.Warning {
+		return location + ": warning: " + p.Message
+	}
+	return location + ": " + p.Message
+}
+
+// A host port published by an expose entry.
+type PublishedPort struct {
+	Ip       string
+	Port     int
+	Protocol string
+	Source   Source
+}
+
+// Whether two published ports can't be bound at the same time.
+func (p PublishedPort) Conflicts(other PublishedPort) bool {
+	if p.Port != other.Port || p.Protocol != other.Protocol {
+		return false
+	}
+	wildcard := func(ip string) bool { return ip == "" || ip == "0.0.0.0" || ip == "[::]" }
+	return p.Ip == other.Ip || wildcard(p.Ip) || wildcard(other.Ip)
+}
+
+// Checks a config and its templates without docker: yaml syntax, missing templates, unknown
+// keys, placeholder values, bundled plugins, expose entries, volume host paths, and {{config}}.
+// Profile overlays are checked too. The loaded config is nil when it can't be loaded.
+func Validate(dir string, configName string, templatesDir string, profiles ...string) (*Config, []Problem) {
+	problems := []Problem{}
+	loadable := true
+	checked := map[string]bool{}
+	names := []string{configName}
+	for _, profile := range profiles {
+		names = append(names, configName+"."+profile)
+	}
+	for _, name := range names {
+		filenames, err := utils.ConfigFiles(dir, name)
+		if err != nil {
+			problems = append(problems, Problem{File: filepath.Join(dir, name), Message: err.Error()})
+			loadable = false
+			continue
+		}
+		for _, filename := range filenames {
+			root, fileProblems, fileLoadable := validateFile(filename)
+			problems = append(problems, fileProblems...)
+			loadable = loadable && fileLoadable
+			if root == nil {
+				continue
+			}
+			templateProblems, templatesLoadable := validateTemplates(templatesDir, filename, root, nil, checked)
+			problems = append(problems, templateProblems...)
+			loadable = loadable && templatesLoadable
+		}
+	}
+	if !loadable {
+		return nil, problems
+	}
+
+	conf, err := LoadConfig(dir, configName, true, templatesDir, profiles...)
+	if err != nil {
+		return nil, append(problems, Problem{File: filepath.Join(dir, configName), Message: err.Error()})
+	}
+	return conf, append(problems, conf.validateValues()...)
+}
+
+// Checks the templates a file includes, and the templates they include. Each template is
+// checked once.
+func validateTemplates(templatesDir string, filename string, root *yaml.Node, loading []string, checked map[string]bool) ([]Problem, bool) {
+	problems := []Problem{}
+	loadable := true
+	loading = slices.Concat(loading, []string{filename})
+	for _, template := range nodeTemplates(root) {
+		template_filename := findTemplate(templatesDir, template.Value)
+		switch {
+		case template_filename == "":
+			problems = append(problems, Problem{File: filename, Line: template.Line, Message: missingTemplate(templatesDir, template.Value)})
+			loadable = false
+			continue
+		case slices.Contains(loading, template_filename):
+			problems = append(problems, Problem{File: filename, Line: template.Line, Message: "template cycle: " + strings.Join(append(loading, template_filename), " -> ")})
+			loadable = false
+			continue
+		case checked[template_filename]:
+			continue
+		}
+		checked[template_filename] = true
+		templateRoot, templateProblems, templateLoadable := validateFile(template_filename)
+		problems = append(problems, templateProblems...)
+		loadable = loadable && templateLoadable
+		if templateRoot != nil {
+			includedProblems, includedLoadable := validateTemplates(templatesDir, template_filename, templateRoot, loading, checked)
+			problems = append(problems, includedProblems...)
+			loadable = loadable && includedLoadable
+		}
+	}
+	return problems, loadable
+}
+
+// Checks a single file. The root mapping is nil when the file can't be parsed, and it
+// isn't loadable when its values don't fit the config.
+func validateFile(filename string) (*yaml.Node, []Problem, bool) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, []Problem{{File: filename, Message: err.Error()}}, false
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		problem := Problem{File: filename, Message: err.Error()}
+		if match := yamlErrorRegexp.FindStringSubmatch(err.Error()); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+		}
+		return nil, []Problem{problem}, false
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil, true
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, []Problem{{File: filename, Line: root.Line, Message: "expected a mapping of config keys"}}, false
+	}
+
+	_, misplaced := extractDeletions(doc)
+	problems := decodeProblems(filename, root)
+	for _, node := range misplaced {
+		problems = append(problems, Problem{File: filename, Line: node.Line, Message: misplacedDeleteMessage()})
+	}
+	loadable := len(problems) == 0
+	known := slices.Concat(yamlKeys(reflect.TypeOf(Config{})), pupsKeys)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i]
+		if !slices.Contains(known, key.Value) {
+			problems = append(problems, Problem{File: filename, Line: key.Line, Message: "unknown key " + key.Value})
+		}
+	}
+	problems = append(problems, configPlaceholderProblems(filename, "", root)...)
+	problems = append(problems, bundledPluginProblems(filename, root)...)
+	return root, problems, loadable
+}
+
+// Values that don't fit the config, like a map for expose. Secret sources are left out,
+// they are checked when the config is loaded.
+func decodeProblems(filename string, root *yaml.Node) []Problem {
+	decoded := *root
+	decoded.Content = slices.Clone(root.Content)
+	for i := 0; i+1 < len(decoded.Content); i += 2 {
+		if decoded.Content[i].Value != "env" || decoded.Content[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+		env := *decoded.Content[i+1]
+		env.Content = nil
+		for j := 0; j+1 < len(decoded.Content[i+1].Content); j += 2 {
+			if value := decoded.Content[i+1].Content[j+1]; value.Kind != yaml.MappingNode {
+				env.Content = append(env.Content, decoded.Content[i+1].Content[j], value)
+			}
+		}
+		decoded.Content[i+1] = &env
+	}
+
+	err := decoded.Decode(&Config{})
+	if err == nil {
+		return nil
+	}
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return []Problem{{File: filename, Message: err.Error()}}
+	}
+	problems := []Problem{}
+	for _, e := range typeErr.Errors {
+		problem := Problem{File: filename, Message: e}
+		if match := yamlTypeErrorRegexp.FindStringSubmatch(e); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// Top-level keys of a struct's yaml tags.
+func yamlKeys(t reflect.Type) []string {
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name != "" && name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// Entries of the templates list, for their lines.
+func nodeTemplates(root *yaml.Node) []*yaml.Node {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "templates" && root.Content[i+1].Kind == yaml.SequenceNode {
+			return root.Content[i+1].Content
+		}
+	}
+	return nil
+}
+
+// {{config}} is only replaced in env and labels values, anywhere else it is passed on as is.
+func configPlaceholderProblems(filename string, path string, node *yaml.Node) []Problem {
+	problems := []Problem{}
+	check := func(n *yaml.Node, replaced bool) {
+		for _, match := range configPlaceholderRegexp.FindAllString(n.Value, -1) {
+			if match != "{{config}}" {
+				problems = append(problems, Problem{File: filename, Line: n.Line, Message: match + " is never replaced, write {{config}}"})
+			} else if !replaced {
+				problems = append(problems, Problem{File: filename, Line: n.Line, Message: "{{config}} is only replaced in env and labels values"})
+			}
+		}
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			check(key, false)
+			childPath := key.Value
+			if path != "" {
+				childPath = path + "." + key.Value
+			}
+			if (path == "env" || path == "labels") && value.Kind == yaml.ScalarNode {
+				check(value, true)
+				continue
+			}
+			problems = append(problems, configPlaceholderProblems(filename, childPath, value)...)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			problems = append(problems, configPlaceholderProblems(filename, path, item)...)
+		}
+	case yaml.ScalarNode:
+		check(node, false)
+	}
+	return problems
+}
+
+// Plugins bundled with Discourse, cloned in hooks. Builds fail when they're cloned again.
+func bundledPluginProblems(filename string, root *yaml.Node) []Problem {
+	problems := []Problem{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "hooks" {
+			continue
+		}
+		for _, scalar := range scalarNodes(root.Content[i+1]) {
+			line := scalar.Line
+			// block scalars start on the line after their indicator
+			if scalar.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+				line++
+			}
+			for j, text := range strings.Split(scalar.Value, "\n") {
+				if match := bundledPluginRegexp.FindStringSubmatch(text); match != nil {
+					problems = append(problems, Problem{File: filename, Line: line + j, Message: "the plugin " + match[1] + " is bundled with Discourse, remove this git clone"})
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func scalarNodes(node *yaml.Node) []*yaml.Node {
+	if node.Kind == yaml.ScalarNode {
+		return []*yaml.Node{node}
+	}
+	scalars := []*yaml.Node{}
+	for _, child := range node.Content {
+		scalars = append(scalars, scalarNodes(child)...)
+	}
+	return scalars
+}
+
+// Checks of the merged config, reported where each value was set.
+func (config *Config) validateValues() []Problem {
+	problems := []Problem{}
+	at := func(key string, warning bool, message string) Problem {
+		problem := config.problemAt(key, message)
+		problem.Warning = warning
+		return problem
+	}
+
+	keys := []string{}
+	for k := range config.Env {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if config.HasSecretSource(k) {
+			continue
+		}
+		for _, placeholder := range placeholderValues {
+			if strings.Contains(config.Env[k], placeholder) {
+				problems = append(problems, at("env."+k, false, "env "+k+" is still the example value "+placeholder))
+			}
+		}
+	}
+
+	for _, list := range config.exposeLists() {
+		for i, entry := range list.entries {
+			if _, err := parseExpose(entry); err != nil {
+				problems = append(problems, at(list.key+"["+strconv.Itoa(i)+"]", false, err.Error()))
+			}
+		}
+	}
+
+	for i, v := range config.Volumes {
+		host := v.Volume.Host
+		// other host values name docker volumes
+		if !filepath.IsAbs(host) {
+			continue
+		}
+		if _, err := os.Stat(host); os.IsNotExist(err) {
+			problems = append(problems, at("volumes["+strconv.Itoa(i)+"]", true, "volume host path "+host+" does not exist, docker will create it"))
+		}
+	}
+	return problems
+}
+
+// A problem with a value, where it was set. Values no file set are reported on the config file.
+func (config *Config) problemAt(key string, message string) Problem {
+	problem := Problem{File: config.Name + ".yml", Message: message}
+	if len(config.files) > 0 {
+		problem.File = config.files[len(config.files)-1]
+	}
+	if source := config.Source(key); source != nil {
+		problem.File, problem.Line = source.File, source.Line
+	}
+	return problem
+}
+
+// Host ports an expose entry publishes, none for entries that only expose a container port.
+func parseExpose(entry string) ([]PublishedPort, error) {
+	match := exposeRegexp.FindStringSubmatch(entry)
+	if match == nil {
+		return nil, fmt.Errorf("expose %q is not [[ip:]host port:]container port[/protocol]", entry)
+	}
+	ip, hostPorts, containerPorts, protocol := match[1], match[2], match[3], match[4]
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	hostFirst, hostLast, err := portRange(entry, hostPorts)
+	if err != nil {
+		return nil, err
+	}
+	containerFirst, containerLast, err := portRange(entry, containerPorts)
+	if err != nil {
+		return nil, err
+	}
+	if hostPorts != "" && hostLast-hostFirst != containerLast-containerFirst {
+		return nil, fmt.Errorf("expose %q maps ranges of different lengths", entry)
+	}
+
+	ports := []PublishedPort{}
+	if hostPorts == "" {
+		return ports, nil
+	}
+	for port := hostFirst; port <= hostLast; port++ {
+		ports = append(ports, PublishedPort{Ip: ip, Port: port, Protocol: protocol})
+	}
+	return ports, nil
+}
+
+func portRange(entry string, ports string) (int, int, error) {
+	if ports == "" {
+		return 0, 0, nil
+	}
+	firstValue, lastValue, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		lastValue = firstValue
+	}
+	first, _ := strconv.Atoi(firstValue)
+	last, _ := strconv.Atoi(lastValue)
+	if first < 1 || last > 65535 || last < first {
+		return 0, 0, fmt.Errorf("expose %q has an invalid port %s", entry, ports)
+	}
+	return first, last, nil
+}
+
+// Host ports the config publishes, from expose and blue_green expose.
+func (config *Config) PublishedPorts() []PublishedPort {
+	published := []PublishedPort{}
+	for _, list := range config.exposeLists() {
+		for i, entry := range list.entries {
+			ports, err := parseExpose(entry)
+			if err != nil {
+				continue
+			}
+			source := config.Source(list.key + "[" + strconv.Itoa(i) + "]")
+			for _, port := range ports {
+				if source != nil {
+					port.Source = source.Source
+				}
+				published = append(published, port)
+			}
+		}
+	}
+	return published
+}
+
+type exposeList struct {
+	key     string
+	entries []string
+}
+
+func (config *Config) exposeLists() []exposeList {
+	return []exposeList{{"expose", config.Expose}, {"blue_green.expose", config.BlueGreen.Expose}}
+}
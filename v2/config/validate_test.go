@@ -0,0 +1,140 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"os"
+	"path/filepath"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Validate", func() {
+	var testDir string
+	var confDir string
+
+	var writeConfig = func(name string, content string) string {
+		filename := filepath.Join(testDir, name)
+		os.WriteFile(filename, []byte(content), 0644) //nolint:errcheck
+		return filename
+	}
+
+	var messages = func(problems []config.Problem) []string {
+		result := []string{}
+		for _, p := range problems {
+			result = append(result, p.String())
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		confDir = filepath.Join(testDir, "containers")
+		os.MkdirAll(confDir, 0755)                             //nolint:errcheck
+		os.MkdirAll(filepath.Join(testDir, "templates"), 0755) //nolint:errcheck
+		writeConfig("templates/web.yml", "base_image: discourse/base:release\n")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir) //nolint:errcheck
+	})
+
+	It("passes a valid config", func() {
+		writeConfig("containers/app.yml", `templates:
+  - templates/web.yml
+expose:
+  - "80:80"
+  - "127.0.0.1:8443:443/tcp"
+  - "[::1]:9000-9001:9000-9001"
+  - 5432
+env:
+  DISCOURSE_HOSTNAME: forum.example.org
+labels:
+  app: "{{config}}"
+`)
+		conf, problems := config.Validate(confDir, "app", testDir)
+		Expect(problems).To(BeEmpty())
+		Expect(conf.PublishedPorts()).To(HaveLen(4))
+	})
+
+	It("reports yaml syntax errors with their line", func() {
+		filename := writeConfig("containers/app.yml", "templates:\n  - templates/web.yml\nenv:\n  LANG: [en\n")
+		conf, problems := config.Validate(confDir, "app", testDir)
+		Expect(conf).To(BeNil())
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].File).To(Equal(filename))
+		Expect(problems[0].Line).To(BeNumerically(">", 0))
+	})
+
+	It("reports missing templates and errors in templates", func() {
+		filename := writeConfig("containers/app.yml", "templates:\n  - templates/web.yml\n  - templates/missing.yml\n  - templates/broken.yml\n")
+		template := writeConfig("templates/broken.yml", "expose:\n  http: 80\n")
+		conf, problems := config.Validate(confDir, "app", testDir)
+		Expect(conf).To(BeNil())
+		Expect(messages(problems)).To(ConsistOf(
+			filename+":3: template templates/missing.yml is not in "+testDir,
+			template+":2: cannot unmarshal !!map into []string",
+		))
+	})
+
+	It("reports unknown keys, placeholders, and {{config}} outside env and labels", func() {
+		filename := writeConfig("containers/app.yml", `templates:
+  - templates/web.yml
+enviroment:
+  LANG: en_US.UTF-8
+env:
+  DISCOURSE_HOSTNAME: discourse.example.com
+  REPLACED: "{{ config }}"
+volumes:
+  - volume:
+      host: /var/discourse/shared/{{config}}
+      guest: /shared
+`)
+		conf, problems := config.Validate(confDir, "app", testDir)
+		Expect(conf).ToNot(BeNil())
+		Expect(messages(problems)).To(ConsistOf(
+			filename+":3: unknown key enviroment",
+			filename+":6: env DISCOURSE_HOSTNAME is still the example value discourse.example.com",
+			filename+":7: {{ config }} is never replaced, write {{config}}",
+			filename+":10: {{config}} is only replaced in env and labels values",
+			filename+":9: warning: volume host path /var/discourse/shared/{{config}} does not exist, docker will create it",
+		))
+	})
+
+	It("reports malformed expose entries", func() {
+		filename := writeConfig("containers/app.yml", `templates:
+  - templates/web.yml
+expose:
+  - "80:80"
+  - "http:80"
+  - "70000:80"
+  - "8000-8001:80"
+`)
+		_, problems := config.Validate(confDir, "app", testDir)
+		Expect(messages(problems)).To(ConsistOf(
+			filename+`:5: expose "http:80" is not [[ip:]host port:]container port[/protocol]`,
+			filename+`:6: expose "70000:80" has an invalid port 70000`,
+			filename+`:7: expose "8000-8001:80" maps ranges of different lengths`,
+		))
+	})
+
+	It("reports bundled plugins cloned in hooks", func() {
+		filename := writeConfig("containers/app.yml", `templates:
+  - templates/web.yml
+hooks:
+  after_code:
+    - exec:
+        cd: $home/plugins
+        cmd:
+          - git clone https://github.com/discourse/docker_manager.git
+          #- git clone https://github.com/discourse/discourse-math.git
+          - git clone https://github.com/discourse/discourse-reactions.git
+          - git clone https://github.com/discourse/discourse-math-extras.git
+`)
+		_, problems := config.Validate(confDir, "app", testDir)
+		Expect(messages(problems)).To(ConsistOf(
+			filename + ":10: the plugin discourse-reactions is bundled with Discourse, remove this git clone",
+		))
+	})
+})
@@ -0,0 +1,429 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+const apiVersion = "v1.41"
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// An error response from the Docker Engine API.
+type ApiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ApiError) Error() string {
+	return "docker api error (" + strconv.Itoa(e.StatusCode) + "): " + e.Message
+}
+
+func IsNotFound(err error) bool {
+	var apiErr *ApiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// A container run through the API exited with a non-zero status.
+type ContainerExitError struct {
+	ContainerId string
+	StatusCode  int
+}
+
+func (e *ContainerExitError) Error() string {
+	return "container " + e.ContainerId + " exited with status " + strconv.Itoa(e.StatusCode)
+}
+
+func (e *ContainerExitError) ExitCode() int {
+	return e.StatusCode
+}
+
+// Docker args are translated to API fields, this arg has no translation.
+type UnsupportedArgError struct {
+	Arg string
+}
+
+func (e *UnsupportedArgError) Error() string {
+	return "docker arg '" + e.Arg + "' is not supported by the docker api backend, use --docker-backend=cli"
+}
+
+type ApiBackend struct {
+	network string
+	address string
+	client  *http.Client
+}
+
+// Creates a backend for the Docker Engine API at host, in DOCKER_HOST format.
+// Defaults to the local unix socket.
+func NewApiBackend(host string) (*ApiBackend, error) {
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	b := &ApiBackend{}
+	switch u.Scheme {
+	case "unix":
+		b.network = "unix"
+		b.address = u.Path
+	case "tcp", "http":
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+			return nil, errors.New("TLS docker hosts are not supported by the docker api backend")
+		}
+		b.network = "tcp"
+		b.address = u.Host
+	default:
+		return nil, errors.New("unsupported DOCKER_HOST for the docker api backend: " + host)
+	}
+	b.client = &http.Client{Transport: &http.Transport{DialContext: b.dial}}
+	return b, nil
+}
+
+func (b *ApiBackend) dial(ctx context.Context, _ string, _ string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, b.network, b.address)
+}
+
+func (b *ApiBackend) url(path string, query url.Values) string {
+	u := "http://docker/" + apiVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func apiErrorFromResponse(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	message := struct {
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(body, &message); err != nil || message.Message == "" {
+		message.Message = strings.TrimSpace(string(body))
+	}
+	return &ApiError{StatusCode: resp.StatusCode, Message: message.Message}
+}
+
+func (b *ApiBackend) do(ctx context.Context, method string, path string, query url.Values, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(content)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.url(path, query), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close() //nolint:errcheck
+		return nil, apiErrorFromResponse(resp)
+	}
+	return resp, nil
+}
+
+// Makes an API call, decoding a json response into out when it is not nil.
+func (b *ApiBackend) call(ctx context.Context, method string, path string, query url.Values, body any, out any) error {
+	resp, err := b.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Upgrades an API call to a raw stream, as used by container attach.
+func (b *ApiBackend) hijack(ctx context.Context, path string, query url.Values) (net.Conn, *bufio.Reader, error) {
+	conn, err := b.dial(ctx, b.network, b.address)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, b.url(path, query), nil)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close() //nolint:errcheck
+		return nil, nil, apiErrorFromResponse(resp)
+	}
+	return conn, reader, nil
+}
+
+// Splits a multiplexed stream of a container without a tty into stdout and stderr.
+func demuxStream(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *ApiBackend) ContainerState(ctx context.Context, container string) (*ContainerState, error) {
+	filters, _ := json.Marshal(map[string][]string{"name": {"^" + regexp.QuoteMeta(container) + "$"}})
+	query := url.Values{"all": {"1"}, "filters": {string(filters)}}
+	result := []struct {
+		Id      string
+		Names   []string
+		Image   string
+		State   string
+		Status  string
+		Created int64
+	}{}
+	if err := b.call(ctx, http.MethodGet, "/containers/json", query, nil, &result); err != nil {
+		return nil, err
+	}
+	for _, c := range result {
+		if !slices.Contains(c.Names, "/"+container) {
+			continue
+		}
+		return &ContainerState{
+			Id:      c.Id,
+			Name:    container,
+			Image:   c.Image,
+			Status:  c.Status,
+			Created: time.Unix(c.Created, 0),
+			Running: c.State == "running" || c.State == "paused" || c.State == "restarting",
+		}, nil
+	}
+	return nil, nil
+}
+
+func (b *ApiBackend) Start(ctx context.Context, container string, attach bool) error {
+	if !attach {
+		return b.call(ctx, http.MethodPost, "/containers/"+container+"/start", nil, nil, nil)
+	}
+	return b.runAttached(ctx, container, os.Stdin, utils.Stdout, utils.Stderr, false)
+}
+
+func (b *ApiBackend) Stop(ctx context.Context, container string, timeout time.Duration) error {
+	query := url.Values{"t": {strconv.Itoa(int(timeout.Seconds()))}}
+	return b.call(ctx, http.MethodPost, "/containers/"+container+"/stop", query, nil, nil)
+}
+
+func (b *ApiBackend) Remove(ctx context.Context, container string, force bool) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "1")
+	}
+	return b.call(ctx, http.MethodDelete, "/containers/"+container, query, nil, nil)
+}
+
+func (b *ApiBackend) Rename(ctx context.Context, container string, name string) error {
+	return b.call(ctx, http.MethodPost, "/containers/"+container+"/rename", url.Values{"name": {name}}, nil, nil)
+}
+
+// Splits an image reference into repository and tag, defaulting to latest.
+func splitImageTag(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+func (b *ApiBackend) Commit(ctx context.Context, container string, image string, changes []string) error {
+	repo, tag := splitImageTag(image)
+	query := url.Values{"container": {container}, "repo": {repo}, "tag": {tag}}
+	for _, change := range changes {
+		query.Add("changes", change)
+	}
+	return b.call(ctx, http.MethodPost, "/commit", query, nil, nil)
+}
+
+func (b *ApiBackend) Logs(ctx context.Context, container string, w io.Writer) error {
+	query := url.Values{"stdout": {"1"}, "stderr": {"1"}}
+	resp, err := b.do(ctx, http.MethodGet, "/containers/"+container+"/logs", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	return demuxStream(resp.Body, w, w)
+}
+
+func (b *ApiBackend) Prune(ctx context.Context, until string) error {
+	filters, _ := json.Marshal(map[string][]string{"until": {until}})
+	if err := b.call(ctx, http.MethodPost, "/containers/prune", url.Values{"filters": {string(filters)}}, nil, nil); err != nil {
+		return err
+	}
+	// images launcher built are kept while they're tagged, so previous images can be rolled back to
+	filters, _ = json.Marshal(map[string][]string{"until": {until}, "dangling": {"false"}, "label!": {config.BuildHashLabel}})
+	if err := b.call(ctx, http.MethodPost, "/images/prune", url.Values{"filters": {string(filters)}}, nil, nil); err != nil {
+		return err
+	}
+	filters, _ = json.Marshal(map[string][]string{"until": {until}})
+	return b.call(ctx, http.MethodPost, "/images/prune", url.Values{"filters": {string(filters)}}, nil, nil)
+}
+
+// Pulls an image, like docker run does when an image is missing.
+func (b *ApiBackend) pull(ctx context.Context, image string) error {
+	repo, tag := splitImageTag(image)
+	resp, err := b.do(ctx, http.MethodPost, "/images/create", url.Values{"fromImage": {repo}, "tag": {tag}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		message := struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}{}
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if message.Error != "" {
+			return errors.New("pulling " + image + ": " + message.Error)
+		}
+	}
+}
+
+func (b *ApiBackend) Run(ctx context.Context, r *DockerRunner) error {
+	create, err := r.containerCreateRequest()
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	if r.ContainerId != "" {
+		query.Set("name", r.ContainerId)
+	}
+	created := struct{ Id string }{}
+	err = b.call(ctx, http.MethodPost, "/containers/create", query, create, &created)
+	if IsNotFound(err) {
+		if err := b.pull(ctx, create.Image); err != nil {
+			return err
+		}
+		err = b.call(ctx, http.MethodPost, "/containers/create", query, create, &created)
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.Detatch {
+		return b.call(ctx, http.MethodPost, "/containers/"+created.Id+"/start", nil, nil, nil)
+	}
+	return b.runAttached(ctx, created.Id, r.Stdin, r.stdout(), r.stderr(), r.Rm)
+}
+
+// Attaches to, starts, and waits on a container. Stdin is closed once copied so
+// the container sees EOF. Interrupting stops the container.
+func (b *ApiBackend) runAttached(ctx context.Context, container string, stdin io.Reader, stdout io.Writer, stderr io.Writer, rm bool) error {
+	attachQuery := url.Values{"stream": {"1"}, "stdin": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+	conn, reader, err := b.hijack(ctx, "/containers/"+container+"/attach", attachQuery)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if rm {
+		defer func() {
+			runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := b.Remove(runCtx, container, true); err != nil && !IsNotFound(err) {
+				fmt.Fprintln(utils.Out, "Error removing container "+container) //nolint:errcheck
+			}
+			cancel()
+		}()
+	}
+
+	if err := b.call(ctx, http.MethodPost, "/containers/"+container+"/start", nil, nil, nil); err != nil {
+		return err
+	}
+
+	go func() {
+		if stdin != nil {
+			io.Copy(conn, stdin) //nolint:errcheck
+		}
+		if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite() //nolint:errcheck
+		}
+	}()
+
+	streamDone := make(chan error, 1)
+	go func() {
+		streamDone <- demuxStream(reader, stdout, stderr)
+	}()
+
+	select {
+	case err := <-streamDone:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := b.Stop(runCtx, container, 10*time.Second); err != nil {
+			fmt.Fprintln(utils.Out, "Error stopping container "+container) //nolint:errcheck
+		}
+		cancel()
+		return ctx.Err()
+	}
+
+	result := struct {
+		StatusCode int
+	}{}
+	if err := b.call(ctx, http.MethodPost, "/containers/"+container+"/wait", url.Values{"condition": {"not-running"}}, nil, &result); err != nil {
+		return err
+	}
+	if result.StatusCode != 0 {
+		return &ContainerExitError{ContainerId: container, StatusCode: result.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package docker
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type apiPortBinding struct {
+	HostIp   string `json:"HostIp,omitempty"`
+	HostPort string `json:"HostPort"`
+}
+
+type apiRestartPolicy struct {
+	Name              string `json:"Name"`
+	MaximumRetryCount int    `json:"MaximumRetryCount,omitempty"`
+}
+
+type apiLogConfig struct {
+	Type   string            `json:"Type,omitempty"`
+	Config map[string]string `json:"Config,omitempty"`
+}
+
+type apiHostConfig struct {
+	Binds         []string                    `json:"Binds,omitempty"`
+	Links         []string                    `json:"Links,omitempty"`
+	PortBindings  map[string][]apiPortBinding `json:"PortBindings,omitempty"`
+	ShmSize       int64                       `json:"ShmSize,omitempty"`
+	RestartPolicy apiRestartPolicy            `json:"RestartPolicy"`
+	NetworkMode   string                      `json:"NetworkMode,omitempty"`
+	ExtraHosts    []string                    `json:"ExtraHosts,omitempty"`
+	CapAdd        []string                    `json:"CapAdd,omitempty"`
+	CapDrop       []string                    `json:"CapDrop,omitempty"`
+	Dns           []string                    `json:"Dns,omitempty"`
+	Privileged    bool                        `json:"Privileged,omitempty"`
+	LogConfig     *apiLogConfig               `json:"LogConfig,omitempty"`
+}
+
+type apiContainerCreate struct {
+	Hostname     string              `json:"Hostname,omitempty"`
+	User         string              `json:"User,omitempty"`
+	MacAddress   string              `json:"MacAddress,omitempty"`
+	AttachStdin  bool                `json:"AttachStdin"`
+	AttachStdout bool                `json:"AttachStdout"`
+	AttachStderr bool                `json:"AttachStderr"`
+	OpenStdin    bool                `json:"OpenStdin"`
+	StdinOnce    bool                `json:"StdinOnce"`
+	Env          []string            `json:"Env"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Image        string              `json:"Image"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   apiHostConfig       `json:"HostConfig"`
+}
+
+const shmSize = 512 * 1024 * 1024
+
+// Sets an env entry, replacing an existing entry for the same key. Entries
+// without a value are taken from the launcher's environment, as docker run does.
+func setEnv(env []string, entry string) []string {
+	key, _, found := strings.Cut(entry, "=")
+	if !found {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			return env
+		}
+		entry = key + "=" + value
+	}
+	for i, e := range env {
+		if k, _, _ := strings.Cut(e, "="); k == key {
+			env[i] = entry
+			return env
+		}
+	}
+	return append(env, entry)
+}
+
+// Parses a port in docker --publish or --expose format, eg "80", "8080:80/tcp" or "127.0.0.1:8080:80".
+func parsePortSpec(spec string) (string, *apiPortBinding, error) {
+	proto := "tcp"
+	if p, found := strings.CutSuffix(spec, "/udp"); found {
+		spec, proto = p, "udp"
+	} else if p, found := strings.CutSuffix(spec, "/tcp"); found {
+		spec = p
+	}
+	if strings.Contains(spec, "-") {
+		return "", nil, errors.New("port ranges are not supported by the docker api backend: " + spec)
+	}
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return spec + "/" + proto, nil, nil
+	}
+	containerPort := spec[i+1:] + "/" + proto
+	host := spec[:i]
+	binding := &apiPortBinding{HostPort: host}
+	if j := strings.LastIndex(host, ":"); j >= 0 {
+		binding.HostIp = strings.Trim(host[:j], "[]")
+		binding.HostPort = host[j+1:]
+	}
+	return containerPort, binding, nil
+}
+
+func (c *apiContainerCreate) addPort(spec string, publish bool) error {
+	port, binding, err := parsePortSpec(spec)
+	if err != nil {
+		return err
+	}
+	c.ExposedPorts[port] = struct{}{}
+	if publish {
+		if binding == nil {
+			binding = &apiPortBinding{}
+		}
+		c.HostConfig.PortBindings[port] = append(c.HostConfig.PortBindings[port], *binding)
+	}
+	return nil
+}
+
+func parseRestartPolicy(policy string) apiRestartPolicy {
+	name, count, _ := strings.Cut(policy, ":")
+	maxRetries, _ := strconv.Atoi(count)
+	return apiRestartPolicy{Name: name, MaximumRetryCount: maxRetries}
+}
+
+// Translates docker run flags in docker_args and extra flags to API fields.
+// Only a common subset of flags is supported.
+func (c *apiContainerCreate) applyDockerArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--privileged" {
+			c.HostConfig.Privileged = true
+			continue
+		}
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue {
+			if i+1 >= len(args) || !strings.HasPrefix(name, "-") {
+				return &UnsupportedArgError{Arg: arg}
+			}
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "--network", "--net":
+			c.HostConfig.NetworkMode = value
+		case "--add-host":
+			c.HostConfig.ExtraHosts = append(c.HostConfig.ExtraHosts, value)
+		case "-e", "--env":
+			c.Env = setEnv(c.Env, value)
+		case "-l", "--label":
+			k, v, _ := strings.Cut(value, "=")
+			c.Labels[k] = v
+		case "-v", "--volume":
+			c.HostConfig.Binds = append(c.HostConfig.Binds, value)
+		case "--link":
+			c.HostConfig.Links = append(c.HostConfig.Links, value)
+		case "-p", "--publish":
+			if err := c.addPort(value, true); err != nil {
+				return err
+			}
+		case "--expose":
+			if err := c.addPort(value, false); err != nil {
+				return err
+			}
+		case "-h", "--hostname":
+			c.Hostname = value
+		case "-u", "--user":
+			c.User = value
+		case "--mac-address":
+			c.MacAddress = value
+		case "--cap-add":
+			c.HostConfig.CapAdd = append(c.HostConfig.CapAdd, value)
+		case "--cap-drop":
+			c.HostConfig.CapDrop = append(c.HostConfig.CapDrop, value)
+		case "--dns":
+			c.HostConfig.Dns = append(c.HostConfig.Dns, value)
+		case "--restart":
+			c.HostConfig.RestartPolicy = parseRestartPolicy(value)
+		case "--log-driver":
+			if c.HostConfig.LogConfig == nil {
+				c.HostConfig.LogConfig = &apiLogConfig{}
+			}
+			c.HostConfig.LogConfig.Type = value
+		case "--log-opt":
+			if c.HostConfig.LogConfig == nil {
+				c.HostConfig.LogConfig = &apiLogConfig{}
+			}
+			if c.HostConfig.LogConfig.Config == nil {
+				c.HostConfig.LogConfig.Config = map[string]string{}
+			}
+			k, v, _ := strings.Cut(value, "=")
+			c.HostConfig.LogConfig.Config[k] = v
+		default:
+			return &UnsupportedArgError{Arg: name}
+		}
+	}
+	return nil
+}
+
+// The API equivalent of the runner's docker run command.
+func (r *DockerRunner) containerCreateRequest() (*apiContainerCreate, error) {
+	c := &apiContainerCreate{
+		AttachStdin:  !r.Detatch,
+		AttachStdout: !r.Detatch,
+		AttachStderr: !r.Detatch,
+		OpenStdin:    true,
+		StdinOnce:    !r.Detatch,
+		Env:          []string{},
+		Cmd:          r.Cmd,
+		Image:        r.image(),
+		Labels:       map[string]string{},
+		ExposedPorts: map[string]struct{}{},
+		HostConfig: apiHostConfig{
+			PortBindings: map[string][]apiPortBinding{},
+			ShmSize:      shmSize,
+			RestartPolicy: apiRestartPolicy{
+				Name: "no",
+			},
+		},
+	}
+
+	envKeys := make([]string, 0, len(r.Config.Env))
+	for envKey := range r.Config.Env {
+		envKeys = append(envKeys, envKey)
+	}
+	sort.Strings(envKeys)
+	for _, envKey := range envKeys {
+		value, err := r.Config.EnvValue(envKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Env = setEnv(c.Env, envKey+"="+value)
+	}
+	// Order is important here, we add extra env after config's env to override anything set in env.
+	for _, e := range r.ExtraEnv {
+		c.Env = setEnv(c.Env, e)
+	}
+
+	for k, v := range r.Config.Labels {
+		c.Labels[k] = v
+	}
+
+	if !r.SkipPorts {
+		for _, v := range r.Config.Expose {
+			if err := c.addPort(v, strings.Contains(v, ":")); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, v := range r.Config.Volumes {
+		c.HostConfig.Binds = append(c.HostConfig.Binds, v.Volume.Host+":"+v.Volume.Guest)
+	}
+
+	for _, v := range r.Config.Links {
+		c.HostConfig.Links = append(c.HostConfig.Links, v.Link.Name+":"+v.Link.Alias)
+	}
+
+	if r.Restart {
+		c.HostConfig.RestartPolicy.Name = "always"
+	}
+
+	// Docker args override settings above
+	if err := c.applyDockerArgs(r.Config.GetDockerArgs()); err != nil {
+		return nil, err
+	}
+	if err := c.applyDockerArgs(r.ExtraFlags); err != nil {
+		return nil, err
+	}
+
+	if r.Hostname != "" {
+		c.Hostname = r.Hostname
+	}
+
+	return c, nil
+}
@@ -0,0 +1,241 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Writes a frame of a multiplexed container stream
+func writeFrame(w io.Writer, stream byte, content []byte) {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(content)))
+	w.Write(header)  //nolint:errcheck
+	w.Write(content) //nolint:errcheck
+}
+
+var _ = Describe("ApiBackend", func() {
+	var socketDir string
+	var server *http.Server
+	var mux *http.ServeMux
+	var backend *docker.ApiBackend
+	var ctx context.Context
+	var requests []string
+
+	BeforeEach(func() {
+		utils.Out = &bytes.Buffer{}
+		ctx = context.Background()
+		requests = []string{}
+		socketDir, _ = os.MkdirTemp("", "ddocker-test")
+		socket := filepath.Join(socketDir, "docker.sock")
+		listener, err := net.Listen("unix", socket)
+		Expect(err).To(BeNil())
+
+		mux = http.NewServeMux()
+		server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			mux.ServeHTTP(w, r)
+		})}
+		go server.Serve(listener) //nolint:errcheck
+
+		backend, err = docker.NewApiBackend("unix://" + socket)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		server.Close()          //nolint:errcheck
+		os.RemoveAll(socketDir) //nolint:errcheck
+	})
+
+	It("rejects unsupported docker hosts", func() {
+		_, err := docker.NewApiBackend("ssh://user@host")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("looks up container state by exact name", func() {
+		mux.HandleFunc("GET /v1.41/containers/json", func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Query().Get("all")).To(Equal("1"))
+			Expect(r.URL.Query().Get("filters")).To(Equal(`{"name":["^app$"]}`))
+			w.Write([]byte(`[{"Id":"def","Names":["/web/app"],"State":"running"},{"Id":"abc","Names":["/app"],"Image":"local_discourse/app","State":"exited","Status":"Exited (0) 1 minute ago","Created":1791972000}]`)) //nolint:errcheck
+		})
+		state, err := backend.ContainerState(ctx, "app")
+		Expect(err).To(BeNil())
+		Expect(state.Id).To(Equal("abc"))
+		Expect(state.Image).To(Equal("local_discourse/app"))
+		Expect(state.Running).To(BeFalse())
+		Expect(state.Created.Unix()).To(Equal(int64(1791972000)))
+	})
+
+	It("returns no state for missing containers", func() {
+		mux.HandleFunc("GET /v1.41/containers/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[]`)) //nolint:errcheck
+		})
+		state, err := backend.ContainerState(ctx, "app")
+		Expect(err).To(BeNil())
+		Expect(state).To(BeNil())
+	})
+
+	It("inspects containers, and returns nil for missing images", func() {
+		mux.HandleFunc("GET /v1.41/containers/abc/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"abc","Image":"sha256:1","RestartCount":3,"Config":{"Env":["A=1"]}}`)) //nolint:errcheck
+		})
+		mux.HandleFunc("GET /v1.41/images/local_discourse/app/json", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such image: local_discourse/app"}`)) //nolint:errcheck
+		})
+		container, err := backend.InspectContainer(ctx, "abc")
+		Expect(err).To(BeNil())
+		Expect(container.RestartCount).To(Equal(3))
+		Expect(container.EnvMap()).To(Equal(map[string]string{"A": "1"}))
+		image, err := backend.InspectImage(ctx, "local_discourse/app")
+		Expect(err).To(BeNil())
+		Expect(image).To(BeNil())
+	})
+
+	It("returns typed errors", func() {
+		mux.HandleFunc("POST /v1.41/containers/app/stop", func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Query().Get("t")).To(Equal("600"))
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such container: app"}`)) //nolint:errcheck
+		})
+		err := backend.Stop(ctx, "app", 600*time.Second)
+		Expect(docker.IsNotFound(err)).To(BeTrue())
+		Expect(err).To(MatchError("docker api error (404): No such container: app"))
+	})
+
+	It("commits containers with changes", func() {
+		mux.HandleFunc("POST /v1.41/commit", func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			Expect(query.Get("container")).To(Equal("discourse-build-test"))
+			Expect(query.Get("repo")).To(Equal("local_discourse/test"))
+			Expect(query.Get("tag")).To(Equal("latest"))
+			Expect(query["changes"]).To(Equal([]string{`CMD ["/sbin/boot"]`}))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"sha256:123"}`)) //nolint:errcheck
+		})
+		Expect(backend.Commit(ctx, "discourse-build-test", "local_discourse/test", []string{`CMD ["/sbin/boot"]`})).To(Succeed())
+	})
+
+	It("lists and tags images of a repository", func() {
+		mux.HandleFunc("GET /v1.41/images/json", func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Query().Get("filters")).To(Equal(`{"reference":["local_discourse/app"]}`))
+			w.Write([]byte(`[{"Id":"sha256:1","RepoTags":["local_discourse/app:latest","other/app:latest"]},{"Id":"sha256:2","RepoTags":["local_discourse/app:previous"]}]`)) //nolint:errcheck
+		})
+		mux.HandleFunc("POST /v1.41/images/sha256:2/tag", func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Query().Get("repo")).To(Equal("local_discourse/app"))
+			Expect(r.URL.Query().Get("tag")).To(Equal("20261017-120000"))
+			w.WriteHeader(http.StatusCreated)
+		})
+		tags, err := backend.ImageTags(ctx, "local_discourse/app")
+		Expect(err).To(BeNil())
+		Expect(tags).To(Equal(map[string]string{"latest": "sha256:1", "previous": "sha256:2"}))
+		Expect(backend.TagImage(ctx, "sha256:2", "local_discourse/app:20261017-120000")).To(Succeed())
+	})
+
+	It("demultiplexes logs", func() {
+		mux.HandleFunc("GET /v1.41/containers/app/logs", func(w http.ResponseWriter, r *http.Request) {
+			writeFrame(w, 1, []byte("out\n"))
+			writeFrame(w, 2, []byte("err\n"))
+		})
+		out := &bytes.Buffer{}
+		Expect(backend.Logs(ctx, "app", out)).To(Succeed())
+		Expect(out.String()).To(Equal("out\nerr\n"))
+	})
+
+	Context("running containers", func() {
+		var conf *config.Config
+		var created map[string]any
+
+		BeforeEach(func() {
+			conf = &config.Config{
+				Name:       "test",
+				Env:        map[string]string{"A": "1", "B": "2"},
+				Expose:     []string{"8080:80", "90"},
+				DockerArgs: "--network=discourse --add-host host.docker.internal:host-gateway",
+			}
+			created = map[string]any{}
+			docker.Backend = backend
+			mux.HandleFunc("POST /v1.41/containers/create", func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Query().Get("name")).To(Equal("test"))
+				json.NewDecoder(r.Body).Decode(&created) //nolint:errcheck
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"Id":"abc"}`)) //nolint:errcheck
+			})
+			mux.HandleFunc("POST /v1.41/containers/abc/start", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+			mux.HandleFunc("POST /v1.41/containers/abc/attach", func(w http.ResponseWriter, r *http.Request) {
+				conn, buf, _ := w.(http.Hijacker).Hijack()
+				buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n") //nolint:errcheck
+				buf.Flush()                                                                                                                                //nolint:errcheck
+				// echo stdin back on stdout
+				stdin, _ := io.ReadAll(buf.Reader)
+				writeFrame(conn, 1, stdin)
+				conn.Close() //nolint:errcheck
+			})
+			mux.HandleFunc("POST /v1.41/containers/abc/wait", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"StatusCode":77}`)) //nolint:errcheck
+			})
+			mux.HandleFunc("DELETE /v1.41/containers/abc", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+		})
+
+		AfterEach(func() {
+			docker.Backend = &docker.CliBackend{}
+		})
+
+		It("creates and starts detached containers", func() {
+			runner := docker.DockerRunner{Config: conf, ContainerId: "test", Detatch: true, Restart: true, ExtraEnv: []string{"B=3"}, Cmd: []string{"/sbin/boot"}}
+			Expect(runner.Run(ctx)).To(Succeed())
+			Expect(requests).To(Equal([]string{"POST /v1.41/containers/create", "POST /v1.41/containers/abc/start"}))
+
+			Expect(created["Image"]).To(Equal("local_discourse/test"))
+			Expect(created["Env"]).To(Equal([]any{"A=1", "B=3"}))
+			Expect(created["Cmd"]).To(Equal([]any{"/sbin/boot"}))
+			hostConfig := created["HostConfig"].(map[string]any)
+			Expect(hostConfig["NetworkMode"]).To(Equal("discourse"))
+			Expect(hostConfig["ExtraHosts"]).To(Equal([]any{"host.docker.internal:host-gateway"}))
+			Expect(hostConfig["RestartPolicy"]).To(HaveKeyWithValue("Name", "always"))
+			Expect(hostConfig["PortBindings"]).To(HaveKeyWithValue("80/tcp", []any{map[string]any{"HostPort": "8080"}}))
+			Expect(created["ExposedPorts"]).To(HaveKey("90/tcp"))
+		})
+
+		It("streams stdin and output, and reports the exit status", func() {
+			out := &bytes.Buffer{}
+			runner := docker.DockerRunner{Config: conf, ContainerId: "test", Rm: true, SkipPorts: true, Stdin: strings.NewReader("pups config"), Stdout: out}
+			err := runner.Run(ctx)
+
+			var exitErr *docker.ContainerExitError
+			Expect(err).To(BeAssignableToTypeOf(exitErr))
+			Expect(err.(*docker.ContainerExitError).ExitCode()).To(Equal(77))
+			Expect(out.String()).To(Equal("pups config"))
+			Expect(created["HostConfig"]).ToNot(HaveKey("PortBindings"))
+			Expect(requests).To(ContainElement("DELETE /v1.41/containers/abc"))
+		})
+
+		It("refuses docker args it cannot translate", func() {
+			conf.DockerArgs = "--cpuset-cpus 0-3"
+			runner := docker.DockerRunner{Config: conf, ContainerId: "test", Detatch: true}
+			err := runner.Run(ctx)
+			Expect(err).To(MatchError(&docker.UnsupportedArgError{Arg: "--cpuset-cpus"}))
+			Expect(requests).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,192 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Container operations, implemented either by shelling out to the docker CLI
+// or by talking to the Docker Engine API directly.
+type IBackend interface {
+	// Returns nil when no container has exactly this name.
+	ContainerState(ctx context.Context, container string) (*ContainerState, error)
+	// Returns nil when the container or image does not exist.
+	InspectContainer(ctx context.Context, container string) (*ContainerInspect, error)
+	InspectImage(ctx context.Context, image string) (*ImageInspect, error)
+	Run(ctx context.Context, r *DockerRunner) error
+	Start(ctx context.Context, container string, attach bool) error
+	Stop(ctx context.Context, container string, timeout time.Duration) error
+	Remove(ctx context.Context, container string, force bool) error
+	Rename(ctx context.Context, container string, name string) error
+	Commit(ctx context.Context, container string, image string, changes []string) error
+	TagImage(ctx context.Context, image string, tag string) error
+	RemoveImage(ctx context.Context, image string) error
+	// Tags of images in a repository, mapped to image ids.
+	ImageTags(ctx context.Context, repo string) (map[string]string, error)
+	Logs(ctx context.Context, container string, w io.Writer) error
+	// Runs a command in a running container, discarding its output. Fails when it exits non-zero.
+	Exec(ctx context.Context, container string, command []string) error
+	Prune(ctx context.Context, until string) error
+}
+
+type ContainerState struct {
+	Id      string
+	Name    string
+	Image   string
+	Status  string
+	Created time.Time
+	Running bool
+}
+
+var Backend IBackend = &CliBackend{}
+
+// Returns the backend selected by name, either "cli" or "api".
+// The api backend honors DOCKER_HOST, and only drives docker.
+func NewBackend(name string) (IBackend, error) {
+	switch name {
+	case "", "cli":
+		return &CliBackend{}, nil
+	case "api":
+		if Runtime.Name() != "docker" {
+			return nil, errors.New("the api backend only supports the docker runtime")
+		}
+		return NewApiBackend(os.Getenv("DOCKER_HOST"))
+	}
+	return nil, errors.New("unknown docker backend: " + name)
+}
+
+type CliBackend struct{}
+
+// Lists containers matching the exact name, the name filter on its own is a regex match.
+func (b *CliBackend) ContainerState(ctx context.Context, container string) (*ContainerState, error) {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "ps", "--all", "--no-trunc",
+		"--filter", "name=^"+regexp.QuoteMeta(container)+"$",
+		"--format", "{{.ID}}\t{{.Names}}\t{{.Image}}\t{{.Status}}\t{{.CreatedAt}}")
+	result, err := utils.CmdRunner(cmd).Output()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(result), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		// linked containers are also listed under their alias, eg "app/data"
+		if !slices.Contains(strings.Split(fields[1], ","), container) {
+			continue
+		}
+		// podman includes fractional seconds
+		created, _ := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", fields[4])
+		return &ContainerState{
+			Id:      fields[0],
+			Name:    container,
+			Image:   fields[2],
+			Status:  fields[3],
+			Created: created,
+			Running: strings.HasPrefix(fields[3], "Up") || strings.HasPrefix(fields[3], "Restarting"),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (b *CliBackend) Run(ctx context.Context, r *DockerRunner) error {
+	cmd, err := r.command(ctx)
+	if err != nil {
+		return err
+	}
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (b *CliBackend) Start(ctx context.Context, container string, attach bool) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "start", container)
+
+	if attach {
+		TimeoutDockerContainer(cmd, container)
+		cmd.Args = append(cmd.Args, "--attach")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = utils.Stdout
+		cmd.Stderr = utils.Stderr
+	}
+
+	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (b *CliBackend) Stop(ctx context.Context, container string, timeout time.Duration) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "stop", "--time", strconv.Itoa(int(timeout.Seconds())), container)
+	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (b *CliBackend) Remove(ctx context.Context, container string, force bool) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "rm")
+	if force {
+		cmd.Args = append(cmd.Args, "--force")
+	}
+	cmd.Args = append(cmd.Args, container)
+	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (b *CliBackend) Rename(ctx context.Context, container string, name string) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "rename", container, name)
+	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	return utils.CmdRunner(cmd).Run()
+}
+
+// Commits are not tied to the context, an interrupted commit leaves a partial image behind.
+func (b *CliBackend) Commit(ctx context.Context, container string, image string, changes []string) error {
+	cmd := exec.Command(utils.DockerPath, "commit")
+	for _, change := range changes {
+		cmd.Args = append(cmd.Args, "--change", change)
+	}
+	cmd.Args = append(cmd.Args, container, image)
+
+	cmd.Stdout = utils.Stdout
+	cmd.Stderr = utils.Stderr
+
+	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (b *CliBackend) Logs(ctx context.Context, container string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "logs", container)
+	output, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
+
+func (b *CliBackend) Prune(ctx context.Context, until string) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "container", "prune", "--filter", "until="+until)
+
+	if err := utils.CmdRunner(cmd).Run(); err != nil {
+		return err
+	}
+
+	// images launcher built are kept while they're tagged, so previous images can be rolled back to
+	cmd = exec.CommandContext(ctx, utils.DockerPath, "image", "prune", "--all", "--filter", "until="+until, "--filter", "label!="+config.BuildHashLabel)
+	if err := utils.CmdRunner(cmd).Run(); err != nil {
+		return err
+	}
+
+	cmd = exec.CommandContext(ctx, utils.DockerPath, "image", "prune", "--filter", "until="+until)
+	return utils.CmdRunner(cmd).Run()
+}
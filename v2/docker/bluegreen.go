@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+// rebuild --blue-green alternates containers between two slots, so the new container can
+// publish its ports while the old one still holds the other slot's. Blue containers
+// publish expose, green ones blue_green expose. Containers without the label are blue.
+const SlotLabel = "org.discourse.launcher.slot"
+
+const (
+	SlotBlue  = "blue"
+	SlotGreen = "green"
+)
+
+// The slot a container is in.
+func ContainerSlot(container *ContainerInspect) string {
+	if container != nil && container.Config.Labels[SlotLabel] == SlotGreen {
+		return SlotGreen
+	}
+	return SlotBlue
+}
+
+// The other slot, for the next container.
+func OtherSlot(slot string) string {
+	if slot == SlotGreen {
+		return SlotBlue
+	}
+	return SlotGreen
+}
+
+// Ports containers in a slot expose.
+func SlotExpose(conf *config.Config, slot string) []string {
+	if slot == SlotGreen {
+		return conf.BlueGreen.Expose
+	}
+	return conf.Expose
+}
+
+// Whether the old and new containers can run side by side: their published host ports can't overlap.
+func CheckBlueGreen(conf *config.Config) error {
+	if _, ports := dockerArgsBindings(conf); len(ports) > 0 {
+		return errors.New("--blue-green can't publish ports from docker_args, as both containers would bind them. Move them to expose")
+	}
+	blue := publishedHostPorts(conf.Expose)
+	green := publishedHostPorts(conf.BlueGreen.Expose)
+	if len(blue) > 0 && len(conf.BlueGreen.Expose) == 0 {
+		return errors.New("--blue-green needs alternate host ports for the ports in expose, set blue_green: expose: in the config")
+	}
+	for _, port := range blue {
+		for _, other := range green {
+			if port == other {
+				return errors.New("--blue-green needs different host ports in expose and blue_green expose, both publish " + port)
+			}
+		}
+	}
+	return nil
+}
+
+// Host ports published by expose entries, like 8080 in 127.0.0.1:8080:80.
+func publishedHostPorts(expose []string) []string {
+	ports := []string{}
+	for _, p := range expose {
+		if !strings.Contains(p, ":") {
+			continue
+		}
+		spec := normalizePort(p)
+		host := spec[:strings.LastIndex(spec, ":")]
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[i+1:]
+		}
+		ports = append(ports, host)
+	}
+	return ports
+}
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+const (
+	// Builds from scratch with a freshly pulled base image.
+	CacheNone = "none"
+	// Reuses layers the runtime cached locally, and the cache in Dir when set. The base image
+	// is only pulled when missing, so builds work offline.
+	CacheLocal = "local"
+	// Imports the cache from Ref and exports it back, for hosts building the same sites.
+	CacheRegistry = "registry"
+)
+
+// How builds use the build cache.
+type CachePolicy struct {
+	Mode string
+	// Directory of a BuildKit local cache, one for each site
+	Dir string
+	// Repository of a registry cache, tagged with the site's config name on BuildKit runtimes
+	Ref string
+}
+
+var Cache = CachePolicy{Mode: CacheNone}
+
+// Build flags for the cache policy. Cached builds of the pups step are keyed on the config's
+// BuildHash and the base image digest, so they are not reused once either changes.
+func (p CachePolicy) buildFlags(ctx context.Context, conf *config.Config) ([]string, error) {
+	if p.Mode == "" || p.Mode == CacheNone {
+		return []string{"--no-cache", "--pull"}, nil
+	}
+	if p.Mode != CacheLocal && p.Mode != CacheRegistry {
+		return nil, errors.New("unknown cache policy: " + p.Mode)
+	}
+	if p.Mode == CacheRegistry && p.Ref == "" {
+		return nil, errors.New("--cache=registry needs --cache-ref, the repository to keep the cache in")
+	}
+	key, err := cacheKey(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	flags := []string{"--build-arg", config.CacheKeyArg + "=" + key}
+	if p.Mode == CacheRegistry {
+		flags = append(flags, "--pull")
+	} else if p.Dir != "" {
+		if err := pruneCacheDir(filepath.Join(p.Dir, conf.Name), key); err != nil {
+			return nil, err
+		}
+	}
+	cacheFlags, err := Runtime.BuildCacheFlags(p, conf.Name, key)
+	if err != nil {
+		return nil, err
+	}
+	return append(flags, cacheFlags...), nil
+}
+
+func cacheKey(ctx context.Context, conf *config.Config) (string, error) {
+	base := conf.BaseImage
+	image, err := Backend.InspectImage(ctx, conf.BaseImage)
+	if err != nil {
+		return "", err
+	}
+	// a base image that isn't pulled yet is keyed on its name, like the build that pulls it
+	if image != nil && len(image.RepoDigests) > 0 {
+		base = image.RepoDigests[0]
+	} else if image != nil {
+		base = image.Id
+	}
+	sum := sha256.Sum256([]byte(conf.BuildHash() + "\n" + base))
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// Removes a site's local caches of other keys, which no build reads again.
+func pruneCacheDir(dir string, key string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() != key {
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Cache flags of BuildKit builds. Exporting caches needs a builder that supports it, like a
+// docker-container buildx builder or the containerd image store.
+func buildkitCacheFlags(p CachePolicy, name string, key string) []string {
+	if p.Mode == CacheRegistry {
+		ref := "type=registry,ref=" + p.Ref + ":" + name
+		return []string{"--cache-from", ref, "--cache-to", ref + ",mode=max"}
+	}
+	if p.Dir == "" {
+		return []string{}
+	}
+	dir := filepath.Join(p.Dir, name, key)
+	return []string{"--cache-from", "type=local,src=" + dir, "--cache-to", "type=local,dest=" + dir + ",mode=max"}
+}
@@ -0,0 +1,135 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Cache", func() {
+	var conf *config.Config
+	var cacheDir string
+	var ctx context.Context
+
+	var build = func() (string, error) {
+		RanCmds = nil
+		runner := docker.DockerBuilder{Config: conf, Dir: cacheDir}
+		err := runner.Run(ctx)
+		for _, cmd := range RanCmds {
+			if cmd.Args[1] == "build" {
+				return cmd.String(), err
+			}
+		}
+		return "", err
+	}
+
+	var cacheKey = func(cmd string) string {
+		match := regexp.MustCompile(`launcher_cache_key=(\w+)`).FindStringSubmatch(cmd)
+		Expect(match).To(HaveLen(2))
+		return match[1]
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		utils.Out = &bytes.Buffer{}
+		utils.Stderr = &bytes.Buffer{}
+		var err error
+		conf, err = config.LoadConfig("../test/containers", "test", true, "../test")
+		Expect(err).To(BeNil())
+		cacheDir, _ = os.MkdirTemp("", "ddocker-cache")
+		ctx = context.Background()
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponses["image inspect"] = []byte(`[{"Id": "sha256:0123456789abcdef", "RepoDigests": ["discourse/base@sha256:fedcba"]}]`)
+	})
+
+	AfterEach(func() {
+		utils.Stderr = os.Stderr
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheNone}
+		docker.Runtime = &docker.DockerRuntime{}
+		os.RemoveAll(cacheDir) //nolint:errcheck
+	})
+
+	It("builds from scratch by default", func() {
+		cmd, err := build()
+		Expect(err).To(BeNil())
+		Expect(cmd).To(ContainSubstring("--no-cache --pull"))
+		Expect(cmd).ToNot(ContainSubstring("launcher_cache_key"))
+	})
+
+	It("reuses local layers without pulling", func() {
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheLocal}
+		cmd, err := build()
+		Expect(err).To(BeNil())
+		Expect(cmd).ToNot(ContainSubstring("--no-cache"))
+		Expect(cmd).ToNot(ContainSubstring("--pull"))
+		Expect(cmd).ToNot(ContainSubstring("--cache-from"))
+		Expect(cacheKey(cmd)).To(HaveLen(16))
+	})
+
+	It("keeps a local cache directory for each site and key, pruning old keys", func() {
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheLocal, Dir: cacheDir}
+		stale := filepath.Join(cacheDir, "test", "0000000000000000")
+		Expect(os.MkdirAll(stale, 0755)).To(Succeed())
+
+		cmd, err := build()
+		Expect(err).To(BeNil())
+		dir := filepath.Join(cacheDir, "test", cacheKey(cmd))
+		Expect(cmd).To(ContainSubstring("--cache-from type=local,src=" + dir))
+		Expect(cmd).To(ContainSubstring("--cache-to type=local,dest=" + dir + ",mode=max"))
+		_, err = os.Stat(stale)
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+	})
+
+	It("changes the key with the base image digest and the pups config, not env", func() {
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheLocal}
+		cmd, _ := build()
+		key := cacheKey(cmd)
+
+		conf.Env["DISCOURSE_HOSTNAME"] = "other.example.com"
+		cmd, _ = build()
+		Expect(cacheKey(cmd)).To(Equal(key))
+
+		CmdOutputResponses["image inspect"] = []byte(`[{"Id": "sha256:0123456789abcdef", "RepoDigests": ["discourse/base@sha256:abcdef"]}]`)
+		cmd, _ = build()
+		Expect(cacheKey(cmd)).ToNot(Equal(key))
+	})
+
+	It("imports and exports a registry cache", func() {
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheRegistry, Ref: "registry.example.com/discourse-cache"}
+		cmd, err := build()
+		Expect(err).To(BeNil())
+		Expect(cmd).To(ContainSubstring("--pull"))
+		Expect(cmd).ToNot(ContainSubstring("--no-cache"))
+		Expect(cmd).To(ContainSubstring("--cache-from type=registry,ref=registry.example.com/discourse-cache:test"))
+		Expect(cmd).To(ContainSubstring("--cache-to type=registry,ref=registry.example.com/discourse-cache:test,mode=max"))
+	})
+
+	It("needs a ref for a registry cache", func() {
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheRegistry}
+		_, err := build()
+		Expect(err).To(MatchError(ContainSubstring("--cache-ref")))
+		Expect(RanCmds).ToNot(ContainElement(HaveField("Args", ContainElement("build"))))
+	})
+
+	It("uses buildah's layer cache with podman", func() {
+		docker.Runtime = &docker.PodmanRuntime{Binary: "podman"}
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheRegistry, Ref: "registry.example.com/discourse-cache"}
+		cmd, err := build()
+		Expect(err).To(BeNil())
+		Expect(cmd).To(ContainSubstring("--layers --cache-from registry.example.com/discourse-cache --cache-to registry.example.com/discourse-cache"))
+
+		docker.Cache = docker.CachePolicy{Mode: docker.CacheLocal, Dir: cacheDir}
+		_, err = build()
+		Expect(err).To(MatchError(ContainSubstring("--cache-dir")))
+	})
+})
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -22,6 +23,11 @@ type DockerBuilder struct {
 	Dir        string
 	ImageTag   string
 	ExtraFlags []string
+	// Config file in Dir, read by the Dockerfile. Defaults to config.yaml
+	ConfigFile string
+	// Where docker build writes its output, utils.Stdout and utils.Stderr by default
+	Stdout io.Writer
+	Stderr io.Writer
 }
 
 func (r *DockerBuilder) Run(ctx context.Context) error {
@@ -33,41 +39,89 @@ func (r *DockerBuilder) Run(ctx context.Context) error {
 	if r.ImageTag == "" {
 		r.ImageTag = utils.DefaultNamespace + "/" + r.Config.Name
 	}
+	cacheFlags, err := Cache.buildFlags(ctx, r.Config)
+	if err != nil {
+		return err
+	}
+	env, err := r.Config.GetEnvSlice(false)
+	if err != nil {
+		return err
+	}
+	// read again by each attempt
+	var stdin []byte
+	if r.Stdin != nil {
+		if stdin, err = io.ReadAll(r.Stdin); err != nil {
+			return err
+		}
+	}
+	err = retry(ctx, "docker build", func() error {
+		watcher := &buildRetryWatcher{}
+		cmd := r.command(ctx, useLauncherTag, cacheFlags, env)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, watcher)
+		cmd.Stdin = bytes.NewReader(stdin)
+		if err := utils.CmdRunner(cmd).Run(); err != nil {
+			if watcher.retry() {
+				return &buildRetryError{err}
+			}
+			return err
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if useLauncherTag {
+		utils.Emit(utils.Event{Type: utils.EventImageCommitted, Config: r.Config.Name, Image: r.ImageTag, Created: time.Now().UTC().Format(time.RFC3339)})
+	}
+	return nil
+}
+
+func (r *DockerBuilder) command(ctx context.Context, useLauncherTag bool, cacheFlags []string, env []string) *exec.Cmd {
 	cmd := exec.CommandContext(ctx, utils.DockerPath, "build")
 	TimeoutDockerBuild(cmd)
 	cmd.Dir = r.Dir
 	cmd.Env = os.Environ()
-	env := r.Config.GetEnvSlice(false)
 	cmd.Env = append(cmd.Env, env...)
-	cmd.Env = append(cmd.Env, "DOCKER_BUILDKIT=1")
-	cmd.Env = append(cmd.Env, "BUILDKIT_PROGRESS=plain")
+	cmd.Env = append(cmd.Env, Runtime.BuildEnv()...)
 	for k := range r.Config.Env {
-		if !slices.Contains(utils.KnownSecrets, k) {
+		if !r.Config.IsSecret(k) {
 			cmd.Args = append(cmd.Args, "--build-arg")
 			cmd.Args = append(cmd.Args, k)
 		}
 	}
-	cmd.Args = append(cmd.Args, "--no-cache")
-	cmd.Args = append(cmd.Args, "--pull")
-	cmd.Args = append(cmd.Args, "--force-rm")
+	cmd.Args = append(cmd.Args, cacheFlags...)
 	if useLauncherTag {
 		cmd.Args = append(cmd.Args, "--tag")
 		cmd.Args = append(cmd.Args, r.ImageTag)
 	}
-	cmd.Args = append(cmd.Args, "--shm-size=512m")
+	configFile := r.ConfigFile
+	if configFile == "" {
+		configFile = "config.yaml"
+	}
+	cmd.Args = append(cmd.Args, Runtime.BuildFlags(r.Dir, configFile)...)
 
 	cmd.Args = append(cmd.Args, r.ExtraFlags...)
 	cmd.Args = append(cmd.Args, "-f")
 	cmd.Args = append(cmd.Args, "-")
 	cmd.Args = append(cmd.Args, ".")
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = r.Stdin
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
+	cmd.Stdout = r.stdout()
+	cmd.Stderr = r.stderr()
+	return cmd
+}
+
+func (r *DockerBuilder) stdout() io.Writer {
+	if r.Stdout == nil {
+		return utils.Stdout
 	}
-	return nil
+	return r.Stdout
+}
+
+func (r *DockerBuilder) stderr() io.Writer {
+	if r.Stderr == nil {
+		return utils.Stderr
+	}
+	return r.Stderr
 }
 
 type DockerRunner struct {
@@ -79,6 +133,8 @@ type DockerRunner struct {
 	CustomImage string
 	Cmd         []string
 	Stdin       io.Reader
+	Stdout      io.Writer
+	Stderr      io.Writer
 	SkipPorts   bool
 	DryRun      bool
 	Restart     bool
@@ -87,6 +143,43 @@ type DockerRunner struct {
 }
 
 func (r *DockerRunner) Run(ctx context.Context) error {
+	if r.DryRun {
+		cmd, err := r.command(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+		return nil
+	}
+	if err := r.Config.ResolveSecrets(); err != nil {
+		return err
+	}
+	return Backend.Run(ctx, r)
+}
+
+func (r *DockerRunner) image() string {
+	if len(r.CustomImage) > 0 {
+		return r.CustomImage
+	}
+	return ConfigImage(r.Config)
+}
+
+func (r *DockerRunner) stdout() io.Writer {
+	if r.Stdout == nil {
+		return utils.Stdout
+	}
+	return r.Stdout
+}
+
+func (r *DockerRunner) stderr() io.Writer {
+	if r.Stderr == nil {
+		return utils.Stderr
+	}
+	return r.Stderr
+}
+
+// The docker run command for this runner, used by the cli backend and for dry runs.
+func (r *DockerRunner) command(ctx context.Context) (*exec.Cmd, error) {
 	cmd := exec.CommandContext(ctx, utils.DockerPath, "run")
 
 	// Detatch signifies we do not want to supervise
@@ -95,8 +188,14 @@ func (r *DockerRunner) Run(ctx context.Context) error {
 	}
 
 	cmd.Env = os.Environ()
-	env := r.Config.GetEnvSlice(true)
-	cmd.Env = append(cmd.Env, env...)
+	// dry runs print the command without the secrets, which are never read for them
+	if !r.DryRun {
+		env, err := r.Config.GetEnvSlice(true)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
 	envKeys := make([]string, 0, len(r.Config.Env))
 
 	for envKey := range r.Config.Env {
@@ -110,7 +209,11 @@ func (r *DockerRunner) Run(ctx context.Context) error {
 		for _, envKey := range envKeys {
 			value := r.Config.Env[envKey]
 
-			if !strings.Contains(value, "\n") {
+			if r.Config.HasSecretSource(envKey) {
+				// never print secrets from secret sources, docker reads them from its env
+				cmd.Args = append(cmd.Args, "--env")
+				cmd.Args = append(cmd.Args, envKey)
+			} else if !strings.Contains(value, "\n") {
 				cmd.Args = append(cmd.Args, "--env")
 				cmd.Args = append(cmd.Args, envKey+"="+shellwords.Escape(value))
 			}
@@ -150,10 +253,11 @@ func (r *DockerRunner) Run(ctx context.Context) error {
 		cmd.Args = append(cmd.Args, v.Volume.Host+":"+v.Volume.Guest)
 	}
 
-	for _, v := range r.Config.Links {
-		cmd.Args = append(cmd.Args, "--link")
-		cmd.Args = append(cmd.Args, v.Link.Name+":"+v.Link.Alias)
+	links, err := Runtime.LinkArgs(ctx, r.Config, r.DryRun)
+	if err != nil {
+		return nil, err
 	}
+	cmd.Args = append(cmd.Args, links...)
 
 	cmd.Args = append(cmd.Args, "--shm-size=512m")
 
@@ -185,32 +289,16 @@ func (r *DockerRunner) Run(ctx context.Context) error {
 	cmd.Args = append(cmd.Args, "--name")
 	cmd.Args = append(cmd.Args, r.ContainerId)
 
-	if len(r.CustomImage) > 0 {
-		cmd.Args = append(cmd.Args, r.CustomImage)
-	} else if len(r.Config.RunImage) > 0 {
-		cmd.Args = append(cmd.Args, r.Config.RunImage)
-	} else {
-		cmd.Args = append(cmd.Args, utils.DefaultNamespace+"/"+r.Config.Name)
-	}
-
+	cmd.Args = append(cmd.Args, r.image())
 	cmd.Args = append(cmd.Args, r.Cmd...)
 
 	if !r.Detatch {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = r.stdout()
+		cmd.Stderr = r.stderr()
 		cmd.Stdin = r.Stdin
 	}
 
-	runner := utils.CmdRunner(cmd)
-
-	if r.DryRun {
-		fmt.Println(cmd)
-	} else {
-		if err := runner.Run(); err != nil {
-			return err
-		}
-	}
-	return nil
+	return cmd, nil
 }
 
 type DockerPupsRunner struct {
@@ -235,8 +323,7 @@ func (r *DockerPupsRunner) Run(ctx context.Context) error {
 		if !rm {
 			time.Sleep(utils.CommitWait)
 			runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			cmd := exec.CommandContext(runCtx, utils.DockerPath, "rm", "--force", r.ContainerId)
-			if err := utils.CmdRunner(cmd).Run(); err != nil {
+			if err := Backend.Remove(runCtx, r.ContainerId, true); err != nil {
 				fmt.Fprintln(utils.Out, "Error stopping container"+r.ContainerId) //nolint:errcheck
 			}
 			cancel()
@@ -249,72 +336,43 @@ func (r *DockerPupsRunner) Run(ctx context.Context) error {
 		"/usr/local/bin/pups --stdin " + r.PupsArgs,
 	}
 
-	runner := DockerRunner{Config: r.Config,
-		ExtraEnv:    r.ExtraEnv,
-		Rm:          rm,
-		CustomImage: r.FromImageName,
-		ContainerId: r.ContainerId,
-		Cmd:         commands,
-		Stdin:       strings.NewReader(r.Config.Yaml()),
-		SkipPorts:   true, //pups runs don't need to expose ports
+	run := func() error {
+		runner := DockerRunner{Config: r.Config,
+			ExtraEnv:    r.ExtraEnv,
+			Rm:          rm,
+			CustomImage: r.FromImageName,
+			ContainerId: r.ContainerId,
+			Cmd:         commands,
+			Stdin:       strings.NewReader(r.Config.Yaml()),
+			SkipPorts:   true, //pups runs don't need to expose ports
+		}
+		return runner.Run(ctx)
+	}
+	// the next attempt reuses the container name. Containers run with --rm may be gone already
+	cleanup := func() {
+		runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		Backend.Remove(runCtx, r.ContainerId, true) //nolint:errcheck
 	}
 
-	if err := runner.Run(ctx); err != nil {
+	if err := retry(ctx, "pups", run, cleanup); err != nil {
 		return err
 	}
 
 	if len(r.SavedImageName) > 0 {
 		time.Sleep(utils.CommitWait)
 
-		cmd := exec.Command(utils.DockerPath,
-			"commit",
-			"--change",
-			"LABEL org.opencontainers.image.created=\""+time.Now().UTC().Format(time.RFC3339)+"\"",
-			"--change",
-			"CMD [\""+r.Config.GetBootCommand()+"\"]",
-			r.ContainerId,
-			r.SavedImageName,
-		)
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+		created := time.Now().UTC().Format(time.RFC3339)
+		changes := []string{
+			"LABEL " + CreatedLabel + "=\"" + created + "\"",
+			"CMD [\"" + r.Config.GetBootCommand() + "\"]",
+		}
 
-		if err := utils.CmdRunner(cmd).Run(); err != nil {
+		if err := Backend.Commit(ctx, r.ContainerId, r.SavedImageName, Runtime.CommitChanges(changes)); err != nil {
 			return err
 		}
+		utils.Emit(utils.Event{Type: utils.EventImageCommitted, Config: r.Config.Name, Image: r.SavedImageName, Created: created})
 	}
 
 	return nil
 }
-
-func ContainerExists(container string) (bool, error) {
-	cmd := exec.Command(utils.DockerPath, "ps", "--all", "--quiet", "--filter", "name="+container)
-	result, err := utils.CmdRunner(cmd).Output()
-
-	if err != nil {
-		return false, err
-	}
-
-	if len(result) > 0 {
-		return true, nil
-	}
-
-	return false, nil
-}
-
-func ContainerRunning(container string) (bool, error) {
-	cmd := exec.Command(utils.DockerPath, "ps", "--quiet", "--filter", "name="+container)
-	result, err := utils.CmdRunner(cmd).Output()
-
-	if err != nil {
-		return false, err
-	}
-
-	if len(result) > 0 {
-		return true, nil
-	}
-
-	return false, nil
-}
@@ -0,0 +1,262 @@
+package docker
+
+import (
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+const (
+	DriftImage      = "image"
+	DriftBuild      = "build"
+	DriftEnv        = "env"
+	DriftLabels     = "labels"
+	DriftVolumes    = "volumes"
+	DriftPorts      = "ports"
+	DriftLinks      = "links"
+	DriftDockerArgs = "docker_args"
+)
+
+// Env rebuild sets on the containers it starts, which is expected to differ from the config.
+var LauncherEnv = []string{"MIGRATE_ON_BOOT", "PRECOMPILE_ON_BOOT"}
+
+// A difference between a config and the container running it.
+type Drift struct {
+	Category string
+	Key      string
+	// Values in the config and in the container, empty when absent.
+	Config    string
+	Container string
+	// Applying the config needs a rebuilt image, rather than only a new container.
+	Rebuild bool
+}
+
+// The image containers for a config run.
+func ConfigImage(conf *config.Config) string {
+	if len(conf.RunImage) > 0 {
+		return conf.RunImage
+	}
+	return utils.DefaultNamespace + "/" + conf.Name
+}
+
+// Compares a config with its container. image is the image the container runs, and latest
+// the image the config currently points to. Either is nil when it no longer exists.
+func ConfigDrift(conf *config.Config, container *ContainerInspect, image *ImageInspect, latest *ImageInspect) []Drift {
+	drift := []Drift{}
+	drift = append(drift, imageDrift(conf, container, latest)...)
+	drift = append(drift, envDrift(conf, container, image)...)
+	drift = append(drift, labelDrift(conf, container, image)...)
+
+	volumes, ports := dockerArgsBindings(conf)
+	for _, v := range conf.Volumes {
+		volumes = append(volumes, v.Volume.Host+":"+v.Volume.Guest)
+	}
+	for _, p := range SlotExpose(conf, ContainerSlot(container)) {
+		if strings.Contains(p, ":") {
+			ports = append(ports, normalizePort(p))
+		}
+	}
+	binds := []string{}
+	for _, b := range container.HostConfig.Binds {
+		// drop mount options, like :ro
+		parts := strings.SplitN(b, ":", 3)
+		binds = append(binds, strings.Join(parts[:min(2, len(parts))], ":"))
+	}
+	drift = append(drift, setDrift(DriftVolumes, volumes, binds)...)
+	drift = append(drift, setDrift(DriftPorts, ports, boundPorts(container.HostConfig.PortBindings))...)
+
+	// other runtimes replace links, and have nothing to compare
+	if Runtime.Name() == "docker" {
+		links := []string{}
+		for _, l := range conf.Links {
+			links = append(links, l.Link.Name+":"+l.Link.Alias)
+		}
+		containerLinks := []string{}
+		for _, l := range container.HostConfig.Links {
+			// docker reports links as /name:/container/alias
+			name, alias, _ := strings.Cut(l, ":")
+			containerLinks = append(containerLinks, strings.TrimPrefix(name, "/")+":"+path.Base(alias))
+		}
+		drift = append(drift, setDrift(DriftLinks, links, containerLinks)...)
+	}
+
+	// only containers started by launcher record their docker args
+	if args, ok := container.Config.Labels[DockerArgsLabel]; ok && args != conf.DockerArgs {
+		drift = append(drift, Drift{Category: DriftDockerArgs, Key: "docker_args", Config: conf.DockerArgs, Container: args})
+	}
+
+	return drift
+}
+
+func imageDrift(conf *config.Config, container *ContainerInspect, latest *ImageInspect) []Drift {
+	drift := []Drift{}
+	name := ConfigImage(conf)
+	if container.Config.Image != name {
+		drift = append(drift, Drift{Category: DriftImage, Key: "name", Config: name, Container: container.Config.Image})
+	}
+	if latest == nil {
+		return append(drift, Drift{Category: DriftImage, Key: "id", Config: name + " (missing)", Container: container.Image, Rebuild: true})
+	}
+	if latest.Id != container.Image {
+		drift = append(drift, Drift{Category: DriftImage, Key: "id", Config: latest.Id, Container: container.Image})
+	}
+	// custom run images are not built by launcher, and images built before the label existed can't be compared
+	if hash := latest.Config.Labels[config.BuildHashLabel]; conf.RunImage == "" && hash != "" && hash != conf.BuildHash() {
+		drift = append(drift, Drift{Category: DriftBuild, Key: "config", Config: conf.BuildHash(), Container: hash, Rebuild: true})
+	}
+	return drift
+}
+
+func envDrift(conf *config.Config, container *ContainerInspect, image *ImageInspect) []Drift {
+	drift := []Drift{}
+	env := container.EnvMap()
+	imageEnv := map[string]string{}
+	if image != nil {
+		for _, e := range image.Config.Env {
+			k, v, _ := strings.Cut(e, "=")
+			imageEnv[k] = v
+		}
+	}
+	keys := []string{}
+	for k := range conf.Env {
+		// comparing secrets not resolved yet would run their commands
+		if !slices.Contains(LauncherEnv, k) && !conf.SecretPending(k) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		v := conf.Env[k]
+		if value, ok := env[k]; !ok || value != v {
+			drift = append(drift, Drift{Category: DriftEnv, Key: k, Config: v, Container: value})
+		}
+	}
+	for k, v := range env {
+		if _, ok := conf.Env[k]; ok || slices.Contains(LauncherEnv, k) {
+			continue
+		}
+		// env from the image was not set by the config
+		if imageValue, ok := imageEnv[k]; ok && imageValue == v {
+			continue
+		}
+		drift = append(drift, Drift{Category: DriftEnv, Key: k, Container: v})
+	}
+	sortDrift(drift)
+	return drift
+}
+
+func labelDrift(conf *config.Config, container *ContainerInspect, image *ImageInspect) []Drift {
+	drift := []Drift{}
+	imageLabels := map[string]string{}
+	if image != nil {
+		imageLabels = image.Config.Labels
+	}
+	for k, v := range conf.Labels {
+		if value, ok := container.Config.Labels[k]; !ok || value != v {
+			drift = append(drift, Drift{Category: DriftLabels, Key: k, Config: v, Container: value})
+		}
+	}
+	for k, v := range container.Config.Labels {
+		if _, ok := conf.Labels[k]; ok || k == DockerArgsLabel || k == SlotLabel {
+			continue
+		}
+		if imageValue, ok := imageLabels[k]; ok && imageValue == v {
+			continue
+		}
+		drift = append(drift, Drift{Category: DriftLabels, Key: k, Container: v})
+	}
+	sortDrift(drift)
+	return drift
+}
+
+// Entries only in the config, or only in the container.
+func setDrift(category string, expected []string, actual []string) []Drift {
+	drift := []Drift{}
+	for _, e := range expected {
+		if !slices.Contains(actual, e) {
+			drift = append(drift, Drift{Category: category, Key: e, Config: e})
+		}
+	}
+	for _, a := range actual {
+		if !slices.Contains(expected, a) {
+			drift = append(drift, Drift{Category: category, Key: a, Container: a})
+		}
+	}
+	sortDrift(drift)
+	return drift
+}
+
+func sortDrift(drift []Drift) {
+	sort.SliceStable(drift, func(i, j int) bool {
+		return drift[i].Key < drift[j].Key
+	})
+}
+
+// Volumes and published ports passed in docker_args, so they aren't reported as unknown.
+func dockerArgsBindings(conf *config.Config) ([]string, []string) {
+	volumes := []string{}
+	ports := []string{}
+	args := conf.GetDockerArgs()
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := strings.Cut(args[i], "=")
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		switch flag {
+		case "-v", "--volume":
+			parts := strings.SplitN(value, ":", 3)
+			volumes = append(volumes, strings.Join(parts[:min(2, len(parts))], ":"))
+		case "-p", "--publish":
+			ports = append(ports, normalizePort(value))
+		default:
+			continue
+		}
+		if !hasValue {
+			i++
+		}
+	}
+	return volumes, ports
+}
+
+// Normalizes a publish spec, [ip:]host:container[/proto], to host:container/proto
+// with the ip only when it is not a wildcard.
+func normalizePort(spec string) string {
+	if !strings.Contains(spec, "/") {
+		spec += "/tcp"
+	}
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return spec
+	}
+	host, containerPort := spec[:i], spec[i+1:]
+	ip, hostPort, found := strings.Cut(host, ":")
+	if !found {
+		return host + ":" + containerPort
+	}
+	return bindingPort(containerPort, PortBinding{HostIp: ip, HostPort: hostPort})
+}
+
+func bindingPort(containerPort string, binding PortBinding) string {
+	if binding.HostIp != "" && binding.HostIp != "0.0.0.0" && binding.HostIp != "::" {
+		return binding.HostIp + ":" + binding.HostPort + ":" + containerPort
+	}
+	return binding.HostPort + ":" + containerPort
+}
+
+func boundPorts(bindings map[string][]PortBinding) []string {
+	ports := []string{}
+	for containerPort, b := range bindings {
+		for _, binding := range b {
+			port := bindingPort(containerPort, binding)
+			if !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	slices.Sort(ports)
+	return ports
+}
@@ -0,0 +1,76 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+)
+
+var _ = Describe("ConfigDrift", func() {
+	var conf *config.Config
+	var container *docker.ContainerInspect
+
+	BeforeEach(func() {
+		conf = &config.Config{
+			Name:       "app",
+			Expose:     []string{"127.0.0.1:8080:80", "443:443/tcp", "90"},
+			DockerArgs: "-p 2222:22 --volume=/srv/extra:/extra:ro",
+			Volumes:    []config.VolumeObject{{Volume: config.Volume{Host: "/var/discourse/shared/app", Guest: "/shared"}}},
+		}
+		container = &docker.ContainerInspect{Image: "sha256:1"}
+		container.Config.Image = "local_discourse/app"
+		container.HostConfig.Binds = []string{"/var/discourse/shared/app:/shared", "/srv/extra:/extra:ro"}
+		container.HostConfig.PortBindings = map[string][]docker.PortBinding{
+			"80/tcp":  {{HostIp: "127.0.0.1", HostPort: "8080"}},
+			"443/tcp": {{HostIp: "", HostPort: "443"}},
+			"22/tcp":  {{HostIp: "0.0.0.0", HostPort: "2222"}},
+		}
+	})
+
+	It("matches ports and volumes from expose, volumes, and docker args", func() {
+		latest := &docker.ImageInspect{Id: "sha256:1"}
+		Expect(docker.ConfigDrift(conf, container, nil, latest)).To(BeEmpty())
+	})
+
+	It("matches green containers with the blue_green ports", func() {
+		conf.BlueGreen.Expose = []string{"127.0.0.1:8081:80", "8443:443"}
+		container.Config.Labels = map[string]string{docker.SlotLabel: docker.SlotGreen}
+		container.HostConfig.PortBindings = map[string][]docker.PortBinding{
+			"80/tcp":  {{HostIp: "127.0.0.1", HostPort: "8081"}},
+			"443/tcp": {{HostIp: "", HostPort: "8443"}},
+			"22/tcp":  {{HostIp: "0.0.0.0", HostPort: "2222"}},
+		}
+		latest := &docker.ImageInspect{Id: "sha256:1"}
+		Expect(docker.ConfigDrift(conf, container, nil, latest)).To(BeEmpty())
+	})
+
+	It("needs distinct host ports for blue green deploys", func() {
+		conf.DockerArgs = ""
+		Expect(docker.CheckBlueGreen(conf)).To(MatchError(ContainSubstring("needs alternate host ports")))
+		conf.BlueGreen.Expose = []string{"8081:80", "443:443"}
+		Expect(docker.CheckBlueGreen(conf)).To(MatchError(ContainSubstring("both publish 443")))
+		conf.BlueGreen.Expose = []string{"8081:80", "8443:443"}
+		Expect(docker.CheckBlueGreen(conf)).To(Succeed())
+		conf.DockerArgs = "-p 2222:22"
+		Expect(docker.CheckBlueGreen(conf)).To(MatchError(ContainSubstring("docker_args")))
+	})
+
+	It("reports ports and volumes only on one side", func() {
+		conf.Expose = []string{"127.0.0.1:8080:80", "8443:443"}
+		container.HostConfig.Binds = container.HostConfig.Binds[1:]
+		latest := &docker.ImageInspect{Id: "sha256:1"}
+		Expect(docker.ConfigDrift(conf, container, nil, latest)).To(ConsistOf(
+			docker.Drift{Category: docker.DriftVolumes, Key: "/var/discourse/shared/app:/shared", Config: "/var/discourse/shared/app:/shared"},
+			docker.Drift{Category: docker.DriftPorts, Key: "8443:443/tcp", Config: "8443:443/tcp"},
+			docker.Drift{Category: docker.DriftPorts, Key: "443:443/tcp", Container: "443:443/tcp"},
+		))
+	})
+
+	It("needs a rebuild when the image is gone", func() {
+		drift := docker.ConfigDrift(conf, container, nil, nil)
+		Expect(drift).To(HaveLen(1))
+		Expect(drift[0].Rebuild).To(BeTrue())
+	})
+})
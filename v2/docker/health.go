@@ -0,0 +1,161 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+const defaultHealthCheckPath = "/srv/status"
+const defaultHealthCheckPort = "80"
+
+// Redirects aren't followed, they could probe another site, like the public hostname served by
+// the container being replaced.
+var healthCheckClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// The container stopped, waiting longer won't make it healthy.
+type ContainerStoppedError struct {
+	Container string
+	Status    string
+}
+
+func (e *ContainerStoppedError) Error() string {
+	return e.Container + " is " + e.Status
+}
+
+func (b *CliBackend) Exec(ctx context.Context, container string, command []string) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "exec", container)
+	cmd.Args = append(cmd.Args, command...)
+	if _, err := utils.CmdRunner(cmd).Output(); err != nil {
+		return fmt.Errorf("%s: %w", strings.Join(command, " "), err)
+	}
+	return nil
+}
+
+func (b *ApiBackend) Exec(ctx context.Context, container string, command []string) error {
+	created := struct{ Id string }{}
+	request := map[string]any{"Cmd": command, "AttachStdout": true, "AttachStderr": true}
+	if err := b.call(ctx, http.MethodPost, "/containers/"+container+"/exec", nil, request, &created); err != nil {
+		return err
+	}
+	// without detach, the response streams output until the command exits
+	resp, err := b.do(ctx, http.MethodPost, "/exec/"+created.Id+"/start", nil, map[string]any{"Detach": false, "Tty": false})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if err := demuxStream(resp.Body, io.Discard, io.Discard); err != nil {
+		return err
+	}
+	result := struct{ ExitCode int }{}
+	if err := b.call(ctx, http.MethodGet, "/exec/"+created.Id+"/json", nil, nil, &result); err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("%s: exited with status %d", strings.Join(command, " "), result.ExitCode)
+	}
+	return nil
+}
+
+// Polls the config's health check until it passes, the container stops, or the timeout.
+func WaitHealthy(ctx context.Context, conf *config.Config, container string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var err error
+	for {
+		checkErr := checkHealth(ctx, conf.HealthCheck, container)
+		if checkErr == nil {
+			return nil
+		}
+		var stopped *ContainerStoppedError
+		if errors.As(checkErr, &stopped) {
+			return checkErr
+		}
+		// a check cut short by the timeout says less than the one before it
+		if err == nil || ctx.Err() == nil {
+			err = checkErr
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s was not healthy after %s: %w", container, timeout, err)
+		case <-time.After(utils.HealthCheckInterval):
+		}
+	}
+}
+
+func checkHealth(ctx context.Context, check config.HealthCheck, container string) error {
+	inspect, err := Backend.InspectContainer(ctx, container)
+	if err != nil {
+		return err
+	}
+	if inspect == nil {
+		return &ContainerStoppedError{Container: container, Status: "gone"}
+	}
+	if !inspect.State.Running {
+		if inspect.State.Status == "exited" || inspect.State.Status == "dead" {
+			return &ContainerStoppedError{Container: container, Status: inspect.State.Status}
+		}
+		return errors.New(container + " is " + inspect.State.Status)
+	}
+
+	if check.Command != "" {
+		return Backend.Exec(ctx, container, []string{"sh", "-c", check.Command})
+	}
+
+	path := check.Path
+	if path == "" {
+		path = defaultHealthCheckPath
+	}
+	port := check.Port
+	if port == "" {
+		port = defaultHealthCheckPort
+	}
+	bindings := inspect.NetworkSettings.Ports[port+"/tcp"]
+	if len(bindings) == 0 {
+		// sites behind a proxy may not publish the port. curl --fail passes redirects, so the
+		// status code is checked instead
+		probe := "case $(curl --silent --output /dev/null --write-out '%{http_code}' 'http://localhost:" + port + path + "') in 2??) ;; *) exit 1 ;; esac"
+		return Backend.Exec(ctx, container, []string{"sh", "-c", probe})
+	}
+
+	host := bindings[0].HostIp
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	url := "http://" + net.JoinHostPort(host, bindings[0].HostPort) + path
+	requestCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(requestCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := healthCheckClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()        //nolint:errcheck
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+	// nginx redirects to https before the app is up, only a 2xx is from a booted site
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("GET " + url + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
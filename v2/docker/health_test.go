@@ -0,0 +1,117 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("WaitHealthy", func() {
+	var conf *config.Config
+	var server *httptest.Server
+	var requests atomic.Int32
+	var healthyAfter int32
+	var ctx context.Context
+
+	var inspectResponse = func(status string, port string) []byte {
+		running := "false"
+		if status == "running" {
+			running = "true"
+		}
+		return []byte(`[{"Id": "123", "State": {"Status": "` + status + `", "Running": ` + running + `},` +
+			`"NetworkSettings": {"Ports": {"80/tcp": [{"HostIp": "0.0.0.0", "HostPort": "` + port + `"}]}}}]`)
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		utils.HealthCheckInterval = time.Millisecond
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		docker.Backend = &docker.CliBackend{}
+		ctx = context.Background()
+		conf = &config.Config{Name: "app"}
+
+		requests.Store(0)
+		healthyAfter = 2
+		// a stand-in for the container's published web port
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/srv/status"))
+			if requests.Add(1) <= healthyAfter {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte("ok")) //nolint:errcheck
+		}))
+		_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		CmdOutputResponses["container inspect"] = inspectResponse("running", port)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("polls the published port until the site responds", func() {
+		Expect(docker.WaitHealthy(ctx, conf, "app", time.Minute)).To(Succeed())
+		Expect(requests.Load()).To(Equal(int32(3)))
+	})
+
+	It("fails on redirects, without following them", func() {
+		public := atomic.Int32{}
+		publicSite := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			public.Add(1)
+			w.Write([]byte("ok")) //nolint:errcheck
+		}))
+		defer publicSite.Close()
+		redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, publicSite.URL+r.URL.Path, http.StatusMovedPermanently)
+		}))
+		defer redirecting.Close()
+		_, port, _ := net.SplitHostPort(redirecting.Listener.Addr().String())
+		CmdOutputResponses["container inspect"] = inspectResponse("running", port)
+
+		err := docker.WaitHealthy(ctx, conf, "app", 50*time.Millisecond)
+		Expect(err).To(MatchError(ContainSubstring("returned 301")))
+		Expect(public.Load()).To(Equal(int32(0)))
+	})
+
+	It("times out with the last failure", func() {
+		healthyAfter = 1 << 30
+		err := docker.WaitHealthy(ctx, conf, "app", 50*time.Millisecond)
+		Expect(err).To(MatchError(ContainSubstring("app was not healthy after 50ms")))
+		Expect(err).To(MatchError(ContainSubstring("returned 502")))
+	})
+
+	It("stops waiting when the container exits", func() {
+		CmdOutputResponses["container inspect"] = inspectResponse("exited", "80")
+		err := docker.WaitHealthy(ctx, conf, "app", time.Minute)
+		var stopped *docker.ContainerStoppedError
+		Expect(errors.As(err, &stopped)).To(BeTrue())
+		Expect(requests.Load()).To(Equal(int32(0)))
+	})
+
+	It("runs health check commands in the container", func() {
+		conf.HealthCheck.Command = "test -f /shared/ready"
+		Expect(docker.WaitHealthy(ctx, conf, "app", time.Minute)).To(Succeed())
+		cmd := RanCmds[len(RanCmds)-1]
+		Expect(cmd.String()).To(ContainSubstring("docker exec app sh -c test -f /shared/ready"))
+		Expect(requests.Load()).To(Equal(int32(0)))
+	})
+
+	It("checks from inside the container when the port isn't published", func() {
+		conf.HealthCheck = config.HealthCheck{Path: "/health", Port: "3000"}
+		Expect(docker.WaitHealthy(ctx, conf, "app", time.Minute)).To(Succeed())
+		cmd := RanCmds[len(RanCmds)-1]
+		Expect(cmd.String()).To(ContainSubstring("docker exec app sh -c case $(curl --silent --output /dev/null --write-out '%{http_code}' 'http://localhost:3000/health') in 2??)"))
+	})
+})
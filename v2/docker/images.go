@@ -0,0 +1,70 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+func (b *CliBackend) TagImage(ctx context.Context, image string, tag string) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "tag", image, tag)
+	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (b *CliBackend) RemoveImage(ctx context.Context, image string) error {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "image", "rm", image)
+	fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (b *CliBackend) ImageTags(ctx context.Context, repo string) (map[string]string, error) {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, "image", "ls", "--no-trunc", "--format", "{{.Tag}}\t{{.ID}}", repo)
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, line := range strings.Split(string(result), "\n") {
+		tag, id, found := strings.Cut(line, "\t")
+		if found && tag != "<none>" {
+			tags[tag] = id
+		}
+	}
+	return tags, nil
+}
+
+func (b *ApiBackend) TagImage(ctx context.Context, image string, tag string) error {
+	repo, tagName := splitImageTag(tag)
+	return b.call(ctx, http.MethodPost, "/images/"+image+"/tag", url.Values{"repo": {repo}, "tag": {tagName}}, nil, nil)
+}
+
+func (b *ApiBackend) RemoveImage(ctx context.Context, image string) error {
+	return b.call(ctx, http.MethodDelete, "/images/"+image, nil, nil, nil)
+}
+
+func (b *ApiBackend) ImageTags(ctx context.Context, repo string) (map[string]string, error) {
+	filters, _ := json.Marshal(map[string][]string{"reference": {repo}})
+	images := []struct {
+		Id       string
+		RepoTags []string
+	}{}
+	if err := b.call(ctx, http.MethodGet, "/images/json", url.Values{"filters": {string(filters)}}, nil, &images); err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, image := range images {
+		for _, repoTag := range image.RepoTags {
+			if r, tag := splitImageTag(repoTag); r == repo {
+				tags[tag] = image.Id
+			}
+		}
+	}
+	return tags, nil
+}
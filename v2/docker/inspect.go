@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// The label DockerPupsRunner sets on committed images.
+const CreatedLabel = "org.opencontainers.image.created"
+
+// The label start sets on containers, holding the config's docker_args.
+const DockerArgsLabel = "org.discourse.launcher.docker-args"
+
+type PortBinding struct {
+	HostIp   string
+	HostPort string
+}
+
+// The parts of docker's container inspect output launcher reads.
+// The cli and the api return the same document.
+type ContainerInspect struct {
+	Id           string
+	Name         string
+	Created      time.Time
+	Image        string
+	RestartCount int
+	State        struct {
+		Status    string
+		Running   bool
+		StartedAt time.Time
+	}
+	Config struct {
+		Image  string
+		Env    []string
+		Labels map[string]string
+	}
+	HostConfig struct {
+		Binds        []string
+		Links        []string
+		PortBindings map[string][]PortBinding
+	}
+	NetworkSettings struct {
+		Ports map[string][]PortBinding
+	}
+}
+
+// Published ports as host:container/proto, sorted.
+func (c *ContainerInspect) PublishedPorts() []string {
+	return boundPorts(c.NetworkSettings.Ports)
+}
+
+// Container env as a map. Later entries win, as they do for docker run.
+func (c *ContainerInspect) EnvMap() map[string]string {
+	env := map[string]string{}
+	for _, e := range c.Config.Env {
+		k, v, _ := strings.Cut(e, "=")
+		env[k] = v
+	}
+	return env
+}
+
+type ImageInspect struct {
+	Id          string
+	RepoDigests []string
+	Created     time.Time
+	Config      struct {
+		Env    []string
+		Labels map[string]string
+	}
+}
+
+// Time the image was committed by launcher, from its created label. Zero when unset.
+func (i *ImageInspect) LauncherCreated() time.Time {
+	created, _ := time.Parse(time.RFC3339, i.Config.Labels[CreatedLabel])
+	return created
+}
+
+// Output of `docker inspect`, nil when the object does not exist.
+func cliInspect(ctx context.Context, kind string, name string, out any) (bool, error) {
+	cmd := exec.CommandContext(ctx, utils.DockerPath, kind, "inspect", name)
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr := strings.ToLower(string(exitErr.Stderr))
+			// docker and nerdctl say "no such", podman says "not known"
+			if strings.Contains(stderr, "no such") || strings.Contains(stderr, "not known") {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(result, out); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *CliBackend) InspectContainer(ctx context.Context, container string) (*ContainerInspect, error) {
+	result := []*ContainerInspect{}
+	if found, err := cliInspect(ctx, "container", container, &result); !found || len(result) == 0 {
+		return nil, err
+	}
+	return result[0], nil
+}
+
+func (b *CliBackend) InspectImage(ctx context.Context, image string) (*ImageInspect, error) {
+	result := []*ImageInspect{}
+	if found, err := cliInspect(ctx, "image", image, &result); !found || len(result) == 0 {
+		return nil, err
+	}
+	return result[0], nil
+}
+
+func (b *ApiBackend) InspectContainer(ctx context.Context, container string) (*ContainerInspect, error) {
+	result := &ContainerInspect{}
+	if err := b.call(ctx, http.MethodGet, "/containers/"+container+"/json", nil, nil, result); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+func (b *ApiBackend) InspectImage(ctx context.Context, image string) (*ImageInspect, error) {
+	result := &ImageInspect{}
+	if err := b.call(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, result); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result, nil
+}
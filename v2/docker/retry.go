@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Exit code of pups, and of the scripts it runs, for failures worth retrying, like a plugin
+// that failed to clone.
+const RetryExitCode = 77
+
+// How builds and pups runs exiting with RetryExitCode are retried.
+type RetryPolicy struct {
+	// Runs in all, 1 doesn't retry
+	Attempts int
+	// Wait before the first retry, doubled for each one after
+	Backoff time.Duration
+}
+
+var Retry = RetryPolicy{Attempts: 3, Backoff: 10 * time.Second}
+
+// Runs run until it succeeds, fails without asking to be retried, or runs out of attempts.
+// cleanup runs between attempts.
+func retry(ctx context.Context, what string, run func() error, cleanup func()) error {
+	backoff := Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil || !retryable(err) || attempt >= Retry.Attempts || ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(utils.Out, "%s exited with %d, which asks for a retry. Retrying in %s, attempt %d of %d\n", //nolint:errcheck
+			what, RetryExitCode, backoff, attempt+1, Retry.Attempts)
+		if cleanup != nil {
+			cleanup()
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func retryable(err error) bool {
+	var exitErr interface{ ExitCode() int }
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == RetryExitCode
+}
+
+// A build step that exited with RetryExitCode. docker build itself exits 1.
+type buildRetryError struct {
+	err error
+}
+
+func (e *buildRetryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *buildRetryError) Unwrap() error {
+	return e.err
+}
+
+func (e *buildRetryError) ExitCode() int {
+	return RetryExitCode
+}
+
+// How docker build reports a step's exit code, with and without BuildKit.
+var buildExitCodeRegexp = regexp.MustCompile(`(?:exit code: |returned a non-zero code: )77\b`)
+
+// Watches docker build output for a step exiting with RetryExitCode.
+type buildRetryWatcher struct {
+	mu    sync.Mutex
+	line  []byte
+	found bool
+}
+
+func (w *buildRetryWatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, b := range p {
+		if b != '\n' {
+			w.line = append(w.line, b)
+			continue
+		}
+		w.found = w.found || buildExitCodeRegexp.Match(w.line)
+		w.line = w.line[:0]
+	}
+	return len(p), nil
+}
+
+func (w *buildRetryWatcher) retry() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.found || buildExitCodeRegexp.Match(w.line)
+}
@@ -0,0 +1,96 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Exits like a failed docker command.
+type exitError int
+
+func (e exitError) Error() string { return "exit status" }
+func (e exitError) ExitCode() int { return int(e) }
+
+var _ = Describe("Retry", func() {
+	var conf *config.Config
+	var out *bytes.Buffer
+	var ctx context.Context
+
+	var countCmds = func(substr string) int {
+		count := 0
+		for _, cmd := range RanCmds {
+			if bytes.Contains([]byte(cmd.String()), []byte(substr)) {
+				count++
+			}
+		}
+		return count
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		utils.Stderr = &bytes.Buffer{}
+		utils.CommitWait = 0
+		docker.Retry = docker.RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+		conf = &config.Config{Name: "test"}
+		ctx = context.Background()
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	AfterEach(func() {
+		utils.Stderr = os.Stderr
+		docker.Retry = docker.RetryPolicy{Attempts: 3, Backoff: 10 * time.Second}
+	})
+
+	It("retries pups runs that exit with 77, removing the failed container", func() {
+		CmdOutputError = exitError(77)
+		runner := docker.DockerPupsRunner{Config: conf, ContainerId: "discourse-build-test", SavedImageName: "local_discourse/test"}
+		err := runner.Run(ctx)
+
+		var exitErr interface{ ExitCode() int }
+		Expect(errors.As(err, &exitErr)).To(BeTrue())
+		Expect(exitErr.ExitCode()).To(Equal(77))
+		Expect(countCmds("docker run")).To(Equal(3))
+		Expect(countCmds("docker rm")).To(BeNumerically(">=", 2))
+		Expect(out.String()).To(ContainSubstring("pups exited with 77, which asks for a retry. Retrying in 1ms, attempt 2 of 3"))
+		Expect(out.String()).To(ContainSubstring("Retrying in 2ms, attempt 3 of 3"))
+	})
+
+	It("does not retry other failures", func() {
+		CmdOutputError = exitError(1)
+		runner := docker.DockerPupsRunner{Config: conf, ContainerId: "discourse-build-test"}
+		Expect(runner.Run(ctx)).ToNot(Succeed())
+		Expect(countCmds("docker run")).To(Equal(1))
+		Expect(out.String()).ToNot(ContainSubstring("Retrying"))
+	})
+
+	It("retries builds with a step that exited with 77", func() {
+		CmdOutputError = exitError(1)
+		CmdStderr = []byte("ERROR: failed to solve: process \"/bin/sh -c pups\" did not complete successfully: exit code: 77\n")
+		docker.Retry.Attempts = 2
+		runner := docker.DockerBuilder{Config: conf, Stdin: bytes.NewReader([]byte("FROM base")), ImageTag: "test/test"}
+		err := runner.Run(ctx)
+
+		var exitErr interface{ ExitCode() int }
+		Expect(errors.As(err, &exitErr)).To(BeTrue())
+		Expect(exitErr.ExitCode()).To(Equal(77))
+		Expect(countCmds("docker build")).To(Equal(2))
+		for _, cmd := range RanCmds {
+			stdin := &bytes.Buffer{}
+			stdin.ReadFrom(cmd.Stdin) //nolint:errcheck
+			Expect(stdin.String()).To(Equal("FROM base"))
+		}
+	})
+})
@@ -0,0 +1,232 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Network podman attaches linked containers to, as it has no --link.
+const linkNetwork = "launcher"
+
+// Differences between the docker compatible CLIs launcher can drive.
+type IRuntime interface {
+	Name() string
+	// Path to the runtime's binary.
+	Path() string
+	// Whether builds understand BuildKit only Dockerfile syntax, like RUN --mount.
+	BuildMounts() bool
+	// Environment and runtime specific flags for a build in dir.
+	BuildEnv() []string
+	BuildFlags(dir string, configFile string) []string
+	// Build flags importing and exporting the cache of a site, for a cache policy other than none.
+	BuildCacheFlags(cache CachePolicy, name string, key string) ([]string, error)
+	// Run flags connecting a container to its configured links. Unless this is a dry run,
+	// anything the flags rely on, like networks, is set up first.
+	LinkArgs(ctx context.Context, config *config.Config, dryRun bool) ([]string, error)
+	// Commit changes the runtime can apply, dropped changes are reported.
+	CommitChanges(changes []string) []string
+}
+
+var Runtime IRuntime = &DockerRuntime{}
+
+// Returns the runtime selected by name: "docker", "podman", or "nerdctl".
+func NewRuntime(name string) (IRuntime, error) {
+	switch name {
+	case "", "docker":
+		return &DockerRuntime{}, nil
+	case "podman", "nerdctl":
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return nil, errors.New(name + " was not found in PATH")
+		}
+		if name == "podman" {
+			return &PodmanRuntime{Binary: path}, nil
+		}
+		return &NerdctlRuntime{Binary: path}, nil
+	}
+	return nil, errors.New("unknown container runtime: " + name)
+}
+
+type DockerRuntime struct{}
+
+func (r *DockerRuntime) Name() string {
+	return "docker"
+}
+
+// The docker binary is detected on startup, as either docker.io or docker.
+func (r *DockerRuntime) Path() string {
+	return utils.DockerPath
+}
+
+func (r *DockerRuntime) BuildMounts() bool {
+	return true
+}
+
+func (r *DockerRuntime) BuildEnv() []string {
+	return []string{"DOCKER_BUILDKIT=1", "BUILDKIT_PROGRESS=plain"}
+}
+
+func (r *DockerRuntime) BuildFlags(dir string, configFile string) []string {
+	return []string{"--force-rm", "--shm-size=512m"}
+}
+
+func (r *DockerRuntime) BuildCacheFlags(cache CachePolicy, name string, key string) ([]string, error) {
+	return buildkitCacheFlags(cache, name, key), nil
+}
+
+func (r *DockerRuntime) LinkArgs(ctx context.Context, config *config.Config, dryRun bool) ([]string, error) {
+	args := []string{}
+	for _, v := range config.Links {
+		args = append(args, "--link", v.Link.Name+":"+v.Link.Alias)
+	}
+	return args, nil
+}
+
+func (r *DockerRuntime) CommitChanges(changes []string) []string {
+	return changes
+}
+
+// Podman builds with buildah, which may predate RUN --mount. The config is mounted
+// as a build volume instead. Links are replaced by a shared network, with linked
+// containers reachable under their alias.
+type PodmanRuntime struct {
+	Binary string
+}
+
+func (r *PodmanRuntime) Name() string {
+	return "podman"
+}
+
+func (r *PodmanRuntime) Path() string {
+	return r.Binary
+}
+
+func (r *PodmanRuntime) BuildMounts() bool {
+	return false
+}
+
+func (r *PodmanRuntime) BuildEnv() []string {
+	return []string{}
+}
+
+func (r *PodmanRuntime) BuildFlags(dir string, configFile string) []string {
+	return []string{
+		"--force-rm",
+		"--shm-size=512m",
+		"--volume", filepath.Join(dir, configFile) + ":/temp-config.yaml:ro,Z",
+	}
+}
+
+// Buildah caches layers itself, and only imports and exports caches from repositories.
+func (r *PodmanRuntime) BuildCacheFlags(cache CachePolicy, name string, key string) ([]string, error) {
+	if cache.Mode == CacheRegistry {
+		return []string{"--layers", "--cache-from", cache.Ref, "--cache-to", cache.Ref}, nil
+	}
+	if cache.Dir != "" {
+		return nil, errors.New("podman has no local cache directories, drop --cache-dir")
+	}
+	return []string{"--layers"}, nil
+}
+
+func (r *PodmanRuntime) LinkArgs(ctx context.Context, config *config.Config, dryRun bool) ([]string, error) {
+	if len(config.Links) == 0 {
+		return []string{}, nil
+	}
+
+	if !dryRun {
+		if err := utils.CmdRunner(exec.CommandContext(ctx, r.Binary, "network", "exists", linkNetwork)).Run(); err != nil {
+			cmd := exec.CommandContext(ctx, r.Binary, "network", "create", linkNetwork)
+			fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+			if err := utils.CmdRunner(cmd).Run(); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, v := range config.Links {
+			cmd := exec.CommandContext(ctx, r.Binary, "network", "connect", "--alias", v.Link.Alias, linkNetwork, v.Link.Name)
+			fmt.Fprintln(utils.Out, cmd) //nolint:errcheck
+			if _, err := utils.CmdRunner(cmd).Output(); err != nil {
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) && strings.Contains(string(exitErr.Stderr), "already connected") {
+					continue
+				}
+				return nil, fmt.Errorf("could not connect linked container %s: %w", v.Link.Name, err)
+			}
+		}
+	}
+
+	return []string{"--network", linkNetwork}, nil
+}
+
+func (r *PodmanRuntime) CommitChanges(changes []string) []string {
+	return changes
+}
+
+// Nerdctl builds with BuildKit, but has neither --link nor network aliases. Linked
+// containers are added as hosts entries instead, which is what --link does under the hood.
+type NerdctlRuntime struct {
+	Binary string
+}
+
+func (r *NerdctlRuntime) Name() string {
+	return "nerdctl"
+}
+
+func (r *NerdctlRuntime) Path() string {
+	return r.Binary
+}
+
+func (r *NerdctlRuntime) BuildMounts() bool {
+	return true
+}
+
+func (r *NerdctlRuntime) BuildEnv() []string {
+	return []string{}
+}
+
+func (r *NerdctlRuntime) BuildFlags(dir string, configFile string) []string {
+	return []string{"--progress=plain"}
+}
+
+func (r *NerdctlRuntime) BuildCacheFlags(cache CachePolicy, name string, key string) ([]string, error) {
+	return buildkitCacheFlags(cache, name, key), nil
+}
+
+func (r *NerdctlRuntime) LinkArgs(ctx context.Context, config *config.Config, dryRun bool) ([]string, error) {
+	args := []string{}
+	for _, v := range config.Links {
+		inspect := exec.CommandContext(ctx, r.Binary, "inspect", "--format", "{{.NetworkSettings.IPAddress}}", v.Link.Name)
+		if dryRun {
+			args = append(args, "--add-host", v.Link.Alias+":$("+strings.Join(inspect.Args, " ")+")")
+			continue
+		}
+		output, err := utils.CmdRunner(inspect).Output()
+		if err != nil {
+			return nil, fmt.Errorf("could not find linked container %s: %w", v.Link.Name, err)
+		}
+		args = append(args, "--add-host", v.Link.Alias+":"+strings.TrimSpace(string(output)))
+	}
+	return args, nil
+}
+
+// nerdctl commit only applies CMD and ENTRYPOINT changes.
+func (r *NerdctlRuntime) CommitChanges(changes []string) []string {
+	supported := []string{}
+	for _, change := range changes {
+		instruction, _, _ := strings.Cut(change, " ")
+		if slices.Contains([]string{"CMD", "ENTRYPOINT"}, strings.ToUpper(instruction)) {
+			supported = append(supported, change)
+		} else {
+			fmt.Fprintln(utils.Out, "nerdctl commit does not support "+instruction+", skipping: "+change) //nolint:errcheck
+		}
+	}
+	return supported
+}
@@ -0,0 +1,93 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Runtime", func() {
+	var conf *config.Config
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.Out = &bytes.Buffer{}
+		utils.CommitWait = 0
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		ctx = context.Background()
+		conf = &config.Config{Name: "test"}
+		yaml.Unmarshal([]byte("links:\n- link: {name: data, alias: db}"), conf) //nolint:errcheck
+	})
+
+	AfterEach(func() {
+		docker.Runtime = &docker.DockerRuntime{}
+		utils.DockerPath = "docker"
+	})
+
+	Context("with podman", func() {
+		BeforeEach(func() {
+			docker.Runtime = &docker.PodmanRuntime{Binary: "podman"}
+			utils.DockerPath = "podman"
+		})
+
+		It("replaces links with a shared network", func() {
+			runner := docker.DockerRunner{Config: conf, ContainerId: "test", Detatch: true}
+			Expect(runner.Run(ctx)).To(Succeed())
+
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(Equal("podman network exists launcher"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(Equal("podman network connect --alias db launcher data"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("podman run"))
+			Expect(cmd.String()).To(ContainSubstring("--network launcher"))
+			Expect(cmd.String()).ToNot(ContainSubstring("--link"))
+		})
+
+		It("mounts the config as a build volume", func() {
+			builder := docker.DockerBuilder{Config: conf, Dir: "/tmp/build"}
+			Expect(builder.Run(ctx)).To(Succeed())
+
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("podman build"))
+			Expect(cmd.String()).To(ContainSubstring("--volume /tmp/build/config.yaml:/temp-config.yaml:ro,Z"))
+			Expect(cmd.Env).ToNot(ContainElement("DOCKER_BUILDKIT=1"))
+		})
+	})
+
+	Context("with nerdctl", func() {
+		BeforeEach(func() {
+			docker.Runtime = &docker.NerdctlRuntime{Binary: "nerdctl"}
+			utils.DockerPath = "nerdctl"
+		})
+
+		It("adds linked containers as hosts", func() {
+			CmdOutputResponse = []byte("10.4.0.2\n")
+			runner := docker.DockerRunner{Config: conf, ContainerId: "test", Detatch: true}
+			Expect(runner.Run(ctx)).To(Succeed())
+
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(Equal("nerdctl inspect --format {{.NetworkSettings.IPAddress}} data"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("--add-host db:10.4.0.2"))
+		})
+
+		It("only commits supported changes", func() {
+			conf.Links = nil
+			runner := docker.DockerPupsRunner{Config: conf, ContainerId: "123", SavedImageName: "local_discourse/test"}
+			Expect(runner.Run(ctx)).To(Succeed())
+
+			GetLastCommand()
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(Equal(`nerdctl commit --change CMD ["/sbin/boot"] 123 local_discourse/test`))
+		})
+	})
+})
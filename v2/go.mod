@@ -3,7 +3,6 @@ module github.com/discourse/launcher/v2
 go 1.22
 
 require (
-	dario.cat/mergo v1.0.1
 	github.com/Wing924/shellwords v1.1.0
 	github.com/alecthomas/kong v0.9.0
 	github.com/google/uuid v1.6.0
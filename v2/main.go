@@ -2,37 +2,58 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/discourse/launcher/v2/docker"
 	"github.com/discourse/launcher/v2/utils"
 	"github.com/posener/complete"
 	"github.com/willabides/kongplete"
 )
 
 type Cli struct {
-	Version      kong.VersionFlag   `help:"Show version."`
-	ConfDir      string             `default:"./containers" hidden:"" help:"Discourse pups config directory." predictor:"dir"`
-	TemplatesDir string             `default:"." hidden:"" help:"Home project directory containing a templates/ directory which in turn contains pups yaml templates." predictor:"dir"`
-	BuildDir     string             `default:"" hidden:"" help:"Temporary build directory for building images." predictor:"dir"`
-	BuildCmd     DockerBuildCmd     `cmd:"" name:"build" help:"Build a base image. This command does not need a running database. Saves resulting container."`
-	ConfigureCmd DockerConfigureCmd `cmd:"" name:"configure" help:"Configure and save an image with all dependencies and environment baked in. Updates themes and precompiles all assets. Saves resulting container."`
-	MigrateCmd   DockerMigrateCmd   `cmd:"" name:"migrate" help:"Run migration tasks for a site. Running container is temporary and is not saved."`
-	BootstrapCmd DockerBootstrapCmd `cmd:"" name:"bootstrap" help:"Builds, migrates, and configures an image. Resulting image is a fully built and configured Discourse image."`
+	Version       kong.VersionFlag   `help:"Show version."`
+	ConfDir       string             `default:"./containers" hidden:"" help:"Discourse pups config directory." predictor:"dir"`
+	TemplatesDir  string             `default:"." hidden:"" help:"Home project directory containing a templates/ directory which in turn contains pups yaml templates. May be a search path of directories separated by ':', the first directory holding a template wins." predictor:"dir"`
+	BuildDir      string             `default:"" hidden:"" help:"Temporary build directory for building images." predictor:"dir"`
+	StateDir      string             `default:"./shared/launcher" hidden:"" env:"LAUNCHER_STATE_DIR" help:"Directory launcher keeps state for each site in, like when post-deploy migrations last ran." predictor:"dir"`
+	Runtime       string             `name:"runtime" default:"docker" enum:"docker,podman,nerdctl" env:"LAUNCHER_RUNTIME" help:"Container runtime to use: docker, podman, or nerdctl."`
+	Profile       []string           `name:"profile" sep:"," env:"LAUNCHER_PROFILE" help:"Profiles to merge over the config, like 'staging' for containers/{config}.staging.yml. Later profiles win." predictor:"profile"`
+	Output        string             `name:"output" default:"text" enum:"text,json" env:"LAUNCHER_OUTPUT" help:"Output format: 'text', or 'json' for newline delimited json events, with launcher and docker output relayed as log events."`
+	WaitLock      bool               `name:"wait-lock" negatable:"" env:"LAUNCHER_WAIT_LOCK" help:"When another launcher command holds the lock on the site, wait for it rather than fail."`
+	RetryAttempts int                `name:"retry-attempts" default:"3" env:"LAUNCHER_RETRY_ATTEMPTS" help:"Times to run a build or pups step that exits with 77, which asks for a retry. 1 doesn't retry."`
+	RetryBackoff  time.Duration      `name:"retry-backoff" default:"10s" env:"LAUNCHER_RETRY_BACKOFF" help:"How long to wait before retrying, doubled for each retry after the first."`
+	Cache         string             `name:"cache" default:"none" enum:"none,local,registry" env:"LAUNCHER_CACHE" help:"How builds use the build cache: 'none' builds from scratch, 'local' reuses layers cached on this host, 'registry' also imports and exports the cache to --cache-ref."`
+	CacheDir      string             `name:"cache-dir" env:"LAUNCHER_CACHE_DIR" help:"Directory to keep a BuildKit local cache in with --cache=local, one for each site." predictor:"dir"`
+	CacheRef      string             `name:"cache-ref" env:"LAUNCHER_CACHE_REF" help:"Repository to keep the build cache in with --cache=registry."`
+	DockerBackend string             `name:"docker-backend" default:"cli" enum:"cli,api" env:"LAUNCHER_DOCKER_BACKEND" help:"How to talk to docker: 'cli' runs the docker binary, 'api' uses the Docker Engine API (honors DOCKER_HOST). Builds always use the docker binary."`
+	BuildCmd      DockerBuildCmd     `cmd:"" name:"build" help:"Build a base image. This command does not need a running database. Saves resulting container."`
+	ConfigureCmd  DockerConfigureCmd `cmd:"" name:"configure" help:"Configure and save an image with all dependencies and environment baked in. Updates themes and precompiles all assets. Saves resulting container."`
+	MigrateCmd    DockerMigrateCmd   `cmd:"" name:"migrate" help:"Run migration tasks for a site. Running container is temporary and is not saved."`
+	BootstrapCmd  DockerBootstrapCmd `cmd:"" name:"bootstrap" help:"Builds, migrates, and configures an image. Resulting image is a fully built and configured Discourse image."`
 
-	DestroyCmd DestroyCmd `cmd:"" name:"destroy" aliases:"down,rm" help:"Shutdown and destroy container."`
-	LogsCmd    LogsCmd    `cmd:"" name:"logs" help:"Print logs for container."`
-	CleanupCmd CleanupCmd `cmd:"" name:"cleanup" help:"Cleanup unused containers."`
-	EnterCmd   EnterCmd   `cmd:"" name:"enter" help:"Connects to a shell running in the container."`
-	RunCmd     RunCmd     `cmd:"" name:"run" help:"Runs the specified command in context of a docker container."`
-	StartCmd   StartCmd   `cmd:"" name:"start" aliases:"up" help:"Starts container."`
-	StopCmd    StopCmd    `cmd:"" name:"stop" help:"Stops container."`
-	RestartCmd RestartCmd `cmd:"" name:"restart" help:"Stops then starts container."`
-	RebuildCmd RebuildCmd `cmd:"" name:"rebuild" help:"Builds new image, then destroys old container, and starts new container."`
+	DestroyCmd  DestroyCmd  `cmd:"" name:"destroy" aliases:"down,rm" help:"Shutdown and destroy container."`
+	LogsCmd     LogsCmd     `cmd:"" name:"logs" help:"Print logs for container."`
+	CleanupCmd  CleanupCmd  `cmd:"" name:"cleanup" help:"Cleanup unused containers."`
+	EnterCmd    EnterCmd    `cmd:"" name:"enter" help:"Connects to a shell running in the container."`
+	RunCmd      RunCmd      `cmd:"" name:"run" help:"Runs the specified command in context of a docker container."`
+	StartCmd    StartCmd    `cmd:"" name:"start" aliases:"up" help:"Starts container."`
+	StopCmd     StopCmd     `cmd:"" name:"stop" help:"Stops container."`
+	RestartCmd  RestartCmd  `cmd:"" name:"restart" help:"Stops then starts container."`
+	RebuildCmd  RebuildCmd  `cmd:"" name:"rebuild" help:"Builds new image, then destroys old container, and starts new container."`
+	RollbackCmd RollbackCmd `cmd:"" name:"rollback" help:"Destroys the container, and starts the image the last rebuild replaced."`
+	StatusCmd   StatusCmd   `cmd:"" name:"status" help:"Show container and image state of sites."`
+	HistoryCmd  HistoryCmd  `cmd:"" name:"history" help:"Show the builds, deploys, starts, and destroys launcher ran for a site."`
+	DiffCmd     DiffCmd     `cmd:"" name:"diff" help:"Show differences between a config and its running container. Exits 2 when the container needs recreating, 3 when the image needs rebuilding."`
+
+	ConfigCmd   ConfigCmd   `cmd:"" name:"config" help:"Inspect configs."`
+	ValidateCmd ValidateCmd `cmd:"" name:"validate" help:"Check configs and their templates for mistakes without docker. Exits 1 when there are errors."`
+	ComposeCmd  ComposeCmd  `cmd:"" name:"compose" help:"Generate a docker compose project for a config. Known secrets are written to a separate env file."`
 
 	InstallCompletions kongplete.InstallCompletions `cmd:"" aliases:"sh" help:"Print shell autocompletions. Add output to dotfiles, or 'source <(./launcher sh)'."`
 }
@@ -43,12 +64,14 @@ func main() {
 
 	// pre parse to get config dir for prediction of conf dir
 	confFiles := utils.FindConfigNames()
+	profiles := utils.FindProfileNames()
 
 	parser := kong.Must(&cli, kong.UsageOnError(), kong.Vars{"version": utils.Version})
 
 	// Run kongplete.Complete to handle completion requests
 	kongplete.Complete(parser,
 		kongplete.WithPredictor("config", complete.PredictSet(confFiles...)),
+		kongplete.WithPredictor("profile", complete.PredictSet(profiles...)),
 		kongplete.WithPredictor("file", complete.PredictFiles("*")),
 		kongplete.WithPredictor("dir", complete.PredictDirs("*")),
 	)
@@ -56,6 +79,19 @@ func main() {
 	ctx, err := parser.Parse(os.Args[1:])
 	parser.FatalIfErrorf(err)
 
+	if cli.Output == "json" {
+		utils.EnableJsonEvents(os.Stdout)
+	}
+
+	docker.Runtime, err = docker.NewRuntime(cli.Runtime)
+	parser.FatalIfErrorf(err)
+	utils.DockerPath = docker.Runtime.Path()
+
+	docker.Backend, err = docker.NewBackend(cli.DockerBackend)
+	parser.FatalIfErrorf(err)
+	docker.Retry = docker.RetryPolicy{Attempts: cli.RetryAttempts, Backoff: cli.RetryBackoff}
+	docker.Cache = docker.CachePolicy{Mode: cli.Cache, Dir: cli.CacheDir, Ref: cli.CacheRef}
+
 	defer cancel()
 	ctx.BindTo(runCtx, (*context.Context)(nil))
 	sigChan := make(chan os.Signal, 1)
@@ -72,13 +108,28 @@ func main() {
 		}
 	}()
 	err = ctx.Run()
+	utils.FlushEvents()
 	if err == nil {
 		return
 	}
-	if exiterr, ok := err.(*exec.ExitError); ok {
-		// Magic exit code that indicates a retry
-		if exiterr.ExitCode() == 77 {
-			os.Exit(77)
+	// exec.ExitError from the docker cli, or docker.ContainerExitError from the api backend
+	var exiterr interface{ ExitCode() int }
+	var statusErr *utils.ExitStatusError
+	if utils.JsonEvents() {
+		status := 1
+		if errors.As(err, &statusErr) {
+			status = statusErr.Status
+		} else if errors.As(err, &exiterr) && exiterr.ExitCode() == docker.RetryExitCode {
+			status = docker.RetryExitCode
+		}
+		utils.Emit(utils.Event{Type: utils.EventError, Message: err.Error(), ExitCode: &status})
+		os.Exit(status)
+	} else if errors.As(err, &statusErr) {
+		os.Exit(statusErr.Status)
+	} else if errors.As(err, &exiterr) {
+		// Magic exit code that indicates a retry, still asked for once launcher's retries ran out
+		if exiterr.ExitCode() == docker.RetryExitCode {
+			os.Exit(docker.RetryExitCode)
 		} else if runCtx.Err() != nil {
 			fmt.Fprintln(utils.Out, "Aborted with exit code", exiterr.ExitCode()) //nolint:errcheck
 		} else {
@@ -2,6 +2,8 @@ package test_utils
 
 import (
 	"os/exec"
+	"strings"
+	"sync"
 
 	"github.com/discourse/launcher/v2/utils"
 )
@@ -10,18 +12,43 @@ var RanCmds []exec.Cmd
 var CmdOutputResponse []byte
 var CmdOutputError error
 
+// Written to the stderr of commands that are run.
+var CmdStderr []byte
+
+// Responses for commands containing the key, for tests where commands need different output.
+// The longest matching key wins. Other commands get CmdOutputResponse.
+var CmdOutputResponses map[string][]byte
+
+// Commands of sites built at once run concurrently.
+var ranCmdsMu sync.Mutex
+
 type FakeCmdRunner struct {
 	Cmd *exec.Cmd
 }
 
 func (r FakeCmdRunner) Run() error {
+	ranCmdsMu.Lock()
+	defer ranCmdsMu.Unlock()
 	RanCmds = append(RanCmds, *r.Cmd)
+	if len(CmdStderr) > 0 && r.Cmd.Stderr != nil {
+		r.Cmd.Stderr.Write(CmdStderr) //nolint:errcheck
+	}
 	return CmdOutputError
 }
 
 func (r FakeCmdRunner) Output() ([]byte, error) {
+	ranCmdsMu.Lock()
+	defer ranCmdsMu.Unlock()
 	RanCmds = append(RanCmds, *r.Cmd)
-	return CmdOutputResponse, CmdOutputError
+	response := CmdOutputResponse
+	match := ""
+	for k, v := range CmdOutputResponses {
+		if strings.Contains(r.Cmd.String(), k) && len(k) > len(match) {
+			response = v
+			match = k
+		}
+	}
+	return response, CmdOutputError
 }
 
 // Swap out CmdRunner with a fake instance that also returns created ICmdRunners on a channel
@@ -29,7 +56,9 @@ func (r FakeCmdRunner) Output() ([]byte, error) {
 func CreateNewFakeCmdRunner() func(cmd *exec.Cmd) utils.ICmdRunner {
 	RanCmds = []exec.Cmd{}
 	CmdOutputResponse = []byte{}
+	CmdOutputResponses = map[string][]byte{}
 	CmdOutputError = nil
+	CmdStderr = nil
 	return func(cmd *exec.Cmd) utils.ICmdRunner {
 		cmdRunner := &FakeCmdRunner{Cmd: cmd}
 		return cmdRunner
@@ -14,10 +14,12 @@ type ExecCmdRunner struct {
 }
 
 func (r *ExecCmdRunner) Run() error {
+	Emit(Event{Type: EventCommand, Command: r.Cmd.Args})
 	return r.Cmd.Run()
 }
 
 func (r *ExecCmdRunner) Output() ([]byte, error) {
+	Emit(Event{Type: EventCommand, Command: r.Cmd.Args})
 	return r.Cmd.Output()
 }
 
@@ -83,3 +83,6 @@ var DockerPath = findDockerPath()
 var Out io.Writer = os.Stdout
 
 var CommitWait = 2 * time.Second
+
+// Time between health checks while waiting for a container to come up.
+var HealthCheckInterval = 5 * time.Second
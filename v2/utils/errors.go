@@ -13,3 +13,16 @@ func NewBundledPluginError(parentError error, pluginName string, configFile stri
 func (e *BundledPluginError) Error() string {
 	return e.ParentError.Error() + ": the plugin '" + e.PluginName + "' is bundled with Discourse"
 }
+
+// Ends the command with an exit code, after the command has reported why.
+type ExitStatusError struct {
+	Status  int
+	Message string
+}
+
+func NewExitStatusError(status int, message string) error {
+	return &ExitStatusError{status, message}
+}
+func (e *ExitStatusError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where docker subprocesses write their output. With --output json, each line becomes a log event.
+var Stdout io.Writer = os.Stdout
+var Stderr io.Writer = os.Stderr
+
+// Event types of --output json.
+const (
+	EventPhaseStarted   = "phase_started"
+	EventPhaseFinished  = "phase_finished"
+	EventCommand        = "command"
+	EventImageCommitted = "image_committed"
+	EventContainer      = "container"
+	EventLog            = "log"
+	EventError          = "error"
+)
+
+// A line of --output json. Fields that don't apply to the event type are left out.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Phase   string    `json:"phase,omitempty"`
+	Config  string    `json:"config,omitempty"`
+	Command []string  `json:"command,omitempty"`
+	Image   string    `json:"image,omitempty"`
+	// when the image was created, RFC 3339
+	Created   string `json:"created,omitempty"`
+	Container string `json:"container,omitempty"`
+	Id        string `json:"id,omitempty"`
+	// launcher, stdout, or stderr
+	Stream  string `json:"stream,omitempty"`
+	Message string `json:"message,omitempty"`
+	// in seconds
+	Duration *float64 `json:"duration,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+}
+
+type eventWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Nil unless --output json.
+var events *eventWriter
+
+var logWriters []*lineWriter
+
+// Switches output to newline delimited json events on w. Output of launcher and of docker
+// subprocesses is relayed as log events.
+func EnableJsonEvents(w io.Writer) {
+	events = &eventWriter{w: w}
+	Out = newLogWriter("launcher")
+	Stdout = newLogWriter("stdout")
+	Stderr = newLogWriter("stderr")
+}
+
+// Switches back to text output.
+func DisableJsonEvents() {
+	events = nil
+	logWriters = nil
+	Out = os.Stdout
+	Stdout = os.Stdout
+	Stderr = os.Stderr
+}
+
+func JsonEvents() bool {
+	return events != nil
+}
+
+// Writes an event when output is json.
+func Emit(e Event) {
+	if events == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	events.w.Write(append(line, '\n')) //nolint:errcheck
+}
+
+// Emits log events for the output left without a trailing newline.
+func FlushEvents() {
+	for _, w := range logWriters {
+		w.flush()
+	}
+}
+
+// A phase of a command, like build or migrate.
+type Phase struct {
+	name    string
+	config  string
+	started time.Time
+}
+
+func StartPhase(name string, config string) *Phase {
+	Emit(Event{Type: EventPhaseStarted, Phase: name, Config: config})
+	return &Phase{name: name, config: config, started: time.Now()}
+}
+
+// Emits the end of the phase, with the error that ended it. Deferred with the address of a
+// named error result.
+func (p *Phase) Finish(err *error) {
+	duration := time.Since(p.started).Seconds()
+	event := Event{Type: EventPhaseFinished, Phase: p.name, Config: p.config, Duration: &duration}
+	if err != nil && *err != nil {
+		exitCode := ExitCode(*err)
+		event.Message = (*err).Error()
+		event.ExitCode = &exitCode
+	}
+	Emit(event)
+}
+
+// The exit code a command ends with for an error: an ExitStatusError's status, a failed
+// subprocess's exit code, or 1.
+func ExitCode(err error) int {
+	var statusErr *ExitStatusError
+	var exitErr interface{ ExitCode() int }
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.Status
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0:
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// Turns written output into a log event per line.
+func newLogWriter(stream string) *lineWriter {
+	w := &lineWriter{line: func(line string) {
+		Emit(Event{Type: EventLog, Stream: stream, Message: line})
+	}}
+	logWriters = append(logWriters, w)
+	return w
+}
+
+// Output of one of several sites running at once, like their builds. Each line is prefixed with
+// the site's name, or with --output json, becomes a log event with the site's config. Close
+// writes what is left without a trailing newline.
+func NewSiteWriter(config string, stream string) io.WriteCloser {
+	if JsonEvents() {
+		return &lineWriter{line: func(line string) {
+			Emit(Event{Type: EventLog, Stream: stream, Config: config, Message: line})
+		}}
+	}
+	w := Stdout
+	if stream == "stderr" {
+		w = Stderr
+	}
+	return &lineWriter{line: func(line string) {
+		siteWriterMu.Lock()
+		defer siteWriterMu.Unlock()
+		fmt.Fprintln(w, config+" | "+line) //nolint:errcheck
+	}}
+}
+
+// Keeps lines of sites writing at once whole.
+var siteWriterMu sync.Mutex
+
+// Calls line for each line written, without its newline.
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	line func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// keep the partial line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.line(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.line(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *lineWriter) Close() error {
+	w.flush()
+	return nil
+}
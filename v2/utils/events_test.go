@@ -0,0 +1,104 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Events", func() {
+	var out *bytes.Buffer
+
+	var parseEvents = func() []utils.Event {
+		parsed := []utils.Event{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			event := utils.Event{}
+			Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+			parsed = append(parsed, event)
+		}
+		return parsed
+	}
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.EnableJsonEvents(out)
+	})
+
+	AfterEach(func() {
+		utils.DisableJsonEvents()
+	})
+
+	It("emits nothing with text output", func() {
+		utils.DisableJsonEvents()
+		utils.Emit(utils.Event{Type: utils.EventLog, Message: "hello"})
+		Expect(out.String()).To(BeEmpty())
+		Expect(utils.JsonEvents()).To(BeFalse())
+	})
+
+	It("prefixes output of sites with their name", func() {
+		utils.DisableJsonEvents()
+		utils.Stdout = out
+		defer func() { utils.Stdout = os.Stdout }()
+		w := utils.NewSiteWriter("app", "stdout")
+		fmt.Fprint(w, "Step 1/2\nStep") //nolint:errcheck
+		fmt.Fprint(w, " 2/2")           //nolint:errcheck
+		Expect(w.Close()).To(Succeed())
+		Expect(out.String()).To(Equal("app | Step 1/2\napp | Step 2/2\n"))
+	})
+
+	It("tags log events of sites with their config", func() {
+		w := utils.NewSiteWriter("app", "stderr")
+		fmt.Fprintln(w, "warning: slow") //nolint:errcheck
+		events := parseEvents()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Config).To(Equal("app"))
+		Expect(events[0].Stream).To(Equal("stderr"))
+		Expect(events[0].Message).To(Equal("warning: slow"))
+	})
+
+	It("relays output a line at a time, with its stream", func() {
+		fmt.Fprint(utils.Stdout, "Step 1/3\nStep 2")  //nolint:errcheck
+		fmt.Fprint(utils.Stdout, "/3\r\nStep 3/3")    //nolint:errcheck
+		fmt.Fprintln(utils.Stderr, "warning: slow")   //nolint:errcheck
+		fmt.Fprintln(utils.Out, "starting container") //nolint:errcheck
+		utils.FlushEvents()
+
+		lines := []string{}
+		for _, event := range parseEvents() {
+			Expect(event.Type).To(Equal(utils.EventLog))
+			lines = append(lines, event.Stream+": "+event.Message)
+		}
+		Expect(lines).To(Equal([]string{
+			"stdout: Step 1/3",
+			"stdout: Step 2/3",
+			"stderr: warning: slow",
+			"launcher: starting container",
+			"stdout: Step 3/3",
+		}))
+	})
+
+	It("emits phases with their duration and error", func() {
+		var err error
+		utils.StartPhase("build", "app").Finish(&err)
+		err = utils.NewExitStatusError(2, "failed")
+		utils.StartPhase("migrate", "app").Finish(&err)
+
+		events := parseEvents()
+		Expect(events).To(HaveLen(4))
+		Expect(events[0].Type).To(Equal(utils.EventPhaseStarted))
+		Expect(events[1].Type).To(Equal(utils.EventPhaseFinished))
+		Expect(events[1].Duration).ToNot(BeNil())
+		Expect(events[1].ExitCode).To(BeNil())
+		Expect(events[3].Phase).To(Equal("migrate"))
+		Expect(events[3].Message).To(Equal("failed"))
+		Expect(*events[3].ExitCode).To(Equal(2))
+		Expect(out.String()).ToNot(ContainSubstring(`"container"`))
+	})
+})
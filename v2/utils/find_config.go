@@ -3,12 +3,24 @@ package utils
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 )
 
 // Find config names for autocomplete, given the current --conf-dir argument.
 func FindConfigNames() []string {
+	return ConfigNames(completionConfDir())
+}
+
+// Find profile names for autocomplete, given the current --conf-dir argument.
+func FindProfileNames() []string {
+	return ProfileNames(completionConfDir())
+}
+
+func completionConfDir() string {
 	compLine := os.Getenv("COMP_LINE")
 	flagLine := []string{}
 	found := false
@@ -28,23 +40,119 @@ func FindConfigNames() []string {
 	flags.SetOutput(&bytes.Buffer{})
 	confDirArg := flags.String("conf-dir", "./containers", "conf dir")
 	flags.Parse(flagLine) //nolint:errcheck
+	return *confDirArg
+}
 
-	// search in the current conf dir for any files
-	confDir := *confDirArg
+// Config names in confDir, sorted. Profile overlays of configs, like app.staging.yml next to
+// app.yml, aren't configs of their own. Returns no names when the directory can't be read.
+func ConfigNames(confDir string) []string {
+	names := yamlNames(confDir)
 	confFiles := []string{}
-	files, err := os.ReadDir(confDir)
+	for _, name := range names {
+		if config, _, ok := cutProfile(name); !ok || !slices.Contains(names, config) {
+			confFiles = append(confFiles, name)
+		}
+	}
+	return confFiles
+}
+
+// Names of the profiles of configs in confDir, sorted.
+func ProfileNames(confDir string) []string {
+	names := yamlNames(confDir)
+	profiles := []string{}
+	for _, name := range names {
+		if config, profile, ok := cutProfile(name); ok && slices.Contains(names, config) && !slices.Contains(profiles, profile) {
+			profiles = append(profiles, profile)
+		}
+	}
+	slices.Sort(profiles)
+	return profiles
+}
+
+// Splits app.staging into the config and the profile.
+func cutProfile(name string) (string, string, bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name, "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// Names of the configs in a directory: yml and yaml files without the extension, and
+// directories holding a config.
+func yamlNames(dir string) []string {
+	names := []string{}
+	files, err := os.ReadDir(dir)
 	if err == nil {
 		for _, file := range files {
-			if !file.IsDir() {
-				if strings.HasSuffix(file.Name(), ".yml") {
-					confName, _ := strings.CutSuffix(file.Name(), ".yml")
-					confFiles = append(confFiles, confName)
-				} else if strings.HasSuffix(file.Name(), ".yaml") {
-					confName, _ := strings.CutSuffix(file.Name(), ".yaml")
-					confFiles = append(confFiles, confName)
+			name := file.Name()
+			if file.IsDir() {
+				if _, err := configMainFile(filepath.Join(dir, name), name); err == nil {
+					names = append(names, name)
 				}
+			} else if confName, ok := strings.CutSuffix(name, ".yml"); ok {
+				names = append(names, confName)
+			} else if confName, ok := strings.CutSuffix(name, ".yaml"); ok {
+				names = append(names, confName)
 			}
 		}
 	}
-	return confFiles
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// The files of a config in confDir, in the order they merge: {name}.yml, {name}.yaml, or a
+// {name}/ directory holding {name}.yml and fragments merged over it in lexical order. A config
+// in more than one form is an error.
+func ConfigFiles(confDir string, name string) ([]string, error) {
+	found := []string{}
+	for _, candidate := range []string{name + ".yml", name + ".yaml", name + "/"} {
+		info, err := os.Stat(filepath.Join(confDir, candidate))
+		if err == nil && info.IsDir() == strings.HasSuffix(candidate, "/") {
+			found = append(found, candidate)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("no config %s in %s, expected %s.yml, %s.yaml, or a %s/ directory: %w", name, confDir, name, name, name, os.ErrNotExist)
+	case len(found) > 1:
+		return nil, fmt.Errorf("config %s is both %s in %s, keep one", name, strings.Join(found, " and "), confDir)
+	case found[0] != name+"/":
+		return []string{filepath.Join(confDir, found[0])}, nil
+	}
+
+	dir := filepath.Join(confDir, name)
+	main, err := configMainFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{main}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		filename := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() && filename != main && (strings.HasSuffix(entry.Name(), ".yml") || strings.HasSuffix(entry.Name(), ".yaml")) {
+			files = append(files, filename)
+		}
+	}
+	return files, nil
+}
+
+// The main file of a config directory, {name}.yml or {name}.yaml.
+func configMainFile(dir string, name string) (string, error) {
+	found := []string{}
+	for _, candidate := range []string{name + ".yml", name + ".yaml"} {
+		if info, err := os.Stat(filepath.Join(dir, candidate)); err == nil && !info.IsDir() {
+			found = append(found, filepath.Join(dir, candidate))
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("config directory %s has no %s.yml: %w", dir, name, os.ErrNotExist)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("config directory %s has both %s.yml and %s.yaml, keep one", dir, name, name)
 }
@@ -4,7 +4,9 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"errors"
 	"os"
+	"path/filepath"
 
 	"github.com/discourse/launcher/v2/utils"
 )
@@ -37,4 +39,64 @@ var _ = Describe("FindConfig", func() {
 		os.Setenv("COMP_LINE", "launcher") //nolint:errcheck
 		Expect(utils.FindConfigNames()).To(BeEmpty())
 	})
+
+	It("lists profile overlays as profiles, not configs", func() {
+		dir, _ := os.MkdirTemp("", "ddocker-test")
+		defer os.RemoveAll(dir) //nolint:errcheck
+		for _, name := range []string{"app.yml", "app.staging.yml", "db.yaml", "db.staging.yml", "db.eu.yml", "other.site.yml"} {
+			os.WriteFile(filepath.Join(dir, name), []byte{}, 0644) //nolint:errcheck
+		}
+		Expect(utils.ConfigNames(dir)).To(Equal([]string{"app", "db", "other.site"}))
+		Expect(utils.ProfileNames(dir)).To(Equal([]string{"eu", "staging"}))
+	})
+
+	Describe("ConfigFiles", func() {
+		var dir string
+
+		var write = func(name string) string {
+			filename := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(filename), 0755) //nolint:errcheck
+			os.WriteFile(filename, []byte{}, 0644)    //nolint:errcheck
+			return filename
+		}
+
+		BeforeEach(func() {
+			dir, _ = os.MkdirTemp("", "ddocker-test")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir) //nolint:errcheck
+		})
+
+		It("resolves yml and yaml files", func() {
+			app := write("app.yml")
+			db := write("db.yaml")
+			Expect(utils.ConfigFiles(dir, "app")).To(Equal([]string{app}))
+			Expect(utils.ConfigFiles(dir, "db")).To(Equal([]string{db}))
+		})
+
+		It("resolves a directory to its main file and fragments in lexical order", func() {
+			main := write("app/app.yml")
+			plugins := write("app/20-plugins.yaml")
+			env := write("app/10-env.yml")
+			write("app/README.md")
+			Expect(utils.ConfigFiles(dir, "app")).To(Equal([]string{main, env, plugins}))
+			Expect(utils.ConfigNames(dir)).To(Equal([]string{"app"}))
+		})
+
+		It("errors on missing configs, and configs in more than one form", func() {
+			_, err := utils.ConfigFiles(dir, "app")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+
+			write("app.yml")
+			write("app/app.yml")
+			_, err = utils.ConfigFiles(dir, "app")
+			Expect(err).To(MatchError("config app is both app.yml and app/ in " + dir + ", keep one"))
+
+			write("db/10-env.yml")
+			_, err = utils.ConfigFiles(dir, "db")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+			Expect(utils.ConfigNames(dir)).To(Equal([]string{"app"}))
+		})
+	})
 })
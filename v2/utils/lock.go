@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State file of the lock a launcher command holds on a site while it changes it.
+const lockState = "lock"
+
+// How often a waiting command checks the lock.
+var LockPollInterval = time.Second
+
+// The launcher command holding a site's lock.
+type LockHolder struct {
+	Pid     int       `json:"pid"`
+	Host    string    `json:"host"`
+	User    string    `json:"user"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+func (h LockHolder) String() string {
+	return fmt.Sprintf("pid %d on %s (%s, '%s') since %s",
+		h.Pid, h.Host, h.User, h.Command, h.Started.Local().Format(time.DateTime))
+}
+
+// A site is locked by another launcher command.
+type LockedError struct {
+	Config string
+	Holder LockHolder
+}
+
+func (e *LockedError) Error() string {
+	return e.Config + " is locked by " + e.Holder.String()
+}
+
+// A lock held on a site.
+type Lock struct {
+	path   string
+	holder LockHolder
+}
+
+// Takes the lock on a site, {state dir}/{config}/lock. A lock left by a process that is no
+// longer running on this host is taken over. When another command holds it, returns a
+// LockedError, or with wait, waits for it until ctx is done. An empty state dir locks nothing.
+func AcquireLock(ctx context.Context, stateDir string, config string, holder LockHolder, wait bool) (*Lock, error) {
+	if stateDir == "" {
+		return &Lock{}, nil
+	}
+	dir := filepath.Join(stateDir, config)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock := &Lock{path: filepath.Join(dir, lockState), holder: holder}
+	waiting := false
+	for {
+		current, err := lock.tryAcquire()
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			return lock, nil
+		}
+		if !wait {
+			return nil, &LockedError{Config: config, Holder: *current}
+		}
+		if !waiting {
+			fmt.Fprintln(Out, "Waiting for "+(&LockedError{Config: config, Holder: *current}).Error()) //nolint:errcheck
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(LockPollInterval):
+		}
+	}
+}
+
+// Creates the lock file, or returns who holds it.
+func (l *Lock) tryAcquire() (*LockHolder, error) {
+	content, err := json.Marshal(l.holder)
+	if err != nil {
+		return nil, err
+	}
+	// write then link, so the lock file is complete when it appears, and only one command
+	// creates it
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), "."+lockState)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close() //nolint:errcheck
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	for {
+		err := os.Link(tmp.Name(), l.path)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		holder, err := l.readHolder()
+		if errors.Is(err, fs.ErrNotExist) {
+			// released in between
+			continue
+		}
+		if err != nil || holder.stale() {
+			if err := l.removeStale(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return holder, nil
+	}
+}
+
+func (l *Lock) readHolder() (*LockHolder, error) {
+	content, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+	holder := &LockHolder{}
+	if err := json.Unmarshal(content, holder); err != nil {
+		return nil, errors.New("unreadable lock " + l.path + ": " + err.Error())
+	}
+	return holder, nil
+}
+
+// Removes a stale lock file. Another command may take over the same stale lock meanwhile:
+// the lock file is moved aside first, and put back when it turns out to be theirs.
+func (l *Lock) removeStale() error {
+	stale := l.path + fmt.Sprintf(".stale-%d", os.Getpid())
+	if err := os.Rename(l.path, stale); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(stale) //nolint:errcheck
+	content, err := os.ReadFile(stale)
+	if err != nil {
+		return err
+	}
+	holder := LockHolder{}
+	if json.Unmarshal(content, &holder) == nil && !holder.stale() {
+		os.Link(stale, l.path) //nolint:errcheck
+	}
+	return nil
+}
+
+// Whether the holding process is gone. Processes of other hosts sharing the state dir can't
+// be checked, and are taken to be running.
+func (h *LockHolder) stale() bool {
+	host, _ := os.Hostname()
+	if h.Host != host || h.Pid <= 0 {
+		return false
+	}
+	return h.Pid != os.Getpid() && !processRunning(h.Pid)
+}
+
+// Releases the lock, unless it was taken over.
+func (l *Lock) Release() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	holder, err := l.readHolder()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if holder.Pid != l.holder.Pid || holder.Host != l.holder.Host || !holder.Started.Equal(l.holder.Started) {
+		return nil
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,112 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Lock", func() {
+	var stateDir string
+	var ctx context.Context
+	var host string
+
+	var holder = func(pid int) utils.LockHolder {
+		return utils.LockHolder{Pid: pid, Host: host, User: "admin", Command: "launcher rebuild app", Started: time.Now().UTC()}
+	}
+
+	var writeLock = func(h utils.LockHolder) {
+		content, _ := json.Marshal(h)
+		os.MkdirAll(filepath.Join(stateDir, "app"), 0755)                   //nolint:errcheck
+		os.WriteFile(filepath.Join(stateDir, "app", "lock"), content, 0644) //nolint:errcheck
+	}
+
+	BeforeEach(func() {
+		utils.Out = &bytes.Buffer{}
+		utils.LockPollInterval = 10 * time.Millisecond
+		stateDir, _ = os.MkdirTemp("", "ddocker-state")
+		ctx = context.Background()
+		host, _ = os.Hostname()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir) //nolint:errcheck
+	})
+
+	It("locks a site until released", func() {
+		lock, err := utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		Expect(err).To(BeNil())
+
+		_, err = utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		var lockedErr *utils.LockedError
+		Expect(errors.As(err, &lockedErr)).To(BeTrue())
+		Expect(lockedErr.Holder.Command).To(Equal("launcher rebuild app"))
+		Expect(err.Error()).To(ContainSubstring("app is locked by pid"))
+
+		Expect(lock.Release()).To(Succeed())
+		_, err = os.Stat(filepath.Join(stateDir, "app", "lock"))
+		Expect(err).To(MatchError(os.IsNotExist, "IsNotExist"))
+		_, err = utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		Expect(err).To(BeNil())
+	})
+
+	It("takes over locks of processes that are gone", func() {
+		cmd := exec.Command("true")
+		Expect(cmd.Run()).To(Succeed())
+		writeLock(holder(cmd.Process.Pid))
+
+		_, err := utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		Expect(err).To(BeNil())
+	})
+
+	It("keeps locks held from other hosts", func() {
+		other := holder(1)
+		other.Host = "elsewhere"
+		writeLock(other)
+
+		_, err := utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		Expect(err).To(MatchError(ContainSubstring("on elsewhere")))
+	})
+
+	It("waits for the lock", func() {
+		lock, err := utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		Expect(err).To(BeNil())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			lock.Release() //nolint:errcheck
+		}()
+
+		_, err = utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), true)
+		Expect(err).To(BeNil())
+	})
+
+	It("stops waiting when cancelled", func() {
+		_, err := utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		Expect(err).To(BeNil())
+
+		cancelCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err = utils.AcquireLock(cancelCtx, stateDir, "app", holder(os.Getpid()), true)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("does not release a lock it lost", func() {
+		lock, err := utils.AcquireLock(ctx, stateDir, "app", holder(os.Getpid()), false)
+		Expect(err).To(BeNil())
+		writeLock(holder(os.Getpid() + 1))
+
+		Expect(lock.Release()).To(Succeed())
+		_, err = os.Stat(filepath.Join(stateDir, "app", "lock"))
+		Expect(err).To(BeNil())
+	})
+})
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package utils
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+func processRunning(pid int) bool {
+	err := unix.Kill(pid, 0)
+	// EPERM: running, as another user
+	return err == nil || errors.Is(err, unix.EPERM)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package utils
+
+import (
+	"os"
+)
+
+func processRunning(pid int) bool {
+	// finding a process opens it, which fails when it is gone
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release() //nolint:errcheck
+	return true
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Launcher keeps state between runs for each site in {state dir}/{config}.
+// An empty state dir keeps no state: reads find nothing, and writes are dropped.
+
+// Reads a state file for a config. Returns nil when it doesn't exist.
+func ReadState(stateDir string, config string, name string) ([]byte, error) {
+	if stateDir == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(filepath.Join(stateDir, config, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// Replaces a state file for a config.
+func WriteState(stateDir string, config string, name string, content []byte) error {
+	if stateDir == "" {
+		return nil
+	}
+	dir := filepath.Join(stateDir, config)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// write then rename, so an interrupted write leaves the old state
+	tmp, err := os.CreateTemp(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// Appends to a state file for a config.
+func AppendState(stateDir string, config string, name string, content []byte) error {
+	if stateDir == "" {
+		return nil
+	}
+	dir := filepath.Join(stateDir, config)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	return f.Close()
+}